@@ -0,0 +1,336 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/store"
+)
+
+const campaignHelp = `
+Campaign manages campaigns, the named groups of jobs that enqueue creates.
+
+	create   create a campaign for a range of ids, to be enqueued later
+	list     list the campaigns and how far they have come
+	pause    stop handing out the waiting jobs of a campaign
+	resume   start handing them out again
+	cancel   drop the waiting jobs of a campaign for good
+	set      change the weight and priority of a campaign
+
+Run "packtrack campaign <command> -h" for the flags of each.
+`
+
+func campaignCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("campaign", "create|list|pause|resume|cancel|set [flags]", campaignHelp)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "We need a campaign command")
+	}
+
+	args = fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "create":
+		return campaignCreateCmd(ctx, args)
+	case "list":
+		return campaignListCmd(ctx, args)
+	case "pause":
+		return campaignStatusCmd(ctx, args, "pause", store.CampaignPaused)
+	case "resume":
+		return campaignStatusCmd(ctx, args, "resume", store.CampaignActive)
+	case "cancel":
+		return campaignStatusCmd(ctx, args, "cancel", store.CampaignCancelled)
+	case "set":
+		return campaignSetCmd(ctx, args)
+	}
+	return usageErrorf(fs, "Unknown campaign command %q", fs.Arg(0))
+}
+
+const campaignCreateHelp = `
+Create creates a campaign for the ids in [rangeStart, rangeEnd) of the
+tracker. Nothing is queued until "packtrack enqueue -campaign name" is run.
+With -generator the ids are serial numbers of a known scheme, see "packtrack
+enqueue -h" for the ones there are.
+
+Nodes share their time between the active campaigns of their tracker by
+weight, so a campaign of weight 2 gets twice the jobs of one of weight 1.
+Campaigns with a higher priority go before the rest, for as long as they
+have jobs waiting.
+`
+
+func campaignCreateCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("campaign create", "-tracker name -rangeStart n -rangeEnd m name", campaignCreateHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	tracker := fs.String("tracker", "", "the tracker of the campaign")
+	rangeStart := fs.Int64("rangeStart", -1, "the first id of the campaign")
+	rangeEnd := fs.Int64("rangeEnd", -1, "the id after the last id of the campaign")
+	generator := fs.String("generator", "", "the scheme the ids are serial numbers in")
+	description := fs.String("description", "", "what the campaign is for")
+	createdBy := fs.String("createdBy", currentUser(), "who the campaign is for")
+	weight := fs.Int("weight", 1, "the share of the nodes the campaign gets")
+	priority := fs.Int("priority", 0, "the priority of the jobs of the campaign")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "We need exactly one campaign name")
+	}
+	if *tracker == "" {
+		return usageErrorf(fs, "A tracker is required")
+	}
+	if *rangeStart == -1 || *rangeEnd == -1 {
+		return usageErrorf(fs, "We need a range start and range end")
+	}
+	if *rangeStart >= *rangeEnd {
+		return usageErrorf(fs, "We need a range start smaller than the range end")
+	}
+	if err := checkGenerator(*generator, *rangeStart, *rangeEnd); err != nil {
+		return usageErrorf(fs, "%s", err.Error())
+	}
+	if *weight < 1 {
+		return usageErrorf(fs, "The weight must be positive")
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	t, err := lookupTracker(ctx, s, *tracker)
+	if err != nil {
+		return err
+	}
+
+	c := &store.Campaign{
+		Name:        fs.Arg(0),
+		TrackerID:   t.ID,
+		Description: *description,
+		RangeStart:  *rangeStart,
+		RangeEnd:    *rangeEnd,
+		Generator:   *generator,
+		CreatedBy:   *createdBy,
+		Weight:      *weight,
+		Priority:    *priority,
+	}
+	if err := s.CreateCampaign(ctx, c); err != nil {
+		return err
+	}
+	log.Printf("Created campaign %s, run \"packtrack enqueue -campaign %s\" to queue its jobs.\n", c.Name, c.Name)
+	return nil
+}
+
+const campaignListHelp = `
+List lists the campaigns, how far their jobs have come, how many of them
+found something, and how long is left at the pace of the last hour.
+`
+
+func campaignListCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("campaign list", "", campaignListHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if err := writeCampaigns(ctx, w, s); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+const campaignStatusHelp = `
+Pause, resume and cancel change the status of the named campaign, and of its
+waiting jobs along with it. Jobs that are running are left to finish. A
+cancelled campaign can't be resumed.
+`
+
+func campaignStatusCmd(ctx context.Context, args []string, name, status string) error {
+	fs := newFlagSet("campaign "+name, "name", campaignStatusHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "We need exactly one campaign name")
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	c, err := s.Campaign(ctx, fs.Arg(0))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("there is no campaign named %q", fs.Arg(0))
+	} else if err != nil {
+		return err
+	}
+
+	n, err := s.SetCampaignStatus(ctx, c, status)
+	if err != nil {
+		return err
+	}
+	log.Printf("Campaign %s is %s, along with %d of its jobs.\n", c.Name, c.Status, n)
+	return nil
+}
+
+const campaignSetHelp = `
+Set changes the weight and priority of the named campaign. The new priority
+is given to the jobs of the campaign that are waiting or paused too, and the
+nodes pick up the new weight within a minute.
+`
+
+func campaignSetCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("campaign set", "[-weight n] [-priority n] name", campaignSetHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	weight := fs.Int("weight", 0, "the share of the nodes the campaign gets, unchanged if not given")
+	priority := fs.Int("priority", 0, "the priority of the jobs of the campaign, unchanged if not given")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "We need exactly one campaign name")
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["weight"] && *weight < 1 {
+		return usageErrorf(fs, "The weight must be positive")
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	c, err := s.Campaign(ctx, fs.Arg(0))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("there is no campaign named %q", fs.Arg(0))
+	} else if err != nil {
+		return err
+	}
+
+	if !set["weight"] {
+		*weight = c.Weight
+	}
+	if !set["priority"] {
+		*priority = c.Priority
+	}
+	n, err := s.SetCampaignSchedule(ctx, c, *weight, *priority)
+	if err != nil {
+		return err
+	}
+	log.Printf("Campaign %s has weight %d and priority %d, along with %d of its jobs.\n", c.Name, c.Weight, c.Priority, n)
+	return nil
+}
+
+// writeCampaigns writes a table of the campaigns and their progress to w
+func writeCampaigns(ctx context.Context, w io.Writer, s store.JobQueue) error {
+	campaigns, err := s.Campaigns(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "CAMPAIGN\tTRACKER\tSTATUS\tWEIGHT\tPRIORITY\tIDS\tENQUEUED\tJOBS\tDONE\tFAILED\tHITS\tHIT RATE\tPROGRESS\tETA\tCREATED BY\tDESCRIPTION\n")
+	for i := range campaigns {
+		c := &campaigns[i]
+		p, err := s.CampaignProgress(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		enqueued := "yes"
+		if !c.Finished() {
+			enqueued = fmt.Sprintf("up to %d", c.Next)
+		}
+		eta := "-"
+		if d := p.ETA(); d > 0 {
+			eta = d.Round(time.Minute).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%d\t%d\t%d\t%d\t%.2f%%\t%.2f%%\t%s\t%s\t%s\n", c.Name, c.Tracker, c.Status,
+			c.Weight, c.Priority, describeCampaign(c), enqueued, p.Jobs, p.Done, p.Failed, p.Hits, p.HitRate()*100, p.Percent(), eta,
+			c.CreatedBy, c.Description)
+	}
+	return nil
+}
+
+// describeCampaign describes where the ids of the campaign come from
+func describeCampaign(c *store.Campaign) string {
+	if c.Source == "-" {
+		return "stdin"
+	} else if c.Source != "" {
+		return c.Source
+	} else if c.Generator != "" {
+		return fmt.Sprintf("%s [%d, %d)", c.Generator, c.RangeStart, c.RangeEnd)
+	}
+	return fmt.Sprintf("[%d, %d)", c.RangeStart, c.RangeEnd)
+}
+
+// currentUser returns the name of the user running packtrack, to record
+// who campaigns were created by.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,405 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package config loads the configuration of packtrack from a TOML file and
+// PACKTRACK_* environment variables.
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// EnvPrefix is the prefix of the environment variables we look at. The
+// rest of the name is the path to the setting in the file, in upper case
+// and joined by underscores, so work.workers is PACKTRACK_WORK_WORKERS and
+// the fleet_rate of the bring tracker is PACKTRACK_TRACKERS_BRING_FLEET_RATE.
+const EnvPrefix = "PACKTRACK_"
+
+// Duration is a time.Duration written as a string, like "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Config is the configuration of packtrack
+type Config struct {
+	// ConnString is the connection string to the database, or sqlite://
+	// followed by a path for SQLite. When empty, the libpq environment
+	// variables are used.
+	ConnString string `toml:"conn_string"`
+
+	// NodeID is the id of this node, needed to work
+	NodeID string `toml:"node_id"`
+
+	Work   Work   `toml:"work"`
+	Retry  Retry  `toml:"retry"`
+	Follow Follow `toml:"follow"`
+
+	// Trackers holds the rate limits and weights of each tracker, by name
+	Trackers map[string]Tracker `toml:"trackers"`
+}
+
+// Work configures how we perform jobs
+type Work struct {
+	// Tracker is the names of the trackers to work, separated by commas
+	Tracker        string   `toml:"tracker"`
+	Workers        int      `toml:"workers"`
+	Lease          Duration `toml:"lease"`
+	RequestTimeout Duration `toml:"request_timeout"`
+	Heartbeat      Duration `toml:"heartbeat"`
+	DeadNodeAfter  Duration `toml:"dead_node_after"`
+}
+
+// Retry configures how failed jobs are retried
+type Retry struct {
+	MaxAttempts    int      `toml:"max_attempts"`
+	BaseDelay      Duration `toml:"base_delay"`
+	MaxDelay       Duration `toml:"max_delay"`
+	RateLimitDelay Duration `toml:"rate_limit_delay"`
+}
+
+// Follow configures how what has been found is scraped again, to see where
+// it gets to
+type Follow struct {
+	// Cadence is how long to wait before following up on a status that
+	// isn't in Cadences.
+	Cadence Duration `toml:"cadence"`
+	// Cadences is how long to wait before following up on each status,
+	// as the tracker calls them.
+	Cadences map[string]Duration `toml:"cadences"`
+	// MaxAge is how long after it was found something is followed
+	MaxAge   Duration `toml:"max_age"`
+	Priority int      `toml:"priority"`
+	Interval Duration `toml:"interval"`
+}
+
+// CadenceOf returns how long to wait before following up on status
+func (f Follow) CadenceOf(status string) time.Duration {
+	if d, ok := f.Cadences[status]; ok {
+		return d.Duration
+	}
+	return f.Cadence.Duration
+}
+
+// Tracker configures the rate limits for a tracker, and its share of the
+// workers of a node working several trackers.
+type Tracker struct {
+	Weight         int      `toml:"weight"`
+	RateLimit      Duration `toml:"rate_limit"`
+	RateLimitPause Duration `toml:"rate_limit_pause"`
+	Adaptive       bool     `toml:"adaptive"`
+	MinRate        float64  `toml:"min_rate"`
+	MaxRate        float64  `toml:"max_rate"`
+	SlowLatency    Duration `toml:"slow_latency"`
+	FleetRate      float64  `toml:"fleet_rate"`
+	FleetBurst     float64  `toml:"fleet_burst"`
+}
+
+// Default returns the configuration used when nothing else is given
+func Default() *Config {
+	return &Config{
+		Work: Work{
+			Tracker:        "bring",
+			Workers:        1,
+			Lease:          Duration{store.DefaultLeaseDuration},
+			RequestTimeout: Duration{1 * time.Minute},
+			Heartbeat:      Duration{30 * time.Second},
+			DeadNodeAfter:  Duration{2 * time.Minute},
+		},
+		Retry: Retry{
+			MaxAttempts:    store.DefaultMaxAttempts,
+			BaseDelay:      Duration{store.DefaultBaseDelay},
+			MaxDelay:       Duration{store.DefaultMaxDelay},
+			RateLimitDelay: Duration{store.DefaultRateLimitDelay},
+		},
+		Follow: Follow{
+			Cadence: Duration{6 * time.Hour},
+			Cadences: map[string]Duration{
+				"IN_TRANSIT":       {1 * time.Hour},
+				"READY_FOR_PICKUP": {24 * time.Hour},
+			},
+			MaxAge:   Duration{30 * 24 * time.Hour},
+			Interval: Duration{1 * time.Minute},
+		},
+		Trackers: make(map[string]Tracker),
+	}
+}
+
+// DefaultTracker returns the rate limits used for trackers that aren't in
+// the config.
+func DefaultTracker() Tracker {
+	return Tracker{
+		Weight:         1,
+		RateLimit:      Duration{1 * time.Second},
+		RateLimitPause: Duration{10 * time.Minute},
+		MinRate:        0.05,
+		MaxRate:        10,
+		SlowLatency:    Duration{5 * time.Second},
+		FleetBurst:     1,
+	}
+}
+
+// Tracker returns the config of the named tracker
+func (c *Config) Tracker(name string) Tracker {
+	if t, ok := c.Trackers[name]; ok {
+		return t
+	}
+	return DefaultTracker()
+}
+
+// Load reads the config file at path, if path isn't empty, and then the
+// environment into c. Only the settings present are changed.
+func (c *Config) Load(path string) error {
+	if path != "" {
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+
+		// Trackers in the file only override the defaults they mention.
+		for name, decoded := range c.Trackers {
+			t := DefaultTracker()
+			tv := reflect.ValueOf(&t).Elem()
+			dv := reflect.ValueOf(decoded)
+			for i := 0; i < tv.NumField(); i++ {
+				if md.IsDefined("trackers", name, tv.Type().Field(i).Tag.Get("toml")) {
+					tv.Field(i).Set(dv.Field(i))
+				}
+			}
+			c.Trackers[name] = t
+		}
+	}
+
+	return c.loadEnv()
+}
+
+// loadEnv overrides the settings in c with the PACKTRACK_* environment
+func (c *Config) loadEnv() error {
+	if c.Trackers == nil {
+		c.Trackers = make(map[string]Tracker)
+	}
+
+	if err := loadEnv(EnvPrefix, reflect.ValueOf(c).Elem()); err != nil {
+		return err
+	}
+
+	// We look for the trackers we know about, and those in the file.
+	names := trackers.Names()
+	for name := range c.Trackers {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		t := c.Tracker(name)
+		prefix := EnvPrefix + "TRACKERS_" + strings.ToUpper(name) + "_"
+		if !hasEnvPrefix(prefix) {
+			continue
+		}
+		if err := loadEnv(prefix, reflect.ValueOf(&t).Elem()); err != nil {
+			return err
+		}
+		c.Trackers[name] = t
+	}
+	return nil
+}
+
+// hasEnvPrefix reports if any environment variable starts with prefix
+func hasEnvPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// loadEnv sets the fields of the struct v from the environment, descending
+// into nested structs. Maps are left alone.
+func loadEnv(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + strings.ToUpper(field.Tag.Get("toml"))
+		fv := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			if err := loadEnv(name+"_", fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, value); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// setValue parses s into v
+func setValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		return v.Addr().Interface().(*Duration).UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	}
+	return nil
+}
+
+// Validate checks that the configuration makes sense, returning an error
+// listing every problem found.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(c.Work.Workers >= 1, "work.workers must be at least 1")
+	check(c.Work.Lease.Duration > 0, "work.lease must be positive")
+	check(c.Work.RequestTimeout.Duration > 0, "work.request_timeout must be positive")
+	check(c.Work.RequestTimeout.Duration < c.Work.Lease.Duration, "work.request_timeout must be shorter than work.lease")
+	check(c.Work.Heartbeat.Duration > 0, "work.heartbeat must be positive")
+	check(c.Work.DeadNodeAfter.Duration > c.Work.Heartbeat.Duration, "work.dead_node_after must be longer than work.heartbeat")
+
+	check(c.Retry.MaxAttempts >= 1, "retry.max_attempts must be at least 1")
+	check(c.Retry.BaseDelay.Duration > 0, "retry.base_delay must be positive")
+	check(c.Retry.MaxDelay.Duration >= c.Retry.BaseDelay.Duration, "retry.max_delay must be at least retry.base_delay")
+	check(c.Retry.RateLimitDelay.Duration > 0, "retry.rate_limit_delay must be positive")
+
+	check(c.Follow.Cadence.Duration > 0, "follow.cadence must be positive")
+	statuses := make([]string, 0, len(c.Follow.Cadences))
+	for status := range c.Follow.Cadences {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		check(c.Follow.Cadences[status].Duration > 0, "follow.cadences.%s must be positive", status)
+	}
+	check(c.Follow.MaxAge.Duration > 0, "follow.max_age must be positive")
+	check(c.Follow.Interval.Duration > 0, "follow.interval must be positive")
+
+	names := make([]string, 0, len(c.Trackers))
+	for name := range c.Trackers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, c.Trackers[name].problems("trackers."+name)...)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// Validate checks that the rate limits of a tracker make sense
+func (t Tracker) Validate() error {
+	if problems := t.problems("tracker"); len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+func (t Tracker) problems(path string) []string {
+	var problems []string
+	check := func(ok bool, format string) {
+		if !ok {
+			problems = append(problems, path+"."+format)
+		}
+	}
+
+	check(t.Weight >= 1, "weight must be at least 1")
+	check(t.RateLimit.Duration > 0, "rate_limit must be positive")
+	check(t.RateLimitPause.Duration >= 0, "rate_limit_pause can't be negative")
+	check(t.MinRate > 0, "min_rate must be positive")
+	check(t.MaxRate >= t.MinRate, "max_rate must be at least min_rate")
+	check(t.SlowLatency.Duration >= 0, "slow_latency can't be negative")
+	check(t.FleetRate >= 0, "fleet_rate can't be negative")
+	check(t.FleetBurst >= 1, "fleet_burst must be at least 1")
+	return problems
+}
+
+// Store returns the configuration for the store
+func (c *Config) Store() store.Config {
+	return store.Config{
+		NodeID:        c.NodeID,
+		ConnString:    c.ConnString,
+		LeaseDuration: c.Work.Lease.Duration,
+		Retry: store.RetryPolicy{
+			MaxAttempts:    c.Retry.MaxAttempts,
+			BaseDelay:      c.Retry.BaseDelay.Duration,
+			MaxDelay:       c.Retry.MaxDelay.Duration,
+			RateLimitDelay: c.Retry.RateLimitDelay.Duration,
+		},
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	// The environment is only looked at for the trackers we know about,
+	// or that are in the file.
+	_ "github.com/rhermes/packtrack/trackers/bring"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "packtrack.toml")
+	err := ioutil.WriteFile(path, []byte(`
+node_id = "from-file"
+
+[work]
+workers = 4
+request_timeout = "30s"
+
+[trackers.bring]
+rate_limit = "2s"
+adaptive = true
+`), 0644)
+	if err != nil {
+		t.Fatalf("writing the config: %s", err)
+	}
+	t.Setenv("PACKTRACK_WORK_WORKERS", "8")
+	t.Setenv("PACKTRACK_RETRY_BASE_DELAY", "1m")
+	t.Setenv("PACKTRACK_TRACKERS_BRING_FLEET_RATE", "2.5")
+
+	cfg := Default()
+	if err := cfg.Load(path); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	if cfg.NodeID != "from-file" {
+		t.Errorf("node_id is %q, want it from the file", cfg.NodeID)
+	}
+	if cfg.Work.Workers != 8 {
+		t.Errorf("work.workers is %d, want the environment to win over the file", cfg.Work.Workers)
+	}
+	if cfg.Work.RequestTimeout.Duration != 30*time.Second {
+		t.Errorf("work.request_timeout is %s, want 30s", cfg.Work.RequestTimeout)
+	}
+	if cfg.Work.Lease.Duration != Default().Work.Lease.Duration {
+		t.Errorf("work.lease is %s, want the default", cfg.Work.Lease)
+	}
+	if cfg.Retry.BaseDelay.Duration != time.Minute {
+		t.Errorf("retry.base_delay is %s, want 1m", cfg.Retry.BaseDelay)
+	}
+
+	// The tracker gets the defaults for what the file doesn't mention.
+	want := DefaultTracker()
+	want.RateLimit = Duration{2 * time.Second}
+	want.Adaptive = true
+	want.FleetRate = 2.5
+	if got := cfg.Tracker("bring"); got != want {
+		t.Errorf("tracker bring is %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadEnvOnly(t *testing.T) {
+	t.Setenv("PACKTRACK_TRACKERS_BRING_FLEET_RATE", "4")
+	t.Setenv("PACKTRACK_CONN_STRING", "sqlite:///tmp/packtrack.db")
+
+	cfg := Default()
+	if err := cfg.Load(""); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if cfg.ConnString != "sqlite:///tmp/packtrack.db" {
+		t.Errorf("conn_string is %q, want it from the environment", cfg.ConnString)
+	}
+	want := DefaultTracker()
+	want.FleetRate = 4
+	if got := cfg.Tracker("bring"); got != want {
+		t.Errorf("tracker bring is %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "unknown setting",
+			file: "[work]\nworkerz = 4\n",
+			want: "unknown setting work.workerz",
+		},
+		{
+			name: "bad duration",
+			file: "[work]\nlease = \"forever\"\n",
+			want: "invalid duration",
+		},
+		{
+			name: "bad number in the environment",
+			env:  map[string]string{"PACKTRACK_WORK_WORKERS": "many"},
+			want: "PACKTRACK_WORK_WORKERS",
+		},
+		{
+			name: "bad tracker setting in the environment",
+			env:  map[string]string{"PACKTRACK_TRACKERS_BRING_ADAPTIVE": "sometimes"},
+			want: "PACKTRACK_TRACKERS_BRING_ADAPTIVE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "packtrack.toml")
+				if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatalf("writing the config: %s", err)
+				}
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			err := Default().Load(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load gave %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracker(t *testing.T) {
+	cfg := Default()
+	cfg.Trackers["bring"] = Tracker{Weight: 2, RateLimit: Duration{time.Minute}}
+
+	if got := cfg.Tracker("bring"); got.Weight != 2 || got.RateLimit.Duration != time.Minute {
+		t.Errorf("Tracker(bring) is %+v, want the one in the config", got)
+	}
+	if got := cfg.Tracker("other"); got != DefaultTracker() {
+		t.Errorf("Tracker(other) is %+v, want the defaults", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("the default config is invalid: %s", err)
+	}
+
+	tests := []struct {
+		want   string
+		change func(c *Config)
+	}{
+		{"work.workers must be at least 1", func(c *Config) { c.Work.Workers = 0 }},
+		{"work.lease must be positive", func(c *Config) { c.Work.Lease.Duration = 0 }},
+		{"work.request_timeout must be positive", func(c *Config) { c.Work.RequestTimeout.Duration = 0 }},
+		{"work.request_timeout must be shorter than work.lease", func(c *Config) { c.Work.RequestTimeout = c.Work.Lease }},
+		{"work.heartbeat must be positive", func(c *Config) { c.Work.Heartbeat.Duration = 0 }},
+		{"work.dead_node_after must be longer than work.heartbeat", func(c *Config) { c.Work.DeadNodeAfter = c.Work.Heartbeat }},
+		{"retry.max_attempts must be at least 1", func(c *Config) { c.Retry.MaxAttempts = 0 }},
+		{"retry.base_delay must be positive", func(c *Config) { c.Retry.BaseDelay.Duration = 0 }},
+		{"retry.max_delay must be at least retry.base_delay", func(c *Config) { c.Retry.MaxDelay.Duration = c.Retry.BaseDelay.Duration - 1 }},
+		{"retry.rate_limit_delay must be positive", func(c *Config) { c.Retry.RateLimitDelay.Duration = 0 }},
+		{"follow.cadence must be positive", func(c *Config) { c.Follow.Cadence.Duration = 0 }},
+		{"follow.cadences.IN_TRANSIT must be positive", func(c *Config) { c.Follow.Cadences["IN_TRANSIT"] = Duration{-time.Hour} }},
+		{"follow.max_age must be positive", func(c *Config) { c.Follow.MaxAge.Duration = 0 }},
+		{"follow.interval must be positive", func(c *Config) { c.Follow.Interval.Duration = 0 }},
+	}
+
+	trackerTests := []struct {
+		want   string
+		change func(t *Tracker)
+	}{
+		{"weight must be at least 1", func(t *Tracker) { t.Weight = 0 }},
+		{"rate_limit must be positive", func(t *Tracker) { t.RateLimit.Duration = 0 }},
+		{"rate_limit_pause can't be negative", func(t *Tracker) { t.RateLimitPause.Duration = -time.Second }},
+		{"min_rate must be positive", func(t *Tracker) { t.MinRate = 0 }},
+		{"max_rate must be at least min_rate", func(t *Tracker) { t.MaxRate = t.MinRate / 2 }},
+		{"slow_latency can't be negative", func(t *Tracker) { t.SlowLatency.Duration = -time.Second }},
+		{"fleet_rate can't be negative", func(t *Tracker) { t.FleetRate = -1 }},
+		{"fleet_burst must be at least 1", func(t *Tracker) { t.FleetBurst = 0.5 }},
+	}
+	for _, tt := range trackerTests {
+		tt := tt
+		tests = append(tests, struct {
+			want   string
+			change func(c *Config)
+		}{"trackers.bring." + tt.want, func(c *Config) {
+			tr := DefaultTracker()
+			tt.change(&tr)
+			c.Trackers["bring"] = tr
+		}})
+
+		// A tracker on its own is checked the same way.
+		tr := DefaultTracker()
+		tt.change(&tr)
+		if err := tr.Validate(); err == nil || !strings.Contains(err.Error(), "tracker."+tt.want) {
+			t.Errorf("Tracker.Validate gave %v, want an error about %q", err, tt.want)
+		}
+	}
+
+	for _, tt := range tests {
+		c := Default()
+		tt.change(c)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Validate gave %v, want an error about %q", err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/idgen"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const enqueueHelp = `
+Enqueue adds the jobs of a campaign to the queue. Either name a campaign made
+with "packtrack campaign create", or give a tracker and where the ids come
+from, which makes a campaign named after them unless there is one already.
+
+The ids are either the numbers in [rangeStart, rangeEnd), or the tracking ids
+read from -file, which is - for stdin.
+
+With -generator the numbers of the range are the serial numbers of tracking
+ids of a known scheme, with the check digit worked out for each, so no
+requests are wasted on ids that can't exist. The generators are:
+
+%s
+
+A file can be in one of these formats, which is guessed from the extension
+of the file unless -format is given:
+
+	line     an id per line, skipping blank lines and lines starting with #
+	csv      a CSV file with a header, the ids being in the first column or
+	         the one named by -column (.csv)
+	ndjson   a JSON object per line, the ids being in its id field or the
+	         one named by -column (.ndjson and .jsonl)
+
+Ids the tracker doesn't think are tracking ids are skipped and reported. Ids
+that are already queued for the tracker are skipped, unless -update is given,
+in which case they are queued to be scraped again.
+
+The ids are enqueued -chunk at a time, and the progress is recorded along
+with each chunk. If enqueue is stopped before it is done, running it again
+for the same campaign carries on where it stopped. For a file that means
+skipping the records that were read already, so give it the same file.
+`
+
+func enqueueCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("enqueue", "-campaign name | -tracker name (-rangeStart n -rangeEnd m [-generator spec] | -file path)",
+		fmt.Sprintf(enqueueHelp, indent(idgen.Specs, "\t")))
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	campaign := fs.String("campaign", "", "the campaign to enqueue, defaults to one named after the tracker and range or file")
+	tracker := fs.String("tracker", "", "the name of the tracker we will be using")
+	rangeStart := fs.Int64("rangeStart", -1, "The start of the insert range")
+	rangeEnd := fs.Int64("rangeEnd", -1, "The end of the insert range")
+	generator := fs.String("generator", "", "the scheme the numbers of the range are serial numbers in")
+	file := fs.String("file", "", "the file to read tracking ids from, - for stdin")
+	format := fs.String("format", "", "the format of the file: line, csv or ndjson")
+	column := fs.String("column", "", "the CSV column, by name or number, or NDJSON field with the ids")
+	description := fs.String("description", "", "what the campaign is for, if it is created")
+	weight := fs.Int("weight", 1, "the share of the nodes the campaign gets, if it is created")
+	priority := fs.Int("priority", 0, "the priority of the jobs of the campaign, if it is created")
+	update := fs.Bool("update", false, "queue ids that have already been queued again")
+	chunk := fs.Int("chunk", 100000, "how many ids to enqueue at a time")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	hasRange := *rangeStart != -1 || *rangeEnd != -1 || *generator != ""
+	hasFile := *file != ""
+	switch {
+	case hasRange && hasFile:
+		return usageErrorf(fs, "Give either a range or a file, not both")
+	case hasFile:
+		if *campaign == "" && *tracker == "" {
+			return usageErrorf(fs, "A tracker is required")
+		}
+		if *campaign == "" && *file == "-" {
+			return usageErrorf(fs, "A campaign name is required when reading from stdin")
+		}
+	case hasRange || *tracker != "" || *campaign == "":
+		hasRange = true
+		if *tracker == "" {
+			return usageErrorf(fs, "A tracker is required")
+		}
+		if *rangeStart == -1 || *rangeEnd == -1 {
+			return usageErrorf(fs, "We need a range start and range end")
+		}
+		if *rangeStart >= *rangeEnd {
+			return usageErrorf(fs, "We need a range start smaller than the range end")
+		}
+		if err := checkGenerator(*generator, *rangeStart, *rangeEnd); err != nil {
+			return usageErrorf(fs, "%s", err.Error())
+		}
+	}
+	switch *format {
+	case "", formatLine, formatCSV, formatNDJSON:
+	default:
+		return usageErrorf(fs, "Unknown format %q", *format)
+	}
+	if *weight < 1 {
+		return usageErrorf(fs, "The weight must be positive")
+	}
+	if *chunk <= 0 {
+		return usageErrorf(fs, "The chunk size must be positive")
+	}
+
+	source := *file
+	if hasFile && source != "-" {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			return err
+		}
+		source = abs
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	name := *campaign
+	switch {
+	case name != "":
+	case hasFile:
+		name = fmt.Sprintf("%s-%s", *tracker, filepath.Base(source))
+	case *generator != "":
+		name = fmt.Sprintf("%s-%s-%d-%d", *tracker, *generator, *rangeStart, *rangeEnd)
+	default:
+		name = fmt.Sprintf("%s-%d-%d", *tracker, *rangeStart, *rangeEnd)
+	}
+
+	c, err := s.Campaign(ctx, name)
+	switch {
+	case err == sql.ErrNoRows && !hasRange && !hasFile:
+		return fmt.Errorf("there is no campaign named %q, give a tracker and a range or file to create it", name)
+
+	case err == sql.ErrNoRows && *tracker == "":
+		return fmt.Errorf("there is no campaign named %q, give a tracker to create it", name)
+
+	case err == sql.ErrNoRows:
+		t, err := findTracker(ctx, s, *tracker)
+		if err != nil {
+			return err
+		}
+		c = &store.Campaign{
+			Name:        name,
+			TrackerID:   t.ID,
+			Description: *description,
+			CreatedBy:   currentUser(),
+			Weight:      *weight,
+			Priority:    *priority,
+		}
+		if hasFile {
+			c.Source = source
+		} else {
+			c.RangeStart, c.RangeEnd, c.Generator = *rangeStart, *rangeEnd, *generator
+		}
+		if err := s.CreateCampaign(ctx, c); err != nil {
+			return err
+		}
+		log.Printf("Created campaign %s.\n", c.Name)
+
+	case err != nil:
+		return err
+
+	case hasRange && (c.Tracker != *tracker || c.Source != "" || c.RangeStart != *rangeStart || c.RangeEnd != *rangeEnd ||
+		c.Generator != *generator):
+		want := &store.Campaign{RangeStart: *rangeStart, RangeEnd: *rangeEnd, Generator: *generator}
+		return fmt.Errorf("campaign %s is for %s of %s, not %s of %s", c.Name, describeCampaign(c), c.Tracker, describeCampaign(want), *tracker)
+
+	case hasFile && ((*tracker != "" && c.Tracker != *tracker) || c.Source != source):
+		return fmt.Errorf("campaign %s reads %s for %s, not %s", c.Name, describeCampaign(c), c.Tracker, *file)
+	}
+
+	if _, err := findTracker(ctx, s, c.Tracker); err != nil {
+		return err
+	}
+	if _, err := s.Exploration(ctx, c.ID); err == nil {
+		return fmt.Errorf("campaign %s is being explored, use \"packtrack explore\" to carry on with it", c.Name)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	mode := store.InsertSkip
+	if *update {
+		mode = store.InsertUpdate
+	}
+
+	if c.Source == "" {
+		return enqueueRange(ctx, s, mode, c, *chunk)
+	}
+	return enqueueFile(ctx, s, mode, c, *format, *column, *chunk)
+}
+
+// checkGenerator checks that the generator spec, if there is one, is one we
+// know and has room for the range.
+func checkGenerator(spec string, rangeStart, rangeEnd int64) error {
+	if spec == "" {
+		return nil
+	}
+	g, err := idgen.Parse(spec)
+	if err != nil {
+		return err
+	}
+	if rangeStart < 0 || rangeEnd > g.Size() {
+		return fmt.Errorf("the serial numbers of %s are [0, %d), which the range must be within", spec, g.Size())
+	}
+	return nil
+}
+
+// enqueuer returns the tracker of the campaign, if it can make jobs from
+// tracking ids.
+func enqueuer(c *store.Campaign) (trackers.Enqueuer, error) {
+	t, _ := trackers.Get(c.Tracker)
+	e, ok := t.(trackers.Enqueuer)
+	if !ok {
+		return nil, fmt.Errorf("tracker %s can't make jobs from tracking ids", c.Tracker)
+	}
+	return e, nil
+}
+
+// enqueueRange enqueues the ids of the campaign a chunk at a time, carrying
+// on from where it was left.
+func enqueueRange(ctx context.Context, s store.JobQueue, mode store.InsertMode, c *store.Campaign, chunk int) error {
+	if c.Finished() {
+		log.Printf("Campaign %s has been enqueued already, give -campaign a new name to enqueue the range again.\n", c.Name)
+		return nil
+	}
+	if c.Status != store.CampaignActive {
+		return fmt.Errorf("campaign %s is %s", c.Name, c.Status)
+	}
+
+	e, err := enqueuer(c)
+	if err != nil {
+		return err
+	}
+	id := func(n int64) string { return strconv.FormatInt(n, 10) }
+	if c.Generator != "" {
+		g, err := idgen.Parse(c.Generator)
+		if err != nil {
+			return err
+		}
+		id = g.ID
+	}
+	if c.Next > c.RangeStart {
+		log.Printf("Resuming campaign %s at %d, %d ids are left.\n", c.Name, c.Next, c.RangeEnd-c.Next)
+	}
+
+	args := make([][]byte, 0, chunk)
+	createdAt := make([]time.Time, 0, chunk)
+	var total store.InsertResult
+	beforeInsert := time.Now()
+
+	for !c.Finished() {
+		next := c.Next + int64(chunk)
+		if next > c.RangeEnd {
+			next = c.RangeEnd
+		}
+
+		args, createdAt = args[:0], createdAt[:0]
+		now := time.Now()
+		for i := c.Next; i < next; i++ {
+			a, err := e.Args(id(i))
+			if err != nil {
+				return err
+			}
+			args = append(args, a)
+			createdAt = append(createdAt, now)
+		}
+
+		res, err := s.InsertCampaignJobs(ctx, c, mode, args, createdAt, next)
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Stopped at %d, run the same command again to carry on.\n", c.Next)
+			return ctx.Err()
+		} else if err != nil {
+			return err
+		}
+		total.New += res.New
+		total.Existing += res.Existing
+		total.Updated += res.Updated
+
+		done := c.Next - c.RangeStart
+		all := c.RangeEnd - c.RangeStart
+		log.Printf("Enqueued %d of %d ids aka %.2f%%.\n", done, all, float64(done)/float64(all)*100)
+	}
+
+	log.Printf("We spent %s inserting into the database.\n", time.Since(beforeInsert).String())
+	log.Printf("%d new jobs, %d already queued (%d queued again).\n", total.New, total.Existing, total.Updated)
+	return nil
+}
+
+// maxReported is how many of the invalid ids we tell about one by one
+const maxReported = 10
+
+// enqueueFile enqueues the ids read from the source of the campaign a chunk
+// of records at a time, skipping the records that were enqueued already.
+func enqueueFile(ctx context.Context, s store.JobQueue, mode store.InsertMode, c *store.Campaign, format, column string, chunk int) error {
+	if c.Finished() {
+		log.Printf("Campaign %s has been enqueued already, give -campaign a new name to enqueue the file again.\n", c.Name)
+		return nil
+	}
+	if c.Status != store.CampaignActive {
+		return fmt.Errorf("campaign %s is %s", c.Name, c.Status)
+	}
+
+	e, err := enqueuer(c)
+	if err != nil {
+		return err
+	}
+
+	var f io.Reader = os.Stdin
+	var size int64
+	if c.Source != "-" {
+		file, err := os.Open(c.Source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if fi, err := file.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+		f = file
+	}
+	if format == "" {
+		format = guessFormat(c.Source)
+	}
+
+	counter := &countingReader{r: f}
+	r, err := newIDReader(counter, format, column)
+	if err != nil {
+		return fmt.Errorf("%s: %s", describeCampaign(c), err.Error())
+	}
+
+	if c.Next > 0 {
+		log.Printf("Resuming campaign %s, skipping the %d records enqueued already.\n", c.Name, c.Next)
+		for i := int64(0); i < c.Next; i++ {
+			if _, err := r.next(); err == io.EOF {
+				return fmt.Errorf("%s has only %d records, but %d were enqueued already, is it the same file?", describeCampaign(c), i, c.Next)
+			} else if _, ok := err.(*recordError); err != nil && !ok {
+				return err
+			}
+		}
+	}
+
+	args := make([][]byte, 0, chunk)
+	createdAt := make([]time.Time, 0, chunk)
+	var total store.InsertResult
+	var invalid int64
+	beforeInsert := time.Now()
+
+	for eof := false; !eof; {
+		args, createdAt = args[:0], createdAt[:0]
+		now := time.Now()
+		var read int64
+		for read < int64(chunk) {
+			id, err := r.next()
+			if err == io.EOF {
+				eof = true
+				break
+			} else if _, ok := err.(*recordError); err != nil && !ok {
+				return err
+			}
+			read++
+
+			if err == nil && id == "" {
+				continue
+			}
+			var a []byte
+			if err == nil {
+				a, err = e.Args(id)
+			}
+			if err != nil {
+				invalid++
+				if invalid <= maxReported {
+					log.Printf("Skipping record %d on line %d: %s\n", c.Next+read, r.line(), err.Error())
+				}
+				continue
+			}
+			args = append(args, a)
+			createdAt = append(createdAt, now)
+		}
+		if read == 0 {
+			break
+		}
+
+		res, err := s.InsertCampaignJobs(ctx, c, mode, args, createdAt, c.Next+read)
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Stopped after %d records, run the same command again to carry on.\n", c.Next)
+			return ctx.Err()
+		} else if err != nil {
+			return err
+		}
+		total.New += res.New
+		total.Existing += res.Existing
+		total.Updated += res.Updated
+
+		if size > 0 {
+			log.Printf("Enqueued %d records aka %.2f%% of the file.\n", c.Next, float64(counter.n)/float64(size)*100)
+		} else {
+			log.Printf("Enqueued %d records.\n", c.Next)
+		}
+	}
+
+	if err := s.FinishCampaign(ctx, c); err != nil {
+		return err
+	}
+
+	log.Printf("We spent %s inserting into the database.\n", time.Since(beforeInsert).String())
+	log.Printf("%d new jobs, %d already queued (%d queued again).\n", total.New, total.Existing, total.Updated)
+	if invalid > 0 {
+		log.Printf("%d records had no valid tracking id, and were skipped.\n", invalid)
+	}
+	return nil
+}
+
+// indent puts prefix in front of every line of s
+func indent(s, prefix string) string {
+	return prefix + strings.Replace(s, "\n", "\n"+prefix, -1)
+}
@@ -0,0 +1,458 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/idgen"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const exploreHelp = `
+Explore finds the parts of a range where there are tracking ids, without
+scraping all of it. The range is split into blocks of -block ids, and every
+-stride'th id of each block is enqueued as a sample. Once the samples of a
+block have been performed, the block is judged: if enough of them found
+something it is sampled -factor times more densely, until every id of it
+has been enqueued, and otherwise it is abandoned. The blocks next to one
+with hits are sampled again at its density even if they were abandoned, as
+ids tend to come in runs.
+
+The range and how it is explored is kept in the database, so explore can be
+stopped and run again for the same campaign for as long as it takes. It
+judges the blocks every -interval, which should be about how long it takes
+the nodes to work through a round of samples, or once with -once.
+
+Pausing the campaign pauses the exploration, and cancelling it stops it.
+Only the samples that are enqueued for the campaign are judged, so ids that
+were already queued by another campaign don't count.
+`
+
+// exploreChunk is how many samples are enqueued at a time
+const exploreChunk = 100000
+
+func exploreCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("explore", "-campaign name | -tracker name -rangeStart n -rangeEnd m [-generator spec]", exploreHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	campaign := fs.String("campaign", "", "the campaign to explore, defaults to one named after the tracker and range")
+	tracker := fs.String("tracker", "", "the name of the tracker we will be using")
+	rangeStart := fs.Int64("rangeStart", -1, "The start of the range")
+	rangeEnd := fs.Int64("rangeEnd", -1, "The end of the range")
+	generator := fs.String("generator", "", "the scheme the numbers of the range are serial numbers in")
+	description := fs.String("description", "", "what the campaign is for, if it is created")
+	weight := fs.Int("weight", 1, "the share of the nodes the campaign gets, if it is created")
+	priority := fs.Int("priority", 0, "the priority of the jobs of the campaign, if it is created")
+	block := fs.Int64("block", 1000, "how many ids are judged together")
+	stride := fs.Int64("stride", 100, "how far apart the first samples of a block are")
+	factor := fs.Int64("factor", 10, "how much denser each round of samples of a block is")
+	minHitRate := fs.Float64("minHitRate", 0, "the share of the samples of a block that must find something for it to be sampled more densely")
+	interval := fs.Duration("interval", 5*time.Minute, "how often to judge the blocks")
+	once := fs.Bool("once", false, "judge the blocks once and exit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	hasRange := *rangeStart != -1 || *rangeEnd != -1 || *generator != ""
+	if hasRange || *campaign == "" {
+		hasRange = true
+		if *tracker == "" {
+			return usageErrorf(fs, "A tracker is required")
+		}
+		if *rangeStart == -1 || *rangeEnd == -1 {
+			return usageErrorf(fs, "We need a range start and range end")
+		}
+		if *rangeStart >= *rangeEnd {
+			return usageErrorf(fs, "We need a range start smaller than the range end")
+		}
+		if err := checkGenerator(*generator, *rangeStart, *rangeEnd); err != nil {
+			return usageErrorf(fs, "%s", err.Error())
+		}
+	}
+	if *weight < 1 {
+		return usageErrorf(fs, "The weight must be positive")
+	}
+	if *interval <= 0 {
+		return usageErrorf(fs, "The interval must be positive")
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	name := *campaign
+	switch {
+	case name != "":
+	case *generator != "":
+		name = fmt.Sprintf("%s-explore-%s-%d-%d", *tracker, *generator, *rangeStart, *rangeEnd)
+	default:
+		name = fmt.Sprintf("%s-explore-%d-%d", *tracker, *rangeStart, *rangeEnd)
+	}
+
+	c, err := s.Campaign(ctx, name)
+	switch {
+	case err == sql.ErrNoRows && !hasRange:
+		return fmt.Errorf("there is no campaign named %q, give a tracker and a range to create it", name)
+
+	case err == sql.ErrNoRows:
+		t, err := findTracker(ctx, s, *tracker)
+		if err != nil {
+			return err
+		}
+		c = &store.Campaign{
+			Name:        name,
+			TrackerID:   t.ID,
+			Description: *description,
+			CreatedBy:   currentUser(),
+			RangeStart:  *rangeStart,
+			RangeEnd:    *rangeEnd,
+			Generator:   *generator,
+			Weight:      *weight,
+			Priority:    *priority,
+		}
+		if err := s.CreateCampaign(ctx, c); err != nil {
+			return err
+		}
+		log.Printf("Created campaign %s.\n", c.Name)
+
+	case err != nil:
+		return err
+
+	case hasRange && (c.Tracker != *tracker || c.Source != "" || c.RangeStart != *rangeStart || c.RangeEnd != *rangeEnd ||
+		c.Generator != *generator):
+		want := &store.Campaign{RangeStart: *rangeStart, RangeEnd: *rangeEnd, Generator: *generator}
+		return fmt.Errorf("campaign %s is for %s of %s, not %s of %s", c.Name, describeCampaign(c), c.Tracker, describeCampaign(want), *tracker)
+	}
+
+	if _, err := findTracker(ctx, s, c.Tracker); err != nil {
+		return err
+	}
+
+	e, err := s.Exploration(ctx, c.ID)
+	switch {
+	case err == sql.ErrNoRows && c.Source != "":
+		return fmt.Errorf("campaign %s reads %s, only a range can be explored", c.Name, describeCampaign(c))
+
+	case err == sql.ErrNoRows && (c.Finished() || c.Next > c.RangeStart):
+		return fmt.Errorf("campaign %s is being enqueued in full, and can't be explored", c.Name)
+
+	case err == sql.ErrNoRows:
+		e = &store.Exploration{CampaignID: c.ID, BlockSize: *block, Stride: *stride, Factor: *factor, MinHitRate: *minHitRate}
+		if err := s.CreateExploration(ctx, e); err != nil {
+			return err
+		}
+
+	case err != nil:
+		return err
+
+	case set["block"] && *block != e.BlockSize, set["stride"] && *stride != e.Stride,
+		set["factor"] && *factor != e.Factor, set["minHitRate"] && *minHitRate != e.MinHitRate:
+		return fmt.Errorf("campaign %s is explored in blocks of %d at a stride of %d, a factor of %d and a minimum hit rate of %g, which can't be changed",
+			c.Name, e.BlockSize, e.Stride, e.Factor, e.MinHitRate)
+	}
+
+	x, err := newExplorer(s, c, e)
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := x.round(ctx)
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Stopped, run the same command again to carry on.\n")
+			return ctx.Err()
+		} else if err != nil || done || *once {
+			return err
+		}
+
+		select {
+		case <-time.After(*interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// explorer explores the range of a campaign a round at a time
+type explorer struct {
+	s       store.JobQueue
+	c       *store.Campaign
+	e       *store.Exploration
+	tracker trackers.Tracker
+	enq     trackers.Enqueuer
+	// id makes the tracking id of a number of the range
+	id func(int64) string
+}
+
+func newExplorer(s store.JobQueue, c *store.Campaign, e *store.Exploration) (*explorer, error) {
+	enq, err := enqueuer(c)
+	if err != nil {
+		return nil, err
+	}
+	t, _ := trackers.Get(c.Tracker)
+
+	x := &explorer{s: s, c: c, e: e, tracker: t, enq: enq}
+	x.id = func(n int64) string { return strconv.FormatInt(n, 10) }
+	if c.Generator != "" {
+		g, err := idgen.Parse(c.Generator)
+		if err != nil {
+			return nil, err
+		}
+		x.id = g.ID
+	}
+	return x, nil
+}
+
+// round judges the blocks whose samples have all been performed, and
+// enqueues the samples the judgement calls for. It tells if the
+// exploration is over.
+func (x *explorer) round(ctx context.Context) (bool, error) {
+	c, err := x.s.Campaign(ctx, x.c.Name)
+	if err != nil {
+		return false, err
+	}
+	x.c = c
+	switch {
+	case c.Status == store.CampaignCancelled:
+		log.Printf("Campaign %s has been cancelled, so the exploration is over.\n", c.Name)
+		return true, nil
+	case c.Finished():
+		log.Printf("Campaign %s has been explored already.\n", c.Name)
+		return true, nil
+	case c.Status == store.CampaignPaused:
+		log.Printf("Campaign %s is paused, waiting for it to be resumed.\n", c.Name)
+		return false, nil
+	}
+
+	blocks, err := x.s.ExploreBlocks(ctx, x.e)
+	if err != nil {
+		return false, err
+	}
+
+	var changed []int
+	if len(blocks) == 0 {
+		for start := c.RangeStart; start < c.RangeEnd; start += x.e.BlockSize {
+			blocks = append(blocks, store.ExploreBlock{Start: start, Stride: x.e.Stride, State: store.BlockSampling})
+			changed = append(changed, len(blocks)-1)
+		}
+		log.Printf("Exploring %s of %s in %d blocks.\n", describeCampaign(c), c.Tracker, len(blocks))
+	} else {
+		stats, err := x.stats(ctx, blocks)
+		if err != nil {
+			return false, err
+		}
+		changed = judgeBlocks(x.e, blocks, stats)
+	}
+
+	var samples []int64
+	for _, i := range changed {
+		if b := blocks[i]; b.State == store.BlockSampling {
+			samples = appendSamples(samples, b.Start, x.blockEnd(b), b.Stride)
+		}
+	}
+	res, err := x.enqueue(ctx, samples)
+	if err != nil {
+		return false, err
+	}
+	save := make([]store.ExploreBlock, len(changed))
+	for j, i := range changed {
+		save[j] = blocks[i]
+	}
+	if err := x.s.SaveExploreBlocks(ctx, x.e, save); err != nil {
+		return false, err
+	}
+
+	counts := make(map[string]int)
+	var hits int64
+	for _, b := range blocks {
+		counts[b.State]++
+		hits += b.Hits
+	}
+	log.Printf("Enqueued %d samples (%d new). %d blocks are being sampled, %d are done and %d abandoned, with %d hits so far.\n",
+		len(samples), res.New, counts[store.BlockSampling], counts[store.BlockDone], counts[store.BlockAbandoned], hits)
+
+	if counts[store.BlockSampling] > 0 {
+		return false, nil
+	}
+	if err := x.s.FinishCampaign(ctx, x.c); err != nil {
+		return false, err
+	}
+	log.Printf("Campaign %s has been explored.\n", c.Name)
+	return true, nil
+}
+
+// blockOf returns the start of the block serial is in
+func (x *explorer) blockOf(serial int64) int64 {
+	return x.c.RangeStart + (serial-x.c.RangeStart)/x.e.BlockSize*x.e.BlockSize
+}
+
+// blockEnd returns the end of the block, which is cut short by the end of
+// the range.
+func (x *explorer) blockEnd(b store.ExploreBlock) int64 {
+	if end := b.Start + x.e.BlockSize; end < x.c.RangeEnd {
+		return end
+	}
+	return x.c.RangeEnd
+}
+
+// enqueue enqueues the numbers of the range as jobs of the campaign,
+// without moving it along, as the exploration keeps track of what has
+// been enqueued.
+func (x *explorer) enqueue(ctx context.Context, samples []int64) (store.InsertResult, error) {
+	var total store.InsertResult
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > exploreChunk {
+			n = exploreChunk
+		}
+
+		args := make([][]byte, n)
+		createdAt := make([]time.Time, n)
+		recorded := make([]store.ExploreSample, n)
+		now := time.Now()
+		for i, serial := range samples[:n] {
+			a, err := x.enq.Args(x.id(serial))
+			if err != nil {
+				return total, err
+			}
+			key, err := x.tracker.Key(a)
+			if err != nil {
+				return total, err
+			}
+			args[i], createdAt[i] = a, now
+			recorded[i] = store.ExploreSample{Key: key, Block: x.blockOf(serial)}
+		}
+
+		// The samples are recorded first, so there are no jobs of the
+		// exploration it doesn't know the block of.
+		if err := x.s.AddExploreSamples(ctx, x.e, recorded); err != nil {
+			return total, err
+		}
+		res, err := x.s.InsertCampaignJobs(ctx, x.c, store.InsertSkip, args, createdAt, x.c.Next)
+		if err != nil {
+			return total, err
+		}
+		total.New += res.New
+		total.Existing += res.Existing
+		samples = samples[n:]
+	}
+	return total, nil
+}
+
+// blockStats is what the jobs of a block have found so far
+type blockStats struct {
+	pending int64
+	samples int64
+	hits    int64
+}
+
+// stats sums up the samples of the blocks that are being sampled
+func (x *explorer) stats(ctx context.Context, blocks []store.ExploreBlock) ([]blockStats, error) {
+	byBlock, err := x.s.ExploreStats(ctx, x.e)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]blockStats, len(blocks))
+	for _, st := range byBlock {
+		i := sort.Search(len(blocks), func(i int) bool { return blocks[i].Start >= st.Start })
+		if i == len(blocks) || blocks[i].Start != st.Start {
+			return nil, fmt.Errorf("there are samples of block %d, which isn't part of the exploration", st.Start)
+		}
+		stats[i] = blockStats{pending: st.Pending, samples: st.Samples, hits: st.Hits}
+	}
+	return stats, nil
+}
+
+// judgeBlocks judges the blocks that are being sampled and whose samples
+// have all been performed, updating them in place. It returns the indexes
+// of the blocks that changed.
+func judgeBlocks(e *store.Exploration, blocks []store.ExploreBlock, stats []blockStats) []int {
+	changed := make(map[int]bool)
+	var denser []int
+	for i := range blocks {
+		b, st := &blocks[i], stats[i]
+		if b.State != store.BlockSampling || st.pending > 0 {
+			continue
+		}
+		b.Samples, b.Hits = st.samples, st.hits
+		changed[i] = true
+
+		switch {
+		case st.hits == 0 || float64(st.hits) < e.MinHitRate*float64(st.samples):
+			b.State = store.BlockAbandoned
+		case b.Stride == 1:
+			b.State = store.BlockDone
+		default:
+			b.Stride /= e.Factor
+			if b.Stride < 1 {
+				b.Stride = 1
+			}
+			denser = append(denser, i)
+		}
+	}
+
+	// The neighbours of a block with hits are sampled as densely as it,
+	// once they have been judged on their own.
+	for _, i := range denser {
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(blocks) {
+				continue
+			}
+			if n := &blocks[j]; n.State == store.BlockAbandoned && n.Stride > blocks[i].Stride {
+				n.State, n.Stride = store.BlockSampling, blocks[i].Stride
+				changed[j] = true
+			}
+		}
+	}
+
+	indexes := make([]int, 0, len(changed))
+	for i := range blocks {
+		if changed[i] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// appendSamples appends every stride'th number of [start, end) to samples
+func appendSamples(samples []int64, start, end, stride int64) []int64 {
+	for n := start; n < end; n += stride {
+		samples = append(samples, n)
+	}
+	return samples
+}
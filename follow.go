@@ -0,0 +1,188 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const followHelp = `
+Follow scrapes what has been found again now and then, to see where it gets
+to. Every job of the tracker that found something is followed. Once the
+latest job of a follow has been performed, the status of the latest event
+in its response decides when the next follow-up is enqueued, which is set
+for each status in the [follow.cadences] section of the config, and is
+-cadence for the rest. Following stops when the status is final, like
+delivered, when the tracker no longer knows the id, or when it was found
+longer than -maxAge ago.
+
+Every follow-up is a job of its own, so each response is kept. Follow-ups
+aren't part of any campaign, and are claimed with -priority.
+
+Follow looks for follow-ups to enqueue every -interval until it gets SIGINT
+or SIGTERM, or only once with -once.
+`
+
+// followBatch is how many follows are judged or followed up at a time
+const followBatch = 1000
+
+func followCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("follow", "[flags]", followHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	tracker := fs.String("tracker", "bring", "the name of the tracker to follow up on")
+	fs.DurationVar(&cfg.Follow.Cadence.Duration, "cadence", cfg.Follow.Cadence.Duration, "how long to wait before following up on a status without a cadence of its own")
+	fs.DurationVar(&cfg.Follow.MaxAge.Duration, "maxAge", cfg.Follow.MaxAge.Duration, "how long after it was found something is followed")
+	fs.IntVar(&cfg.Follow.Priority, "priority", cfg.Follow.Priority, "the priority of the follow-up jobs")
+	fs.DurationVar(&cfg.Follow.Interval.Duration, "interval", cfg.Follow.Interval.Duration, "how often to look for follow-ups to enqueue")
+	once := fs.Bool("once", false, "look for follow-ups once and exit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	t, err := findTracker(ctx, s, *tracker)
+	if err != nil {
+		return err
+	}
+	impl, _ := trackers.Get(t.Name)
+	fw, ok := impl.(trackers.Follower)
+	if !ok {
+		return fmt.Errorf("tracker %s can't tell where what it found has gotten to, so it can't be followed", t.Name)
+	}
+
+	for {
+		err := followRound(ctx, s, t.ID, fw, cfg.Follow)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil || *once {
+			return err
+		}
+
+		select {
+		case <-time.After(cfg.Follow.Interval.Duration):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// followRound starts following the new finds of the tracker, judges the
+// follows whose latest job is done, and enqueues the follow-ups that are
+// due.
+func followRound(ctx context.Context, s store.JobQueue, tracker int, fw trackers.Follower, cfg config.Follow) error {
+	started, err := s.StartFollows(ctx, tracker)
+	if err != nil {
+		return err
+	}
+
+	var scheduled, stopped int
+	for {
+		follows, err := s.WaitingFollows(ctx, tracker, followBatch)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i := range follows {
+			judgeFollow(&follows[i], fw, cfg, now)
+			if follows[i].State == store.FollowStopped {
+				stopped++
+			} else {
+				scheduled++
+			}
+		}
+		if err := s.SaveFollows(ctx, follows); err != nil {
+			return err
+		}
+		if len(follows) < followBatch {
+			break
+		}
+	}
+
+	var enqueued int64
+	for {
+		n, err := s.FollowUp(ctx, tracker, time.Now(), cfg.Priority, followBatch)
+		if err != nil {
+			return err
+		}
+		enqueued += n
+		if n < followBatch {
+			break
+		}
+	}
+
+	log.Printf("Started following %d, scheduled %d follow-ups and stopped following %d. Enqueued %d follow-ups.\n",
+		started, scheduled, stopped, enqueued)
+	return nil
+}
+
+// judgeFollow decides from the latest job of the follow when to follow up
+// next, or if it is time to stop.
+func judgeFollow(f *store.Follow, fw trackers.Follower, cfg config.Follow, now time.Time) {
+	next := now.Add(cfg.CadenceOf(f.Status))
+	switch {
+	case f.Last.Status != store.StatusSuccess:
+		// The follow-up failed, so we try again when we would have
+		// followed up anyway.
+
+	case f.Last.Outcome != trackers.OutcomeFound.String():
+		f.State = store.FollowStopped
+		return
+
+	default:
+		status, final, err := fw.Status(f.Last.Resp)
+		if err != nil {
+			log.Printf("Can't tell the status of job %d, following up on it anyway: %s\n", f.LastJobID, err.Error())
+			break
+		}
+		f.Status = status
+		if final {
+			f.State = store.FollowStopped
+			return
+		}
+		if !f.Last.EndTime.IsZero() {
+			next = f.Last.EndTime.Add(cfg.CadenceOf(status))
+		} else {
+			next = now.Add(cfg.CadenceOf(status))
+		}
+	}
+
+	if next.Sub(f.FoundAt) > cfg.MaxAge.Duration {
+		f.State = store.FollowStopped
+		return
+	}
+	f.State, f.NextAt = store.FollowScheduled, next
+}
@@ -1,5 +1,9 @@
 module github.com/rhermes/packtrack
 
-go 1.12
+go 1.18
 
-require github.com/lib/pq v1.1.1
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/lib/pq v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.6
+)
@@ -0,0 +1,207 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package idgen makes the tracking ids of the numbering schemes we know, so
+// a range of serial numbers can be enqueued without wasting requests on ids
+// that can't exist.
+package idgen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Generator makes the tracking ids of a numbering scheme from serial numbers
+type Generator interface {
+	// ID returns the tracking id with the serial number n, which must be
+	// in [0, Size()).
+	ID(n int64) string
+
+	// Serial returns the serial number of the tracking id, the inverse of
+	// ID. Ids that the generator can't have made are an error.
+	Serial(id string) (int64, error)
+
+	// Size is how many serial numbers there are
+	Size() int64
+
+	// String returns the spec the generator is parsed from
+	String() string
+}
+
+// Specs describes the specs Parse understands
+const Specs = `s10:SS:CC     UPU S10 ids, like CS123456785NO, with the service
+              indicator SS and country code CC. The serial number is
+              the 8 digits before the mod-11 check digit.
+bring:PREFIX  Bring's 17 digit consignment numbers starting with the
+              digits PREFIX, with a mod-10 check digit.
+sscc:PREFIX   18 digit SSCCs, which Bring uses for package numbers, with
+              the extension digit and company prefix PREFIX and a mod-10
+              check digit.`
+
+// Parse returns the generator described by spec, which is one of Specs
+func Parse(spec string) (Generator, error) {
+	parts := strings.Split(spec, ":")
+	switch {
+	case parts[0] == "s10" && len(parts) == 3:
+		return newS10(parts[1], parts[2])
+	case parts[0] == "bring" && len(parts) == 2:
+		return newNumeric(parts[0], parts[1], 17)
+	case parts[0] == "sscc" && len(parts) == 2:
+		return newNumeric(parts[0], parts[1], 18)
+	}
+	return nil, fmt.Errorf("idgen: unknown spec %q", spec)
+}
+
+// s10Weights are the weights of the digits of the serial of a S10 id
+var s10Weights = [8]int{8, 6, 4, 2, 3, 5, 9, 7}
+
+// s10Check returns the check digit of the 8 digit serial of a S10 id
+func s10Check(serial string) byte {
+	sum := 0
+	for i := range s10Weights {
+		sum += int(serial[i]-'0') * s10Weights[i]
+	}
+	switch c := 11 - sum%11; c {
+	case 10:
+		return '0'
+	case 11:
+		return '5'
+	default:
+		return byte('0' + c)
+	}
+}
+
+// mod10Check returns the GS1 mod-10 check digit of digits, where the
+// digits are weighted 3 and 1 in turn from the right.
+func mod10Check(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// upper tells if s is n upper case letters
+func upper(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 'A' || s[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// digits tells if s is only digits
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// s10 makes UPU S10 ids
+type s10 struct {
+	service string
+	country string
+}
+
+func newS10(service, country string) (*s10, error) {
+	if !upper(service, 2) {
+		return nil, fmt.Errorf("idgen: the S10 service indicator %q must be two upper case letters", service)
+	}
+	if !upper(country, 2) {
+		return nil, fmt.Errorf("idgen: the S10 country code %q must be two upper case letters", country)
+	}
+	return &s10{service: service, country: country}, nil
+}
+
+func (g *s10) ID(n int64) string {
+	serial := fmt.Sprintf("%08d", n)
+	return g.service + serial + string(s10Check(serial)) + g.country
+}
+
+func (g *s10) Serial(id string) (int64, error) {
+	if len(id) != 13 || id[:2] != g.service || id[11:] != g.country {
+		return 0, fmt.Errorf("idgen: %q is not a %s id", id, g)
+	}
+	serial := id[2:10]
+	if !digits(serial) || id[10] != s10Check(serial) {
+		return 0, fmt.Errorf("idgen: %q has the wrong check digit", id)
+	}
+	return strconv.ParseInt(serial, 10, 64)
+}
+
+func (g *s10) Size() int64 { return 100000000 }
+
+func (g *s10) String() string { return "s10:" + g.service + ":" + g.country }
+
+// numeric makes ids of a fixed number of digits, starting with a prefix and
+// ending with a mod-10 check digit.
+type numeric struct {
+	name   string
+	prefix string
+	width  int
+}
+
+func newNumeric(name, prefix string, length int) (*numeric, error) {
+	if !digits(prefix) {
+		return nil, fmt.Errorf("idgen: the %s prefix %q must be digits", name, prefix)
+	}
+	width := length - 1 - len(prefix)
+	if width < 1 {
+		return nil, fmt.Errorf("idgen: the %s prefix %q leaves no room for a serial number", name, prefix)
+	}
+	return &numeric{name: name, prefix: prefix, width: width}, nil
+}
+
+func (g *numeric) ID(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	id := g.prefix + strings.Repeat("0", g.width-len(s)) + s
+	return id + string(mod10Check(id))
+}
+
+func (g *numeric) Serial(id string) (int64, error) {
+	if len(id) != len(g.prefix)+g.width+1 || !strings.HasPrefix(id, g.prefix) || !digits(id) {
+		return 0, fmt.Errorf("idgen: %q is not a %s id", id, g)
+	}
+	if id[len(id)-1] != mod10Check(id[:len(id)-1]) {
+		return 0, fmt.Errorf("idgen: %q has the wrong check digit", id)
+	}
+	return strconv.ParseInt(id[len(g.prefix):len(id)-1], 10, 64)
+}
+
+func (g *numeric) Size() int64 {
+	size := int64(1)
+	for i := 0; i < g.width; i++ {
+		size *= 10
+	}
+	return size
+}
+
+func (g *numeric) String() string { return g.name + ":" + g.prefix }
@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package idgen
+
+import "testing"
+
+func TestCheckDigits(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(string) byte
+		in    string
+		want  byte
+	}{
+		// The examples from the UPU S10 standard and GS1
+		{"S10", s10Check, "47312482", '9'},
+		{"S10 remainder 0", s10Check, "00000000", '5'},
+		{"S10 remainder 1", s10Check, "00060000", '0'},
+		{"EAN-13", mod10Check, "400638133393", '1'},
+		{"SSCC", mod10Check, "10614141123456789", '7'},
+	}
+	for _, tc := range tests {
+		if got := tc.check(tc.in); got != tc.want {
+			t.Errorf("%s: check digit of %s is %c, want %c", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []struct {
+		spec string
+		n    int64
+		want string
+		size int64
+	}{
+		{"s10:AA:GB", 47312482, "AA473124829GB", 100000000},
+		{"s10:CS:NO", 0, "CS000000005NO", 100000000},
+		{"sscc:10614141", 123456789, "106141411234567897", 1000000000},
+		{"bring:7072215", 1, "70722150000000017", 1000000000},
+	}
+	for _, tc := range tests {
+		g, err := Parse(tc.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tc.spec, err)
+		}
+		if got := g.ID(tc.n); got != tc.want {
+			t.Errorf("%s: id %d is %s, want %s", tc.spec, tc.n, got, tc.want)
+		}
+		if got, err := g.Serial(tc.want); err != nil || got != tc.n {
+			t.Errorf("%s: serial of %s is %d, %v; want %d", tc.spec, tc.want, got, err, tc.n)
+		}
+		if got := g.Size(); got != tc.size {
+			t.Errorf("%s: size is %d, want %d", tc.spec, got, tc.size)
+		}
+		if got := g.String(); got != tc.spec {
+			t.Errorf("%s: String gives %s", tc.spec, got)
+		}
+	}
+
+	serials := []struct {
+		spec string
+		id   string
+	}{
+		{"s10:CS:NO", "CS000000004NO"},
+		{"s10:CS:NO", "RR000000005NO"},
+		{"s10:CS:NO", "CS000000005SE"},
+		{"sscc:10614141", "106141411234567898"},
+		{"sscc:10614141", "20614141123456789"},
+		{"bring:7072215", "7072215000000001x"},
+	}
+	for _, tc := range serials {
+		g, err := Parse(tc.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tc.spec, err)
+		}
+		if n, err := g.Serial(tc.id); err == nil {
+			t.Errorf("%s: %s gave the serial %d, want an error", tc.spec, tc.id, n)
+		}
+	}
+
+	for _, spec := range []string{"", "s10", "s10:cs:NO", "s10:CS:NOR", "sscc:12a", "sscc:12345678901234567", "upc:123"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) gave no error", spec)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const backfillHelp = `
+Backfill parses the responses of the jobs of a tracker that have found
+something, and saves the consignments, packages and events in them to
+tables of their own. Work does this as the jobs are performed, so backfill
+is only needed for the jobs performed before it did, or after the parsing
+has changed. Parsing a job again replaces what was saved for it.
+
+The jobs are read -batch at a time, ordered by id, and the id of the last
+job of each batch is logged, so an interrupted backfill can be picked up
+again with -afterID.
+`
+
+// ingest parses what a job found and saves it as the consignments of the job
+func ingest(ctx context.Context, s store.JobQueue, parser trackers.Parser, job int64, body []byte) error {
+	consignments, err := parser.Parse(body)
+	if err != nil {
+		return err
+	}
+	return s.SaveConsignments(ctx, job, consignments)
+}
+
+func backfillCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("backfill", "[flags]", backfillHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	tracker := fs.String("tracker", "bring", "the name of the tracker whose jobs to parse")
+	afterID := fs.Int64("afterID", 0, "only parse jobs with an id above this")
+	batch := fs.Int("batch", 1000, "how many jobs to read at a time")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *batch <= 0 {
+		return usageErrorf(fs, "batch must be positive")
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	t, err := findTracker(ctx, s, *tracker)
+	if err != nil {
+		return err
+	}
+	impl, _ := trackers.Get(t.Name)
+	parser, ok := impl.(trackers.Parser)
+	if !ok {
+		return fmt.Errorf("tracker %s can't parse its responses", t.Name)
+	}
+
+	f := store.JobFilter{
+		Tracker: t.ID,
+		Status:  store.StatusSuccess,
+		Outcome: trackers.OutcomeFound.String(),
+		AfterID: *afterID,
+		Limit:   *batch,
+	}
+	var parsed, failed int
+	for {
+		var n int
+		err := s.ExportJobs(ctx, f, func(j *store.JobInfo) error {
+			n++
+			f.AfterID = j.ID
+			if err := ingest(ctx, s, parser, j.ID, j.Resp); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("Couldn't parse job %d: %s\n", j.ID, err.Error())
+				failed++
+				return nil
+			}
+			parsed++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+
+		log.Printf("Parsed %d jobs, %d failed, up to job %d\n", parsed, failed, f.AfterID)
+		if n < *batch {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs couldn't be parsed", failed, parsed+failed)
+	}
+	return nil
+}
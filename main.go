@@ -20,124 +20,220 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"time"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/rhermes/packtrack/config"
 	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+	// The trackers register themselves when imported.
+	_ "github.com/rhermes/packtrack/trackers/bring"
 )
 
-var (
-	NodeID           = flag.String("nodeid", "", "the nodeid for this node")
-	Tracker          = flag.String("tracker", "", "the name of the tracker we will be using")
-	InsertRange      = flag.Bool("range", false, "shall we use range mode?")
-	InsertRangeStart = flag.Int64("rangeStart", -1, "The start of the insert range")
-	InsertRangeEnd   = flag.Int64("rangeEnd", -1, "The end of the insert range")
-	PerformMode      = flag.Bool("perform", false, "Shall we use perform mode")
+// Version is the version of packtrack, set at build time with
+// -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// The exit codes of packtrack
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
 )
 
-func insertJob(s *store.Store, tracker int, start, stop int64) error {
-	trackers := make([]int, 0)
-	args := make([][]byte, 0)
-	createdAt := make([]time.Time, 0)
+// errUsage is returned by commands when they were called the wrong way. The
+// command is expected to have printed its usage already.
+var errUsage = errors.New("usage")
+
+// command is a subcommand of packtrack
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"enqueue", "add jobs to the queue", enqueueCmd},
+	{"explore", "sample a range sparsely, and densely where there are hits", exploreCmd},
+	{"campaign", "create, list, pause, resume and cancel campaigns", campaignCmd},
+	{"work", "perform jobs from the queue", workCmd},
+	{"follow", "scrape what has been found again until it is delivered", followCmd},
+	{"backfill", "parse the responses of found jobs into consignments, packages and events", backfillCmd},
+	{"status", "show the state of the queue and the nodes", statusCmd},
+	{"trackers", "list the trackers", trackersCmd},
+	{"jobs", "list jobs", jobsCmd},
+	{"export", "write jobs and their responses as JSON lines", exportCmd},
+	{"migrate", "apply or revert schema migrations", migrateCmd},
+}
 
-	for i := start; i < stop; i++ {
-		trackers = append(trackers, tracker)
-		args = append(args, []byte(fmt.Sprintf(`{"q":"%d"}`, i)))
-		createdAt = append(createdAt, time.Now())
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: packtrack <command> [flags]\n\nThe commands are:\n\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", c.name, c.summary)
 	}
-	startTime := createdAt[0]
-	endTime := createdAt[len(createdAt)-1]
-	dur := endTime.Sub(startTime)
-	log.Printf("We spent %s building internal slices.\n", dur.String())
-
-	beforeInsert := time.Now()
-	if err := s.InsertJobs(trackers, args, createdAt); err != nil {
-		return err
+	fmt.Fprintf(os.Stderr, "\nUse \"packtrack <command> -h\" for more information about a command.\n")
+}
+
+// newFlagSet creates the flag set for a command, with a usage message made
+// from synopsis and help.
+func newFlagSet(name, synopsis, help string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: packtrack %s %s\n\n%s\n", name, synopsis, strings.TrimSpace(help))
+		var hasFlags bool
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nThe flags are:\n\n")
+			fs.PrintDefaults()
+		}
 	}
-	insertDur := time.Since(beforeInsert)
-	log.Printf("We spent %s inserting into postgresql.\n", insertDur.String())
+	return fs
+}
 
+// parseFlags parses the flags of a command, turning any problem into
+// errUsage, as the flag set has already complained about it.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return flag.ErrHelp
+	} else if err != nil {
+		return errUsage
+	}
 	return nil
 }
 
-func performJobs(s *store.Store) error {
-	for {
-		err := s.PerformJob()
-		if err != nil {
-			if err == sql.ErrNoRows {
-				log.Printf("There appears to be nothing to do, waiting 3 sec\n")
-				time.Sleep(3 * time.Second)
-			} else if err == store.ErrRateLimit {
-				log.Printf("We have been ratelimited, waiting 10 minutes\n")
-				time.Sleep(10 * time.Minute)
-			} else {
-				log.Printf("There was some other error, waiting 10 seconds\n")
-				time.Sleep(10 * time.Second)
-			}
+// usageErrorf prints a complaint and the usage of the command, and returns
+// errUsage.
+func usageErrorf(fs *flag.FlagSet, format string, a ...interface{}) error {
+	fmt.Fprintf(fs.Output(), format+"\n", a...)
+	fs.Usage()
+	return errUsage
+}
+
+// configFlags adds the flags every command has for finding its config to
+// fs, binding them to cfg. It returns the path to the config file.
+func configFlags(fs *flag.FlagSet, cfg *config.Config) *string {
+	path := fs.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "the config file to use, defaults to $PACKTRACK_CONFIG")
+	fs.StringVar(&cfg.ConnString, "conn", cfg.ConnString, "the connection string to the database")
+	return path
+}
+
+// givenFlags are the flags that were set on the command line, and their
+// values.
+type givenFlags map[string]string
+
+// apply sets the flags again, so they win over what has been loaded since
+// they were parsed.
+func (g givenFlags) apply(fs *flag.FlagSet) error {
+	for name, value := range g {
+		if err := fs.Set(name, value); err != nil {
+			return err
 		}
-		time.Sleep(1 * time.Second)
 	}
 	return nil
 }
 
-func main() {
-	flag.Parse()
+// loadConfig loads the config file at path and the environment into cfg,
+// which fs has been parsed into. Flags given on the command line win over
+// both, and the result is validated.
+func loadConfig(fs *flag.FlagSet, cfg *config.Config, path string) (givenFlags, error) {
+	given := make(givenFlags)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
 
-	if *NodeID == "" {
-		log.Fatalf("NodeID is required\n")
+	if err := cfg.Load(path); err != nil {
+		return nil, err
+	}
+	if err := given.apply(fs); err != nil {
+		return nil, err
 	}
+	return given, cfg.Validate()
+}
 
-	if *InsertRange {
-		if *Tracker == "" {
-			log.Fatalf("A tracker is required\n")
-		}
+// lookupTracker finds the tracker with the given name
+func lookupTracker(ctx context.Context, s store.JobQueue, name string) (store.Tracker, error) {
+	ts, err := s.Trackers(ctx)
+	if err != nil {
+		return store.Tracker{}, err
+	}
 
-		if *InsertRangeStart == -1 || *InsertRangeEnd == -1 {
-			log.Fatalf("We need a range start and range end\n")
-		}
-		if *InsertRangeStart > *InsertRangeEnd {
-			log.Fatalf("We need a range start smaller than the range end")
+	for _, t := range ts {
+		if t.Name == name {
+			return t, nil
 		}
 	}
+	return store.Tracker{}, fmt.Errorf("there is no tracker named %q", name)
+}
 
-	s, err := store.New(store.Config{
-		NodeID:     *NodeID,
-		ConnString: "",
-	})
+// findTracker finds the tracker with the given name, making sure we have an
+// implementation of it.
+func findTracker(ctx context.Context, s store.JobQueue, name string) (store.Tracker, error) {
+	t, err := lookupTracker(ctx, s, name)
 	if err != nil {
-		log.Fatalf("Error opening store: %s\n", err.Error())
+		return t, err
 	}
-	defer s.Close()
+	if _, ok := trackers.Get(name); !ok {
+		return store.Tracker{}, fmt.Errorf("tracker %q exists, but this version of packtrack can't perform it", name)
+	}
+	return t, nil
+}
 
-	if *InsertRange {
-		trackers, err := s.Trackers()
-		if err != nil {
-			log.Fatalf("Error getting trackers: %s\n", err.Error())
-		}
+// signalContext returns a context that is cancelled when we get SIGINT or
+// SIGTERM, so commands can stop what they are doing and clean up. Getting
+// the signal a second time kills us right away.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %s, stopping\n", sig)
+		signal.Stop(sigs)
+		cancel()
+	}()
+	return ctx
+}
 
-		var bt store.Tracker
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
 
-		for i, tracker := range trackers {
-			fmt.Printf("Tracker %d: %#v\n", i, tracker)
-			if tracker.Name == "bring" {
-				bt = tracker
-			}
-		}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		os.Exit(exitOK)
+	}
 
-		if bt.ID == 0 {
-			log.Fatalf("Didn't find the tracker we needed!\n")
+	for _, c := range commands {
+		if c.name != name {
+			continue
 		}
 
-		if err := insertJob(s, bt.ID, *InsertRangeStart, *InsertRangeEnd); err != nil {
-			log.Fatalf("Couldn't insert the tracker we needed: %s\n", err.Error())
-		}
-	}
-	if *PerformMode {
-		if err := performJobs(s); err != nil {
-			log.Fatalf("Couldn't perform jobs: %s\n", err.Error())
+		err := c.run(signalContext(), os.Args[2:])
+		switch {
+		case err == nil:
+			os.Exit(exitOK)
+		case err == flag.ErrHelp:
+			os.Exit(exitOK)
+		case err == errUsage:
+			os.Exit(exitUsage)
+		default:
+			log.Printf("%s: %s\n", name, err.Error())
+			os.Exit(exitError)
 		}
 	}
+
+	fmt.Fprintf(os.Stderr, "packtrack: unknown command %q\n\n", name)
+	usage()
+	os.Exit(exitUsage)
 }
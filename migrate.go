@@ -0,0 +1,95 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/store"
+)
+
+const migrateHelp = `
+Migrate manages the schema of the database. "up" applies all the migrations
+that haven't been applied yet, "down" reverts the latest one, and "status"
+lists them all.
+`
+
+func migrateCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate", "up|down|status", migrateHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "We need exactly one of up, down or status")
+	}
+	switch fs.Arg(0) {
+	case "up", "down", "status":
+	default:
+		return usageErrorf(fs, "Unknown migrate command %q", fs.Arg(0))
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	m, err := store.NewMigrator(cfg.ConnString)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch fs.Arg(0) {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied %d migrations, the schema is at version %d\n", n, store.SchemaVersion())
+		return nil
+
+	case "down":
+		return m.Down(ctx)
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "VERSION\tNAME\tAPPLIED AT\n")
+		for _, st := range statuses {
+			appliedAt := "pending"
+			if st.Applied {
+				appliedAt = st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, appliedAt)
+		}
+		return w.Flush()
+	}
+	return nil
+}
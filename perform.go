@@ -0,0 +1,453 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rhermes/packtrack/ratelimit"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// performer claims jobs from the store and feeds them to a tracker client,
+// writing the results back to the store as they come in.
+type performer struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	s        store.Backend
+	sched    *store.Scheduler
+	c        *trackers.Client
+	trackers map[string]*workedTracker
+	workers  int
+
+	heartbeat     time.Duration
+	deadNodeAfter time.Duration
+
+	wgClaimer   sync.WaitGroup
+	wgCollector sync.WaitGroup
+
+	mu         sync.Mutex
+	inFlight   map[int64]*store.Job
+	lastError  string
+	jobsDone   int64
+	jobsFailed int64
+}
+
+// performerConfig configures a performer
+type performerConfig struct {
+	// Trackers are the trackers to perform jobs for
+	Trackers []*workedTracker
+
+	// Workers is how many jobs are performed at the same time, shared by
+	// the trackers.
+	Workers int
+
+	// Timeout is the most time a single request may take
+	Timeout time.Duration
+
+	// Heartbeat is how often we send a heartbeat
+	Heartbeat time.Duration
+
+	// DeadNodeAfter is how long without a heartbeat before we consider
+	// another node to be dead.
+	DeadNodeAfter time.Duration
+}
+
+// workedTracker is a tracker the performer performs jobs for
+type workedTracker struct {
+	store.Tracker
+	Impl trackers.Tracker
+
+	// Weight is the share of the claims the tracker gets, next to the other
+	// trackers.
+	Weight int
+
+	// Parser, if set, parses what the jobs that found something found into
+	// the consignments of the job.
+	Parser trackers.Parser
+
+	// Limiter decides when the next request to the tracker can be made
+	Limiter ratelimit.Limiter
+
+	// Pause is how long to pause the limiter for when the tracker rate
+	// limits us, if it can be paused.
+	Pause time.Duration
+}
+
+// scheduleEvery is how often the claimer looks for changes to the campaigns
+// it shares its claims between.
+const scheduleEvery = 30 * time.Second
+
+// writeTimeout bounds how long we try to write a job back to the store. The
+// writes are not bound by the context of the performer, as we want them to
+// happen even when we are stopping.
+const writeTimeout = 30 * time.Second
+
+// newPerformer registers the node and starts performing jobs, until ctx is
+// done or Close is called.
+func newPerformer(ctx context.Context, s store.Backend, cfg performerConfig) (*performer, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.RegisterNode(ctx, &store.Node{Version: Version, Hostname: hostname, Workers: cfg.Workers}); err != nil {
+		return nil, err
+	}
+
+	// Every tracker gets a lane of its own in the client, which is how far
+	// ahead of the workers we claim for it.
+	ccfg := trackers.ClientConfig{
+		Workers:      cfg.Workers,
+		OutputBuffer: cfg.Workers,
+		ErrorBuffer:  cfg.Workers,
+		Timeout:      cfg.Timeout,
+	}
+	byName := make(map[string]*workedTracker, len(cfg.Trackers))
+	weights := make(map[int]int, len(cfg.Trackers))
+	for _, wt := range cfg.Trackers {
+		ccfg.Lanes = append(ccfg.Lanes, trackers.Lane{Tracker: wt.Impl, Buffer: cfg.Workers, Limiter: wt.Limiter})
+		byName[wt.Name] = wt
+		weights[wt.ID] = wt.Weight
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c, err := trackers.NewClient(ctx, ccfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	p := &performer{
+		ctx:      ctx,
+		cancel:   cancel,
+		s:        s,
+		sched:    store.NewScheduler(s, weights, scheduleEvery),
+		c:        c,
+		trackers: byName,
+		workers:  cfg.Workers,
+
+		heartbeat:     cfg.Heartbeat,
+		deadNodeAfter: cfg.DeadNodeAfter,
+
+		inFlight: make(map[int64]*store.Job),
+	}
+
+	p.wgClaimer.Add(3)
+	go p.runClaimer()
+	go p.runReaper()
+	go p.runHeartbeat()
+
+	// Only adaptive limiters have a rate worth reporting.
+	if p.totalRate() > 0 {
+		p.wgClaimer.Add(1)
+		go p.runRateReporter()
+	}
+
+	p.wgCollector.Add(1)
+	go p.runCollector()
+
+	return p, nil
+}
+
+// Close stops claiming new jobs and aborts the requests being made. The
+// jobs we have claimed but not finished are given back to the queue.
+func (p *performer) Close() error {
+	p.cancel()
+	p.wgClaimer.Wait()
+	err := p.c.Close()
+	p.wgCollector.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	if err2 := p.s.StopNode(ctx); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Done is closed when the performer stops by itself, or is closed
+func (p *performer) Done() <-chan struct{} { return p.ctx.Done() }
+
+// sleep waits for dur, returning false if we were told to quit meanwhile
+func (p *performer) sleep(dur time.Duration) bool {
+	return ratelimit.Sleep(p.ctx, dur) == nil
+}
+
+// ready tells if the client has room for another job of the tracker
+func (p *performer) ready(tracker int) bool {
+	for _, wt := range p.trackers {
+		if wt.ID == tracker {
+			return p.c.Ready(wt.Name)
+		}
+	}
+	return false
+}
+
+// busy tells if the client has no room for some of the trackers
+func (p *performer) busy() bool {
+	for name := range p.trackers {
+		if !p.c.Ready(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForRoom waits until the client makes room for another job, for at
+// most dur. It returns false if we were told to quit meanwhile.
+func (p *performer) waitForRoom(dur time.Duration) bool {
+	t := time.NewTimer(dur)
+	defer t.Stop()
+	select {
+	case <-p.c.Room():
+	case <-t.C:
+	case <-p.ctx.Done():
+		return false
+	}
+	return true
+}
+
+// runClaimer claims jobs and hands them to the client. The lanes of the
+// client decide how far ahead of the workers we claim for each tracker, and
+// the scheduler decides which of the trackers and campaigns each job comes
+// from.
+func (p *performer) runClaimer() {
+	defer p.wgClaimer.Done()
+
+	for {
+		job, err := p.sched.ClaimJob(p.ctx, p.ready)
+		if err != nil && p.ctx.Err() != nil {
+			return
+		} else if err == sql.ErrNoRows && p.busy() {
+			// The trackers we have room for have nothing to do, but the
+			// others may once the client catches up.
+			if !p.waitForRoom(3 * time.Second) {
+				return
+			}
+			continue
+		} else if err == sql.ErrNoRows {
+			log.Printf("There appears to be nothing to do, waiting 3 sec\n")
+			if !p.sleep(3 * time.Second) {
+				return
+			}
+			continue
+		} else if err != nil {
+			log.Printf("Couldn't claim a job, waiting 10 seconds: %s\n", err.Error())
+			if !p.sleep(10 * time.Second) {
+				return
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		p.inFlight[job.ID] = job
+		p.mu.Unlock()
+
+		// The job is ours now, so we hand it over even if we are quitting.
+		// The client gives it straight back then, and it is released.
+		p.c.Send(trackers.CrawlRequest{ID: job.ID, Tracker: job.Tracker, Args: job.Args})
+	}
+}
+
+// runReaper periodically returns jobs with expired leases, or held by
+// nodes that have stopped sending heartbeats, to the queue.
+func (p *performer) runReaper() {
+	defer p.wgClaimer.Done()
+
+	for {
+		n, err := p.s.ReapLeases(p.ctx)
+		if err != nil {
+			log.Printf("Couldn't reap expired leases: %s\n", err.Error())
+		} else if n > 0 {
+			log.Printf("Returned %d jobs with expired leases to the queue\n", n)
+		}
+
+		nodes, jobs, err := p.s.ReapDeadNodes(p.ctx, p.deadNodeAfter)
+		if err != nil {
+			log.Printf("Couldn't reap dead nodes: %s\n", err.Error())
+		} else if nodes > 0 || jobs > 0 {
+			log.Printf("Marked %d nodes as dead, returning %d of their jobs to the queue\n", nodes, jobs)
+		}
+
+		if !p.sleep(1 * time.Minute) {
+			return
+		}
+	}
+}
+
+// rate returns the current rate of the limiter of the tracker in requests
+// per second, or zero if it doesn't have one.
+func (wt *workedTracker) rate() float64 {
+	if r, ok := wt.Limiter.(ratelimit.Rater); ok {
+		return r.Rate()
+	}
+	return 0
+}
+
+// totalRate returns the sum of the rates of the trackers
+func (p *performer) totalRate() float64 {
+	var total float64
+	for _, wt := range p.trackers {
+		total += wt.rate()
+	}
+	return total
+}
+
+// runRateReporter logs the rate of the adaptive limiters every minute, so
+// we can see what the trackers put up with.
+func (p *performer) runRateReporter() {
+	defer p.wgClaimer.Done()
+
+	for p.sleep(1 * time.Minute) {
+		for _, wt := range p.trackers {
+			if rate := wt.rate(); rate > 0 {
+				log.Printf("Current rate of %s is %.3f requests/s\n", wt.Name, rate)
+			}
+		}
+	}
+}
+
+// runHeartbeat tells the other nodes how we are doing, until we quit
+func (p *performer) runHeartbeat() {
+	defer p.wgClaimer.Done()
+
+	for p.sleep(p.heartbeat) {
+		p.mu.Lock()
+		n := &store.Node{
+			Workers:    p.workers,
+			Rate:       p.totalRate(),
+			LastError:  p.lastError,
+			JobsDone:   p.jobsDone,
+			JobsFailed: p.jobsFailed,
+		}
+		p.mu.Unlock()
+
+		err := p.s.Heartbeat(p.ctx, n)
+		if err == store.ErrNodeDead {
+			// The jobs we hold have been handed to others, so we can't
+			// go on as if nothing happened.
+			log.Printf("The other nodes have marked us as dead, stopping\n")
+			p.cancel()
+			return
+		} else if err != nil {
+			log.Printf("Couldn't send heartbeat: %s\n", err.Error())
+		}
+	}
+}
+
+// runCollector writes the responses and errors from the client back to the
+// store, until the client is closed.
+func (p *performer) runCollector() {
+	defer p.wgCollector.Done()
+
+	outputs := p.c.Outputs()
+	errs := p.c.Errors()
+	for outputs != nil || errs != nil {
+		select {
+		case cr, ok := <-outputs:
+			if !ok {
+				outputs = nil
+				continue
+			}
+			if o, ok := p.trackers[cr.Input.Tracker].Limiter.(ratelimit.Observer); ok {
+				o.Observe(cr.Result.Outcome == trackers.OutcomeRateLimited, cr.Result.Timings.Total)
+			}
+			p.finish(cr.Input.ID, cr.Worker, cr.Result, nil)
+		case ce, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			p.finish(ce.Input.ID, ce.Worker, nil, ce.Error)
+		}
+	}
+}
+
+func (p *performer) finish(id int64, worker string, res *trackers.Result, jerr error) {
+	p.mu.Lock()
+	job := p.inFlight[id]
+	delete(p.inFlight, id)
+	p.mu.Unlock()
+
+	if job == nil {
+		log.Printf("[%s] Got a result for job %d, which we don't know about\n", worker, id)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	// An error after we were told to stop is most likely because we were
+	// told to stop, so the job gets another go later.
+	if jerr != nil && p.ctx.Err() != nil {
+		if err := p.s.ReleaseJob(ctx, job); err != nil {
+			log.Printf("[%s] Couldn't give job %d back to the queue: %s\n", worker, id, err.Error())
+		}
+		return
+	}
+
+	err := p.s.FinishJob(ctx, job, res, jerr)
+
+	p.mu.Lock()
+	p.jobsDone++
+	if err != nil {
+		p.jobsFailed++
+		p.lastError = err.Error()
+	}
+	p.mu.Unlock()
+
+	if err == store.ErrLeaseLost {
+		log.Printf("[%s] We held job %d for too long, and lost the lease\n", worker, id)
+	} else if err == store.ErrRateLimit {
+		log.Printf("[%s] We have been ratelimited, job %d will be retried later\n", worker, id)
+		p.pauseLimiter(ctx, p.trackers[job.Tracker], res.RetryAfter)
+	} else if err != nil {
+		log.Printf("[%s] There was an error performing job %d: %s\n", worker, id, err.Error())
+	} else if parser := p.trackers[job.Tracker].Parser; parser != nil && res != nil && res.Outcome == trackers.OutcomeFound {
+		// The job is done either way, backfill can have another go at it.
+		if err := ingest(ctx, p.s, parser, id, res.Body); err != nil {
+			log.Printf("[%s] Couldn't save what job %d found: %s\n", worker, id, err.Error())
+		}
+	}
+}
+
+// pauseLimiter stops requests to the tracker for a while after being rate
+// limited, using the tracker's idea of how long if it is longer than ours.
+func (p *performer) pauseLimiter(ctx context.Context, wt *workedTracker, retryAfter time.Duration) {
+	pauser, ok := wt.Limiter.(ratelimit.Pauser)
+	if !ok {
+		return
+	}
+
+	d := wt.Pause
+	if retryAfter > d {
+		d = retryAfter
+	}
+	log.Printf("Pausing requests to %s for %s\n", wt.Name, d)
+	if err := pauser.Pause(ctx, d); err != nil {
+		log.Printf("Couldn't pause the rate limiter: %s\n", err.Error())
+	}
+}
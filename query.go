@@ -0,0 +1,289 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const timeFormat = "2006-01-02 15:04:05"
+
+// formatTime formats t for tables, leaving times that never happened empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(timeFormat)
+}
+
+const statusHelp = `
+Status shows how many jobs each tracker has in each status, how far the
+campaigns have come, and the nodes that have been working on them.
+`
+
+func statusCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("status", "", statusHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	counts, err := s.JobCounts(ctx)
+	if err != nil {
+		return err
+	}
+	nodes, err := s.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TRACKER\tSTATUS\tJOBS\n")
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", c.Tracker, c.Status, c.N)
+	}
+	fmt.Fprintf(w, "\n")
+	if err := writeCampaigns(ctx, w, s); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nNODE\tSTATUS\tVERSION\tHOST\tWORKERS\tRATE\tDONE\tFAILED\tLAST HEARTBEAT\tLAST ERROR\n")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%.3f\t%d\t%d\t%s\t%s\n", n.ID, n.Status, n.Version, n.Hostname,
+			n.Workers, n.Rate, n.JobsDone, n.JobsFailed, formatTime(n.LastHeartbeat), n.LastError)
+	}
+	return w.Flush()
+}
+
+const trackersHelp = `
+Trackers lists the trackers in the database, and if this version of
+packtrack knows how to perform their jobs.
+`
+
+func trackersCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("trackers", "", trackersHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ts, err := s.Trackers(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tNAME\tIMPLEMENTED\tDESCRIPTION\tURL\n")
+	for _, t := range ts {
+		_, implemented := trackers.Get(t.Name)
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%s\n", t.ID, t.Name, implemented, t.Description, t.URL)
+	}
+	return w.Flush()
+}
+
+// jobFilterFlags adds the flags used to filter jobs to fs. The returned
+// function turns them into a store.JobFilter once the flags are parsed.
+func jobFilterFlags(fs *flag.FlagSet, defaultStatus string, defaultLimit int) func(ctx context.Context, s store.JobQueue) (store.JobFilter, error) {
+	tracker := fs.String("tracker", "", "only jobs for this tracker")
+	status := fs.String("status", defaultStatus, "only jobs in this status")
+	outcome := fs.String("outcome", "", "only jobs with this outcome, like found or not-found")
+	after := fs.Int64("after", 0, "only jobs with an id larger than this")
+	limit := fs.Int("limit", defaultLimit, "the most jobs to list, 0 for all of them")
+
+	return func(ctx context.Context, s store.JobQueue) (store.JobFilter, error) {
+		f := store.JobFilter{
+			Status:  *status,
+			Outcome: *outcome,
+			AfterID: *after,
+			Limit:   *limit,
+		}
+		if *tracker != "" {
+			t, err := lookupTracker(ctx, s, *tracker)
+			if err != nil {
+				return f, err
+			}
+			f.Tracker = t.ID
+		}
+		return f, nil
+	}
+}
+
+const jobsHelp = `
+Jobs lists the jobs in the queue, in the order they were created.
+`
+
+func jobsCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("jobs", "[flags]", jobsHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	filter := jobFilterFlags(fs, "", 50)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := filter(ctx, s)
+	if err != nil {
+		return err
+	}
+	jobs, err := s.Jobs(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tTRACKER\tSTATUS\tATTEMPTS\tPRIORITY\tARGS\tCREATED\tENDED\tRUN AT\tCLAIMED BY\tLAST ERROR\n")
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", j.ID, j.Tracker, j.Status, j.Attempts, j.Priority, j.Args,
+			formatTime(j.CreatedAt), formatTime(j.EndTime), formatTime(j.RunAt), j.ClaimedBy, j.LastError)
+	}
+	return w.Flush()
+}
+
+const exportHelp = `
+Export writes the jobs matching the flags as JSON, one job per line, with
+the response we got for them.
+`
+
+// exportedJob is the format of the lines written by export
+type exportedJob struct {
+	ID        int64           `json:"id"`
+	Tracker   string          `json:"tracker"`
+	Args      json.RawMessage `json:"args"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	FollowOf  int64           `json:"follow_of,omitempty"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	StartTime *time.Time      `json:"start_time,omitempty"`
+	EndTime   *time.Time      `json:"end_time,omitempty"`
+	Stats     json.RawMessage `json:"stats,omitempty"`
+	Resp      json.RawMessage `json:"resp,omitempty"`
+}
+
+func exportCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("export", "[flags]", exportHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	filter := jobFilterFlags(fs, store.StatusSuccess, 0)
+	output := fs.String("o", "", "the file to write to, instead of stdout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(fs, cfg, *configPath); err != nil {
+		return err
+	}
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := filter(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	bw := bufio.NewWriter(out)
+	enc := json.NewEncoder(bw)
+	err = s.ExportJobs(ctx, f, func(j *store.JobInfo) error {
+		ej := exportedJob{
+			ID:        j.ID,
+			Tracker:   j.Tracker,
+			Args:      j.Args,
+			Status:    j.Status,
+			Attempts:  j.Attempts,
+			FollowOf:  j.FollowOf,
+			LastError: j.LastError,
+			CreatedAt: j.CreatedAt,
+			Stats:     j.Stats,
+			Resp:      j.Resp,
+		}
+		if !j.StartTime.IsZero() {
+			ej.StartTime = &j.StartTime
+		}
+		if !j.EndTime.IsZero() {
+			ej.EndTime = &j.EndTime
+		}
+		return enc.Encode(&ej)
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Observer is implemented by limiters that adapt to how the tracker is
+// responding.
+type Observer interface {
+	// Observe is told about every response. limited is true if the
+	// tracker rate limited us, latency is how long the request took.
+	Observe(limited bool, latency time.Duration)
+}
+
+// AIMDConfig configures an AIMD limiter. Rates are in requests per second.
+type AIMDConfig struct {
+	StartRate float64
+	MinRate   float64
+	MaxRate   float64
+
+	// Increase is how much the rate grows per second of clean responses
+	Increase float64
+
+	// Decrease is what the rate is multiplied with when we are rate limited
+	// or the responses are slow.
+	Decrease float64
+
+	// SlowLatency is the latency above which a response counts as slow.
+	// Zero means latency is ignored.
+	SlowLatency time.Duration
+
+	// Cooldown is the least time between two decreases, so that a burst of
+	// bad responses to requests made at the old rate only counts once.
+	Cooldown time.Duration
+}
+
+// AIMD is a limiter doing additive increase, multiplicative decrease, like
+// TCP does. It slowly makes more requests while things are going well, and
+// quickly backs off when they are not.
+type AIMD struct {
+	cfg AIMDConfig
+
+	mu           sync.Mutex
+	rate         float64
+	next         time.Time
+	pausedUntil  time.Time
+	lastDecrease time.Time
+}
+
+// NewAIMD creates a new AIMD limiter. Zero values in cfg are given
+// defaults.
+func NewAIMD(cfg AIMDConfig) *AIMD {
+	if cfg.MinRate <= 0 {
+		cfg.MinRate = 0.01
+	}
+	if cfg.MaxRate < cfg.MinRate {
+		cfg.MaxRate = cfg.MinRate
+	}
+	if cfg.StartRate < cfg.MinRate {
+		cfg.StartRate = cfg.MinRate
+	}
+	if cfg.StartRate > cfg.MaxRate {
+		cfg.StartRate = cfg.MaxRate
+	}
+	if cfg.Increase <= 0 {
+		cfg.Increase = 0.01
+	}
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = 0.5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 10 * time.Second
+	}
+
+	return &AIMD{cfg: cfg, rate: cfg.StartRate}
+}
+
+// Rate returns the current rate in requests per second
+func (a *AIMD) Rate() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rate
+}
+
+// Wait implements Limiter
+func (a *AIMD) Wait(ctx context.Context) error {
+	a.mu.Lock()
+	now := time.Now()
+	at := a.next
+	if at.Before(a.pausedUntil) {
+		at = a.pausedUntil
+	}
+	if at.Before(now) {
+		at = now
+	}
+	a.next = at.Add(time.Duration(float64(time.Second) / a.rate))
+	a.mu.Unlock()
+
+	return Sleep(ctx, time.Until(at))
+}
+
+// Pause implements Pauser. Being told to pause also counts as being
+// rate limited.
+func (a *AIMD) Pause(ctx context.Context, d time.Duration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(a.pausedUntil) {
+		a.pausedUntil = until
+	}
+	a.decrease()
+	return nil
+}
+
+// Observe implements Observer
+func (a *AIMD) Observe(limited bool, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if limited || (a.cfg.SlowLatency > 0 && latency > a.cfg.SlowLatency) {
+		a.decrease()
+		return
+	}
+
+	// We get about rate responses per second, so this adds up to Increase
+	// per second.
+	a.rate += a.cfg.Increase / a.rate
+	if a.rate > a.cfg.MaxRate {
+		a.rate = a.cfg.MaxRate
+	}
+}
+
+// decrease cuts the rate, unless we did so very recently. a.mu must be held.
+func (a *AIMD) decrease() {
+	if time.Since(a.lastDecrease) < a.cfg.Cooldown {
+		return
+	}
+	a.lastDecrease = time.Now()
+
+	a.rate *= a.cfg.Decrease
+	if a.rate < a.cfg.MinRate {
+		a.rate = a.cfg.MinRate
+	}
+}
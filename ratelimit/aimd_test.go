@@ -0,0 +1,172 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewAIMD(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  AIMDConfig
+		want AIMDConfig
+	}{
+		{
+			name: "defaults",
+			want: AIMDConfig{StartRate: 0.01, MinRate: 0.01, MaxRate: 0.01, Increase: 0.01, Decrease: 0.5, Cooldown: 10 * time.Second},
+		},
+		{
+			name: "start below min",
+			cfg:  AIMDConfig{StartRate: 0.5, MinRate: 1, MaxRate: 4, Increase: 1, Decrease: 0.8, Cooldown: time.Second},
+			want: AIMDConfig{StartRate: 1, MinRate: 1, MaxRate: 4, Increase: 1, Decrease: 0.8, Cooldown: time.Second},
+		},
+		{
+			name: "start above max",
+			cfg:  AIMDConfig{StartRate: 8, MinRate: 1, MaxRate: 4, Increase: 1, Decrease: 0.8, Cooldown: time.Second},
+			want: AIMDConfig{StartRate: 4, MinRate: 1, MaxRate: 4, Increase: 1, Decrease: 0.8, Cooldown: time.Second},
+		},
+		{
+			name: "max below min",
+			cfg:  AIMDConfig{StartRate: 2, MinRate: 2, MaxRate: 1, Increase: 1, Decrease: 1.5, Cooldown: time.Second},
+			want: AIMDConfig{StartRate: 2, MinRate: 2, MaxRate: 2, Increase: 1, Decrease: 0.5, Cooldown: time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAIMD(tt.cfg)
+			if a.cfg != tt.want {
+				t.Errorf("config = %+v, want %+v", a.cfg, tt.want)
+			}
+			if r := a.Rate(); r != tt.want.StartRate {
+				t.Errorf("Rate = %g, want %g", r, tt.want.StartRate)
+			}
+		})
+	}
+}
+
+// step is something happening to an AIMD limiter, after which its rate
+// should be rate.
+type step struct {
+	name string
+	do   func(a *AIMD)
+	rate float64
+}
+
+// clean, limited and slow are observations of responses
+func clean(a *AIMD)   { a.Observe(false, time.Millisecond) }
+func limited(a *AIMD) { a.Observe(true, time.Millisecond) }
+func slow(a *AIMD)    { a.Observe(false, time.Minute) }
+
+// pause pauses a for a moment
+func pause(a *AIMD) { a.Pause(context.Background(), time.Millisecond) }
+
+// cooled moves the last decrease of a back past the cooldown, as if that
+// much time had gone by.
+func cooled(f func(a *AIMD)) func(a *AIMD) {
+	return func(a *AIMD) {
+		a.lastDecrease = a.lastDecrease.Add(-a.cfg.Cooldown)
+		f(a)
+	}
+}
+
+func TestAIMDObserve(t *testing.T) {
+	cfg := AIMDConfig{
+		StartRate:   1,
+		MinRate:     0.25,
+		MaxRate:     2,
+		Increase:    0.5,
+		Decrease:    0.5,
+		SlowLatency: time.Second,
+		Cooldown:    time.Hour,
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "additive increase",
+			steps: []step{
+				{"clean", clean, 1.5},
+				{"clean", clean, 1.5 + 0.5/1.5},
+				{"clean up to max", clean, 2},
+				{"clean at max", clean, 2},
+			},
+		},
+		{
+			name: "multiplicative decrease",
+			steps: []step{
+				{"limited", limited, 0.5},
+				{"limited within the cooldown", limited, 0.5},
+				{"slow within the cooldown", slow, 0.5},
+				{"slow after the cooldown", cooled(slow), 0.25},
+				{"limited down to min", cooled(limited), 0.25},
+				{"clean", clean, 2},
+			},
+		},
+		{
+			name: "pause decreases",
+			steps: []step{
+				{"clean", clean, 1.5},
+				{"pause", pause, 0.75},
+				{"pause within the cooldown", pause, 0.75},
+				{"limited within the cooldown", limited, 0.75},
+				{"pause after the cooldown", cooled(pause), 0.375},
+			},
+		},
+		{
+			name: "slow latency ignored when unset",
+			steps: []step{
+				{"slow without a slow latency", func(a *AIMD) {
+					a.cfg.SlowLatency = 0
+					slow(a)
+				}, 1.5},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAIMD(cfg)
+			for i, s := range tt.steps {
+				s.do(a)
+				if r := a.Rate(); math.Abs(r-s.rate) > 1e-9 {
+					t.Fatalf("step %d, %s: rate = %g, want %g", i, s.name, r, s.rate)
+				}
+			}
+		})
+	}
+}
+
+func TestAIMDWait(t *testing.T) {
+	ctx := context.Background()
+	a := NewAIMD(AIMDConfig{StartRate: float64(time.Second / tick), MaxRate: 1000})
+
+	if d := timed(func() { a.Wait(ctx); a.Wait(ctx); a.Wait(ctx) }); d < 2*tick-tick/2 {
+		t.Errorf("three Waits at one per %s took %s", tick, d)
+	}
+
+	a.Pause(ctx, 4*tick)
+	if d := timed(func() { a.Wait(ctx) }); d < 4*tick-tick/2 {
+		t.Errorf("Wait after a pause of %s took %s", 4*tick, d)
+	}
+}
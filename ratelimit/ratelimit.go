@@ -0,0 +1,150 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package ratelimit decides when we are allowed to make the next request.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is something we wait on before making a request
+type Limiter interface {
+	// Wait blocks until we may make the next request, or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// Pauser is implemented by limiters that can be told to stop handing out
+// requests for a while, typically because the tracker rate limited us.
+type Pauser interface {
+	Pause(ctx context.Context, d time.Duration) error
+}
+
+// Rater is implemented by limiters whose rate changes as they go
+type Rater interface {
+	// Rate returns the current rate in requests per second
+	Rate() float64
+}
+
+// Interval is a local limiter allowing one request per interval.
+type Interval struct {
+	mu          sync.Mutex
+	dur         time.Duration
+	next        time.Time
+	pausedUntil time.Time
+}
+
+// NewInterval creates a limiter allowing one request every dur
+func NewInterval(dur time.Duration) *Interval {
+	return &Interval{dur: dur}
+}
+
+// Wait implements Limiter
+func (l *Interval) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(l.pausedUntil) {
+		at = l.pausedUntil
+	}
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.dur)
+	l.mu.Unlock()
+
+	return Sleep(ctx, time.Until(at))
+}
+
+// Pause implements Pauser
+func (l *Interval) Pause(ctx context.Context, d time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	return nil
+}
+
+// Chain is a limiter that waits on all the limiters in it, in order.
+type Chain []Limiter
+
+// Wait implements Limiter
+func (c Chain) Wait(ctx context.Context) error {
+	for _, l := range c {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pause implements Pauser, pausing every limiter in the chain that can be.
+func (c Chain) Pause(ctx context.Context, d time.Duration) error {
+	var firstErr error
+	for _, l := range c {
+		if p, ok := l.(Pauser); ok {
+			if err := p.Pause(ctx, d); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Observe implements Observer, passing the observation on to every limiter
+// in the chain that wants it.
+func (c Chain) Observe(limited bool, latency time.Duration) {
+	for _, l := range c {
+		if o, ok := l.(Observer); ok {
+			o.Observe(limited, latency)
+		}
+	}
+}
+
+// Rate returns the rate of the first limiter in the chain that has one, or
+// zero if none do.
+func (c Chain) Rate() float64 {
+	for _, l := range c {
+		if r, ok := l.(Rater); ok {
+			return r.Rate()
+		}
+	}
+	return 0
+}
+
+// Sleep waits for dur or until ctx is done
+func Sleep(ctx context.Context, dur time.Duration) error {
+	if dur <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(dur)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tick is the interval used by the tests. It is short to keep them quick,
+// but long enough for the scheduler not to blur it.
+const tick = 20 * time.Millisecond
+
+// timed returns how long f took
+func timed(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+func TestSleep(t *testing.T) {
+	ctx := context.Background()
+	if d := timed(func() {
+		if err := Sleep(ctx, tick); err != nil {
+			t.Errorf("Sleep: %s", err)
+		}
+	}); d < tick {
+		t.Errorf("Sleep(%s) returned after %s", tick, d)
+	}
+
+	for _, dur := range []time.Duration{0, -time.Second} {
+		if err := Sleep(ctx, dur); err != nil {
+			t.Errorf("Sleep(%s): %s", dur, err)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, dur := range []time.Duration{0, time.Hour} {
+		if err := Sleep(canceled, dur); err != context.Canceled {
+			t.Errorf("Sleep(%s) with a canceled context gave %v", dur, err)
+		}
+	}
+
+	short, cancel := context.WithTimeout(ctx, tick)
+	defer cancel()
+	if d := timed(func() {
+		if err := Sleep(short, time.Hour); err != context.DeadlineExceeded {
+			t.Errorf("Sleep past the deadline gave %v", err)
+		}
+	}); d > time.Minute {
+		t.Errorf("Sleep past the deadline returned after %s", d)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	ctx := context.Background()
+	l := NewInterval(tick)
+
+	// The first request may be made at once, the next ones a tick apart.
+	if d := timed(func() { l.Wait(ctx) }); d >= tick {
+		t.Errorf("the first Wait took %s", d)
+	}
+	if d := timed(func() { l.Wait(ctx); l.Wait(ctx) }); d < 2*tick-tick/2 {
+		t.Errorf("two more Waits took %s, want about %s", d, 2*tick)
+	}
+
+	// A pause holds back the next request, and a shorter one given later
+	// doesn't shorten it.
+	l.Pause(ctx, 4*tick)
+	l.Pause(ctx, tick)
+	if d := timed(func() { l.Wait(ctx) }); d < 4*tick-tick/2 {
+		t.Errorf("Wait after a pause of %s took %s", 4*tick, d)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	l.Pause(ctx, time.Hour)
+	if err := l.Wait(canceled); err != context.Canceled {
+		t.Errorf("Wait with a canceled context gave %v", err)
+	}
+}
+
+// fake is a limiter recording what is done to it in calls
+type fake struct {
+	name  string
+	calls *[]string
+	err   error
+}
+
+func (f fake) Wait(ctx context.Context) error {
+	*f.calls = append(*f.calls, f.name+" wait")
+	return f.err
+}
+
+// pauser is a fake that can also be paused, observed and rated
+type pauser struct {
+	fake
+	rate float64
+}
+
+func (p pauser) Pause(ctx context.Context, d time.Duration) error {
+	*p.calls = append(*p.calls, p.name+" pause "+d.String())
+	return p.err
+}
+
+func (p pauser) Observe(limited bool, latency time.Duration) {
+	*p.calls = append(*p.calls, p.name+" observe")
+}
+
+func (p pauser) Rate() float64 { return p.rate }
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	errA := errors.New("a failed")
+	errC := errors.New("c failed")
+
+	tests := []struct {
+		name  string
+		chain func(calls *[]string) Chain
+		do    func(c Chain) error
+		err   error
+		calls []string
+	}{
+		{
+			name: "wait on every limiter",
+			chain: func(calls *[]string) Chain {
+				return Chain{pauser{fake{"a", calls, nil}, 0}, fake{"b", calls, nil}, pauser{fake{"c", calls, nil}, 0}}
+			},
+			do:    func(c Chain) error { return c.Wait(ctx) },
+			calls: []string{"a wait", "b wait", "c wait"},
+		},
+		{
+			name: "wait stops at the first error",
+			chain: func(calls *[]string) Chain {
+				return Chain{pauser{fake{"a", calls, errA}, 0}, fake{"b", calls, nil}}
+			},
+			do:    func(c Chain) error { return c.Wait(ctx) },
+			err:   errA,
+			calls: []string{"a wait"},
+		},
+		{
+			name: "pause every pauser",
+			chain: func(calls *[]string) Chain {
+				return Chain{pauser{fake{"a", calls, nil}, 0}, fake{"b", calls, nil}, pauser{fake{"c", calls, nil}, 0}}
+			},
+			do:    func(c Chain) error { return c.Pause(ctx, time.Minute) },
+			calls: []string{"a pause 1m0s", "c pause 1m0s"},
+		},
+		{
+			name: "pause every pauser despite errors",
+			chain: func(calls *[]string) Chain {
+				return Chain{pauser{fake{"a", calls, errA}, 0}, pauser{fake{"c", calls, errC}, 0}}
+			},
+			do:    func(c Chain) error { return c.Pause(ctx, time.Second) },
+			err:   errA,
+			calls: []string{"a pause 1s", "c pause 1s"},
+		},
+		{
+			name: "observe every observer",
+			chain: func(calls *[]string) Chain {
+				return Chain{fake{"a", calls, nil}, pauser{fake{"b", calls, nil}, 0}, pauser{fake{"c", calls, nil}, 0}}
+			},
+			do:    func(c Chain) error { c.Observe(true, time.Second); return nil },
+			calls: []string{"b observe", "c observe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			if err := tt.do(tt.chain(&calls)); err != tt.err {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls = %q, want %q", calls, tt.calls)
+			}
+		})
+	}
+
+	var calls []string
+	c := Chain{fake{"a", &calls, nil}, pauser{fake{"b", &calls, nil}, 2}, pauser{fake{"c", &calls, nil}, 3}}
+	if r := c.Rate(); r != 2 {
+		t.Errorf("Rate = %g, want that of the first rater, 2", r)
+	}
+	if r := (Chain{fake{"a", &calls, nil}}).Rate(); r != 0 {
+		t.Errorf("Rate without raters = %g, want 0", r)
+	}
+
+	// The limiters of the chain are waited on one after another.
+	c = Chain{NewInterval(tick), NewInterval(tick)}
+	c.Pause(ctx, 2*tick)
+	if d := timed(func() { c.Wait(ctx) }); d < 2*tick-tick/2 {
+		t.Errorf("Wait after pausing the chain for %s took %s", 2*tick, d)
+	}
+}
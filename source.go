@@ -0,0 +1,233 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The formats ids can be read in
+const (
+	formatLine   = "line"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// guessFormat returns the format of a file going by its extension, which
+// is the line format unless it says otherwise.
+func guessFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return formatCSV
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	}
+	return formatLine
+}
+
+// recordError is a problem with a single record, which is skipped, rather
+// than with the file as a whole.
+type recordError struct {
+	err error
+}
+
+func (e *recordError) Error() string { return e.err.Error() }
+
+// idReader reads tracking ids from a file, one record at a time
+type idReader interface {
+	// next returns the id in the next record, which is empty if the
+	// record is blank, or io.EOF at the end of the file. A *recordError
+	// means the record was read, but had no id we could make sense of.
+	next() (string, error)
+
+	// line returns the line of the file the last record started on
+	line() int
+}
+
+// newIDReader returns a reader for ids in the given format. column is the
+// CSV column or NDJSON field the ids are in, and defaults to the first
+// column of a CSV file, and the id field of NDJSON. A CSV column is picked
+// by its name in the header, or by its number counting from 1.
+func newIDReader(r io.Reader, format, column string) (idReader, error) {
+	switch format {
+	case formatLine:
+		return &lineReader{s: newLineScanner(r)}, nil
+	case formatCSV:
+		return newCSVReader(r, column)
+	case formatNDJSON:
+		if column == "" {
+			column = "id"
+		}
+		return &ndjsonReader{s: newLineScanner(r), field: column}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, it must be %s, %s or %s", format, formatLine, formatCSV, formatNDJSON)
+}
+
+// maxLine is the longest line we read, which is plenty for a record
+const maxLine = 1 << 20
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLine)
+	return s
+}
+
+// lineReader reads an id per line, skipping blank lines and lines starting
+// with a #.
+type lineReader struct {
+	s *bufio.Scanner
+	n int
+}
+
+func (lr *lineReader) line() int { return lr.n }
+
+func (lr *lineReader) next() (string, error) {
+	if !lr.s.Scan() {
+		if err := lr.s.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	lr.n++
+	line := strings.TrimSpace(lr.s.Text())
+	if strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	return line, nil
+}
+
+// csvReader reads the ids from a column of a CSV file with a header
+type csvReader struct {
+	r      *csv.Reader
+	column int
+	n      int
+}
+
+func (cr *csvReader) line() int { return cr.n }
+
+func newCSVReader(r io.Reader, column string) (*csvReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("the CSV file is empty, we need at least a header")
+	} else if err != nil {
+		return nil, err
+	}
+	if column == "" {
+		return &csvReader{r: cr}, nil
+	}
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			return &csvReader{r: cr, column: i}, nil
+		}
+	}
+	if n, err := strconv.Atoi(column); err == nil && n >= 1 && n <= len(header) {
+		return &csvReader{r: cr, column: n - 1}, nil
+	}
+	return nil, fmt.Errorf("the CSV file has no %q column, only %s", column, strings.Join(header, ", "))
+}
+
+func (cr *csvReader) next() (string, error) {
+	record, err := cr.r.Read()
+	if pe, ok := err.(*csv.ParseError); ok {
+		cr.n = pe.StartLine
+		return "", &recordError{pe.Err}
+	} else if err != nil {
+		return "", err
+	}
+	cr.n, _ = cr.r.FieldPos(0)
+	if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+		return "", nil
+	}
+	if cr.column >= len(record) {
+		return "", &recordError{fmt.Errorf("the record has %d columns, the ids are in column %d", len(record), cr.column+1)}
+	}
+	return strings.TrimSpace(record[cr.column]), nil
+}
+
+// ndjsonReader reads the ids from a field of the JSON object on each line.
+// The field can be either a string or a number.
+type ndjsonReader struct {
+	s     *bufio.Scanner
+	field string
+	n     int
+}
+
+func (nr *ndjsonReader) line() int { return nr.n }
+
+func (nr *ndjsonReader) next() (string, error) {
+	if !nr.s.Scan() {
+		if err := nr.s.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	nr.n++
+	line := bytes.TrimSpace(nr.s.Bytes())
+	if len(line) == 0 {
+		return "", nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(line, &obj); err != nil {
+		return "", &recordError{err}
+	}
+	raw, ok := obj[nr.field]
+	if !ok {
+		return "", &recordError{fmt.Errorf("the object has no %q field", nr.field)}
+	}
+
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return strings.TrimSpace(id), nil
+	}
+	var n json.Number
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&n); err != nil {
+		return "", &recordError{fmt.Errorf("the %q field is %s, not a string or number", nr.field, raw)}
+	}
+	return n.String(), nil
+}
+
+// countingReader counts the bytes read through it, so we can tell how far
+// into a file we are.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhermes/packtrack/store"
+	_ "github.com/rhermes/packtrack/trackers/bring"
+)
+
+// record is what an idReader made of a record
+type record struct {
+	id   string
+	line int
+	// bad is set when it was a *recordError
+	bad bool
+}
+
+// readAll reads every record of r
+func readAll(t *testing.T, r idReader) []record {
+	t.Helper()
+	var records []record
+	for {
+		id, err := r.next()
+		if err == io.EOF {
+			return records
+		}
+		var re *recordError
+		if err != nil && !errors.As(err, &re) {
+			t.Fatalf("next: %s", err)
+		}
+		records = append(records, record{id: id, line: r.line(), bad: err != nil})
+	}
+}
+
+func TestIDReaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		column string
+		input  string
+		want   []record
+	}{
+		{
+			name:   "lines",
+			format: formatLine,
+			input:  "  LA123456789NO \n\n# a comment\n70438101234567890\n",
+			want:   []record{{"LA123456789NO", 1, false}, {"", 2, false}, {"", 3, false}, {"70438101234567890", 4, false}},
+		},
+		{
+			name:   "csv first column",
+			format: formatCSV,
+			input:  "id,name\nLA123456789NO,a\n\n70438101234567890,b\n",
+			want:   []record{{"LA123456789NO", 2, false}, {"70438101234567890", 4, false}},
+		},
+		{
+			name:   "csv column by name",
+			format: formatCSV,
+			column: "tracking_number",
+			input:  "order, Tracking_Number \n1, LA123456789NO\n2,70438101234567890\n",
+			want:   []record{{"LA123456789NO", 2, false}, {"70438101234567890", 3, false}},
+		},
+		{
+			name:   "csv column by number",
+			format: formatCSV,
+			column: "2",
+			input:  "order,tracking\n1,LA123456789NO\n2,70438101234567890\n",
+			want:   []record{{"LA123456789NO", 2, false}, {"70438101234567890", 3, false}},
+		},
+		{
+			name:   "csv malformed records",
+			format: formatCSV,
+			column: "2",
+			input:  "order,tracking\n1\n2,LA12\"34\n3,\"70438101234567890\nNO\"\n4,LA123456789NO\n",
+			want:   []record{{"", 2, true}, {"", 3, true}, {"70438101234567890\nNO", 4, false}, {"LA123456789NO", 6, false}},
+		},
+		{
+			name:   "ndjson",
+			format: formatNDJSON,
+			input:  "{\"id\": \"LA123456789NO\"}\n\n{\"id\": 70438101234567890, \"other\": true}\n",
+			want:   []record{{"LA123456789NO", 1, false}, {"", 2, false}, {"70438101234567890", 3, false}},
+		},
+		{
+			name:   "ndjson field",
+			format: formatNDJSON,
+			column: "tracking",
+			input:  "{\"id\": 1, \"tracking\": \" LA123456789NO \"}\n",
+			want:   []record{{"LA123456789NO", 1, false}},
+		},
+		{
+			name:   "ndjson malformed records",
+			format: formatNDJSON,
+			input:  "{\"id\": \"LA123456789NO\"\n{\"tracking\": \"LA123456789NO\"}\n{\"id\": [1]}\n{\"id\": 12}\n",
+			want:   []record{{"", 1, true}, {"", 2, true}, {"", 3, true}, {"12", 4, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newIDReader(strings.NewReader(tt.input), tt.format, tt.column)
+			if err != nil {
+				t.Fatalf("newIDReader: %s", err)
+			}
+			if got := readAll(t, r); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("read %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDReaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		column string
+		input  string
+	}{
+		{"unknown format", "xml", "", "<ids/>"},
+		{"empty csv", formatCSV, "", ""},
+		{"missing csv column", formatCSV, "tracking", "order,id\n1,LA123456789NO\n"},
+		{"csv column out of range", formatCSV, "3", "order,id\n1,LA123456789NO\n"},
+	}
+	for _, tt := range tests {
+		if _, err := newIDReader(strings.NewReader(tt.input), tt.format, tt.column); err == nil {
+			t.Errorf("%s: newIDReader gave no error", tt.name)
+		}
+	}
+}
+
+// failingQueue fails to insert after a number of chunks, like enqueueing
+// being stopped halfway, and keeps the ids of every chunk it is given.
+type failingQueue struct {
+	store.JobQueue
+	chunksLeft int
+	ids        []string
+}
+
+func (q *failingQueue) InsertCampaignJobs(ctx context.Context, c *store.Campaign, mode store.InsertMode, args [][]byte, createdAt []time.Time, next int64) (store.InsertResult, error) {
+	if q.chunksLeft == 0 {
+		return store.InsertResult{}, errors.New("stopped")
+	}
+	q.chunksLeft--
+
+	res, err := q.JobQueue.InsertCampaignJobs(ctx, c, mode, args, createdAt, next)
+	if err != nil {
+		return res, err
+	}
+	for _, a := range args {
+		var ba struct{ Q string }
+		if err := json.Unmarshal(a, &ba); err != nil {
+			return res, err
+		}
+		q.ids = append(q.ids, ba.Q)
+	}
+	return res, nil
+}
+
+func TestEnqueueFileResumes(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "ids.txt")
+	// The blank lines, comment and invalid id are records too, so they
+	// must be skipped the same way when resuming.
+	input := "A1\nA2\n\nA3\n# comment\nA4\nnot valid\nA5\nA6\nA7\n"
+	if err := ioutil.WriteFile(path, []byte(input), 0644); err != nil {
+		t.Fatalf("writing the ids: %s", err)
+	}
+
+	s := store.NewMemory(store.Config{NodeID: "test"})
+	defer s.Close()
+	c := &store.Campaign{Name: "file", TrackerID: 1, Tracker: "bring", Source: path}
+	if err := s.CreateCampaign(ctx, c); err != nil {
+		t.Fatalf("CreateCampaign: %s", err)
+	}
+
+	q := &failingQueue{JobQueue: s, chunksLeft: 2}
+	if err := enqueueFile(ctx, q, store.InsertSkip, c, "", "", 3); err == nil {
+		t.Fatalf("enqueueFile didn't stop")
+	}
+	c, err := s.Campaign(ctx, "file")
+	if err != nil {
+		t.Fatalf("Campaign: %s", err)
+	}
+	if c.Next != 6 || c.Finished() {
+		t.Fatalf("stopped at record %d, finished %v; want record 6 and not finished", c.Next, c.Finished())
+	}
+
+	// Below zero it never runs out.
+	q.chunksLeft = -1
+	if err := enqueueFile(ctx, q, store.InsertSkip, c, "", "", 3); err != nil {
+		t.Fatalf("resuming enqueueFile: %s", err)
+	}
+	want := []string{"A1", "A2", "A3", "A4", "A5", "A6", "A7"}
+	if !reflect.DeepEqual(q.ids, want) {
+		t.Fatalf("enqueued %v, want %v", q.ids, want)
+	}
+	if c, err := s.Campaign(ctx, "file"); err != nil || !c.Finished() || c.Next != 10 {
+		t.Fatalf("Campaign gave %+v, %v; want it finished after 10 records", c, err)
+	}
+}
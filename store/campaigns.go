@@ -0,0 +1,581 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The statuses a campaign can be in
+const (
+	CampaignActive    = "active"
+	CampaignPaused    = "paused"
+	CampaignCancelled = "cancelled"
+)
+
+var (
+	// ErrCampaignChanged is returned when a campaign has been changed by
+	// someone else since we last looked at it.
+	ErrCampaignChanged = errors.New("the campaign was changed by someone else")
+
+	// ErrCampaignCancelled is returned when trying to change a campaign
+	// that has been cancelled.
+	ErrCampaignCancelled = errors.New("the campaign has been cancelled")
+)
+
+const sqlSelectCampaigns = `
+SELECT
+	c.id,
+	c.name,
+	c.tracker,
+	t.name,
+	c.description,
+	c.range_start,
+	c.range_end,
+	c.source,
+	c.created_by,
+	c.status,
+	c.next_id,
+	c.created_at,
+	c.updated_at,
+	c.finished_at,
+	c.weight,
+	c.priority,
+	c.generator
+FROM
+	campaigns c
+	INNER JOIN trackers t ON t.id = c.tracker
+`
+
+const sqlGetCampaigns = sqlSelectCampaigns + `
+ORDER BY
+	c.id ASC
+`
+
+const sqlGetCampaign = sqlSelectCampaigns + `
+WHERE
+	c.name = $1
+`
+
+const sqlGetCampaignProgress = `
+SELECT
+	p.jobs,
+	p.waiting,
+	p.running,
+	p.paused,
+	p.done,
+	p.failed,
+	p.cancelled,
+	p.hits,
+	p.finished_last_hour
+FROM
+	campaign_progress p
+WHERE
+	p.id = $1
+`
+
+const sqlCreateCampaign = `
+INSERT INTO
+	campaigns (name, tracker, description, range_start, range_end, source, created_by, next_id, weight, priority, generator)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7, COALESCE($4, 0), $8, $9, $10)
+`
+
+const sqlAdvanceCampaign = `
+UPDATE
+	campaigns
+SET
+	next_id = $3,
+	updated_at = now(),
+	finished_at = CASE WHEN $3 >= range_end THEN now() END
+WHERE
+	id = $1
+	AND
+	next_id = $2
+	AND
+	status = 'active'
+`
+
+const sqlFinishCampaign = `
+UPDATE
+	campaigns
+SET
+	updated_at = now(),
+	finished_at = now()
+WHERE
+	id = $1
+	AND
+	next_id = $2
+	AND
+	status = 'active'
+	AND
+	finished_at IS NULL
+`
+
+const sqlSetCampaignStatus = `
+UPDATE
+	campaigns
+SET
+	status = $2,
+	updated_at = now()
+WHERE
+	id = $1
+	AND
+	status <> 'cancelled'
+`
+
+const sqlSetCampaignSchedule = `
+UPDATE
+	campaigns
+SET
+	weight = $2,
+	priority = $3,
+	updated_at = now()
+WHERE
+	id = $1
+	AND
+	status <> 'cancelled'
+`
+
+const sqlSetCampaignJobPriority = `
+UPDATE
+	scrape_jobs
+SET
+	priority = $2
+WHERE
+	campaign_id = $1
+	AND
+	status IN ('created', 'retry', 'paused')
+`
+
+// The waiting jobs of a campaign follow it when it is paused, resumed or
+// cancelled. Jobs that are running are left to finish, and follow it if
+// they have to wait again, by sqlCampaignHold.
+const sqlSetCampaignJobStatus = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE
+		WHEN $2::text = 'active' THEN (CASE WHEN attempts = 0 THEN 'created' ELSE 'retry' END)
+		ELSE $2::text
+	END
+WHERE
+	campaign_id = $1
+	AND
+	status IN ('created', 'retry', 'paused')
+	AND
+	CASE $2::text
+		WHEN 'active' THEN status = 'paused'
+		WHEN 'paused' THEN status <> 'paused'
+		ELSE true
+	END
+`
+
+// Campaign is a named group of jobs for a tracker, made from either a range
+// of ids or the ids in a file.
+type Campaign struct {
+	ID          int64
+	Name        string
+	TrackerID   int
+	Tracker     string
+	Description string
+	// RangeStart and RangeEnd are the ids [RangeStart, RangeEnd) of the
+	// campaign, when it has no Source.
+	RangeStart int64
+	RangeEnd   int64
+	// Generator is the spec of the idgen generator that makes the ids of
+	// the range into tracking ids, or empty if the ids are used as they
+	// are.
+	Generator string
+	// Source is the file the ids of the campaign are read from
+	Source    string
+	CreatedBy string
+	Status    string
+	// Next is how far enqueueing has come. For a range it is the next id
+	// to enqueue.
+	Next      int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// FinishedAt is zero until every id has been enqueued
+	FinishedAt time.Time
+	// Weight is the share of a node's claims the campaign gets, next to
+	// the other active campaigns of the tracker. Zero means 1 when the
+	// campaign is created.
+	Weight int
+	// Priority is given to the jobs of the campaign. Jobs with a higher
+	// priority are claimed before the rest.
+	Priority int
+}
+
+// Finished tells if every id of the campaign has been enqueued
+func (c *Campaign) Finished() bool {
+	return !c.FinishedAt.IsZero()
+}
+
+// left returns how many ids of the campaign are yet to be enqueued, as far
+// as we know.
+func (c *Campaign) left() int64 {
+	if c.Source != "" || c.Finished() {
+		return 0
+	}
+	return c.RangeEnd - c.Next
+}
+
+// validate checks a campaign that is about to be created
+func (c *Campaign) validate() error {
+	switch {
+	case c.Name == "":
+		return errors.New("a campaign needs a name")
+	case c.Source != "" && (c.RangeStart != 0 || c.RangeEnd != 0):
+		return errors.New("a campaign can't have both a range and a source")
+	case c.Source == "" && c.RangeStart >= c.RangeEnd:
+		return errors.New("the start of the range must be before the end")
+	case c.Source != "" && c.Generator != "":
+		return errors.New("only a campaign with a range can have a generator")
+	}
+	return validWeight(c.Weight)
+}
+
+// validWeight checks the weight of a campaign, where zero is allowed to
+// mean the default.
+func validWeight(weight int) error {
+	if weight < 0 {
+		return errors.New("the weight of a campaign can't be negative")
+	}
+	return nil
+}
+
+// weight returns the weight of c, where zero means the default of 1
+func (c *Campaign) weight() int {
+	if c.Weight == 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// CampaignProgress is how far the jobs of a campaign have come
+type CampaignProgress struct {
+	Campaign
+
+	// Jobs is the number of jobs in the campaign, and the rest is how
+	// many of them are in each status.
+	Jobs      int64
+	Waiting   int64
+	Running   int64
+	Paused    int64
+	Done      int64
+	Failed    int64
+	Cancelled int64
+
+	// Hits is how many of the jobs that were done found something
+	Hits int64
+	// FinishedLastHour is how many jobs were done or failed in the last
+	// hour.
+	FinishedLastHour int64
+}
+
+// remaining returns the number of ids that are yet to be performed
+func (p *CampaignProgress) remaining() int64 {
+	return p.Waiting + p.Running + p.Paused + p.left()
+}
+
+// Percent returns how much of the campaign has been performed
+func (p *CampaignProgress) Percent() float64 {
+	total := p.Jobs + p.left()
+	if total == 0 {
+		return 0
+	}
+	return float64(total-p.remaining()) / float64(total) * 100
+}
+
+// HitRate returns how many of the jobs that were done found something
+func (p *CampaignProgress) HitRate() float64 {
+	if p.Done == 0 {
+		return 0
+	}
+	return float64(p.Hits) / float64(p.Done)
+}
+
+// ETA estimates how long is left of the campaign, at the pace of the last
+// hour. It is zero when there is nothing to estimate from, or the campaign
+// isn't moving.
+func (p *CampaignProgress) ETA() time.Duration {
+	if p.Status != CampaignActive || p.FinishedLastHour == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.remaining()) / float64(p.FinishedLastHour) * float64(time.Hour))
+}
+
+// scanCampaign reads a row of sqlSelectCampaigns, followed by extra
+func scanCampaign(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Campaign, error) {
+	var c Campaign
+	var rangeStart, rangeEnd sql.NullInt64
+	var source, generator sql.NullString
+	var finishedAt sql.NullTime
+
+	dest := []interface{}{&c.ID, &c.Name, &c.TrackerID, &c.Tracker, &c.Description, &rangeStart, &rangeEnd,
+		&source, &c.CreatedBy, &c.Status, &c.Next, &c.CreatedAt, &c.UpdatedAt, &finishedAt, &c.Weight, &c.Priority,
+		&generator}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	c.RangeStart = rangeStart.Int64
+	c.RangeEnd = rangeEnd.Int64
+	c.Source = source.String
+	c.Generator = generator.String
+	c.FinishedAt = finishedAt.Time
+	return &c, nil
+}
+
+// campaignColumns returns the range, source and generator of c the way the
+// campaigns table has them.
+func campaignColumns(c *Campaign) (rangeStart, rangeEnd sql.NullInt64, source, generator sql.NullString) {
+	if c.Source != "" {
+		return rangeStart, rangeEnd, sql.NullString{String: c.Source, Valid: true}, generator
+	}
+	if c.Generator != "" {
+		generator = sql.NullString{String: c.Generator, Valid: true}
+	}
+	return sql.NullInt64{Int64: c.RangeStart, Valid: true}, sql.NullInt64{Int64: c.RangeEnd, Valid: true}, source, generator
+}
+
+// CreateCampaign creates the campaign c describes. The Name, TrackerID,
+// Description, range and Generator or Source, CreatedBy, Weight and Priority
+// fields are used, and the rest is filled in.
+func (s *Store) CreateCampaign(ctx context.Context, c *Campaign) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	rangeStart, rangeEnd, source, generator := campaignColumns(c)
+	_, err := s.db.ExecContext(ctx, sqlCreateCampaign, c.Name, c.TrackerID, c.Description, rangeStart, rangeEnd, source, c.CreatedBy,
+		c.weight(), c.Priority, generator)
+	if err != nil {
+		return err
+	}
+
+	created, err := s.Campaign(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	*c = *created
+	return nil
+}
+
+// Campaign returns the campaign with the given name, or sql.ErrNoRows if
+// there is none.
+func (s *Store) Campaign(ctx context.Context, name string) (*Campaign, error) {
+	return scanCampaign(s.db.QueryRowContext(ctx, sqlGetCampaign, name))
+}
+
+// InsertCampaignJobs inserts jobs for the tracker of the campaign like
+// InsertJobs, and records that enqueueing has come to next in the same
+// transaction. ErrCampaignChanged is returned if c is out of date.
+func (s *Store) InsertCampaignJobs(ctx context.Context, c *Campaign, mode InsertMode, args [][]byte, createdAt []time.Time, next int64) (InsertResult, error) {
+	if c.Status != CampaignActive {
+		return InsertResult{}, errCampaignStatus(c)
+	}
+
+	tracker := make([]int, len(args))
+	for i := range tracker {
+		tracker[i] = c.TrackerID
+	}
+
+	res, err := s.insertJobs(ctx, mode, tracker, args, createdAt, c, func(tx *sql.Tx) error {
+		r, err := tx.ExecContext(ctx, sqlAdvanceCampaign, c.ID, c.Next, next)
+		if err != nil {
+			return err
+		}
+		if n, err := r.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrCampaignChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	updated, err := s.Campaign(ctx, c.Name)
+	if err != nil {
+		return res, err
+	}
+	*c = *updated
+	return res, nil
+}
+
+// FinishCampaign records that every id of the campaign has been enqueued.
+// ErrCampaignChanged is returned if c is out of date.
+func (s *Store) FinishCampaign(ctx context.Context, c *Campaign) error {
+	if c.Status != CampaignActive {
+		return errCampaignStatus(c)
+	}
+
+	r, err := s.db.ExecContext(ctx, sqlFinishCampaign, c.ID, c.Next)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCampaignChanged
+	}
+
+	updated, err := s.Campaign(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	*c = *updated
+	return nil
+}
+
+// SetCampaignStatus pauses, resumes or cancels the campaign, taking its
+// waiting jobs along. It returns how many jobs were affected, and
+// ErrCampaignCancelled if the campaign has already been cancelled.
+func (s *Store) SetCampaignStatus(ctx context.Context, c *Campaign, status string) (int64, error) {
+	if err := validCampaignStatus(status); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	r, err := tx.ExecContext(ctx, sqlSetCampaignStatus, c.ID, status)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrCampaignCancelled
+	}
+
+	r, err = tx.ExecContext(ctx, sqlSetCampaignJobStatus, c.ID, status)
+	if err != nil {
+		return 0, err
+	}
+	jobs, err := r.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	c.Status = status
+	return jobs, nil
+}
+
+// SetCampaignSchedule changes the weight and priority of the campaign, and
+// the priority of its waiting jobs. It returns how many jobs were changed.
+func (s *Store) SetCampaignSchedule(ctx context.Context, c *Campaign, weight, priority int) (int64, error) {
+	if err := validWeight(weight); err != nil {
+		return 0, err
+	}
+	if weight == 0 {
+		weight = 1
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	r, err := tx.ExecContext(ctx, sqlSetCampaignSchedule, c.ID, weight, priority)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrCampaignCancelled
+	}
+
+	r, err = tx.ExecContext(ctx, sqlSetCampaignJobPriority, c.ID, priority)
+	if err != nil {
+		return 0, err
+	}
+	jobs, err := r.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	c.Weight, c.Priority = weight, priority
+	return jobs, nil
+}
+
+// Campaigns returns all the campaigns, ordered by id
+func (s *Store) Campaigns(ctx context.Context) ([]Campaign, error) {
+	rows, err := s.db.QueryContext(ctx, sqlGetCampaigns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := make([]Campaign, 0)
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, *c)
+	}
+	return campaigns, rows.Err()
+}
+
+// CampaignProgress returns how far the campaign has come
+func (s *Store) CampaignProgress(ctx context.Context, c *Campaign) (*CampaignProgress, error) {
+	p := &CampaignProgress{Campaign: *c}
+	err := s.db.QueryRowContext(ctx, sqlGetCampaignProgress, c.ID).Scan(&p.Jobs, &p.Waiting, &p.Running,
+		&p.Paused, &p.Done, &p.Failed, &p.Cancelled, &p.Hits, &p.FinishedLastHour)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// validCampaignStatus checks that a campaign can be set to status
+func validCampaignStatus(status string) error {
+	switch status {
+	case CampaignActive, CampaignPaused, CampaignCancelled:
+		return nil
+	}
+	return errors.New("unknown campaign status " + status)
+}
+
+// errCampaignStatus is the error for trying to enqueue jobs for a campaign
+// that isn't active.
+func errCampaignStatus(c *Campaign) error {
+	if c.Status == CampaignCancelled {
+		return ErrCampaignCancelled
+	}
+	return errors.New("campaign " + c.Name + " is " + c.Status)
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The states a block of an exploration can be in
+const (
+	// BlockSampling means samples of the block have been enqueued, and
+	// are waiting to be judged.
+	BlockSampling = "sampling"
+	// BlockDone means every id of the block has been enqueued
+	BlockDone = "done"
+	// BlockAbandoned means the samples of the block found too little to
+	// be worth going on with.
+	BlockAbandoned = "abandoned"
+)
+
+const sqlCreateExploration = `
+INSERT INTO
+	explorations (campaign_id, block_size, stride, factor, min_hit_rate)
+VALUES
+	($1, $2, $3, $4, $5)
+`
+
+const sqlGetExploration = `
+SELECT
+	campaign_id,
+	block_size,
+	stride,
+	factor,
+	min_hit_rate,
+	created_at
+FROM
+	explorations
+WHERE
+	campaign_id = $1
+`
+
+const sqlGetExploreBlocks = `
+SELECT
+	block_start,
+	stride,
+	state,
+	samples,
+	hits,
+	updated_at
+FROM
+	explore_blocks
+WHERE
+	campaign_id = $1
+ORDER BY
+	block_start ASC
+`
+
+const sqlSaveExploreBlock = `
+INSERT INTO
+	explore_blocks (campaign_id, block_start, stride, state, samples, hits)
+VALUES
+	($1, $2, $3, $4, $5, $6)
+ON CONFLICT (campaign_id, block_start)
+	DO UPDATE SET
+		stride = EXCLUDED.stride,
+		state = EXCLUDED.state,
+		samples = EXCLUDED.samples,
+		hits = EXCLUDED.hits,
+		updated_at = now()
+`
+
+const sqlAddExploreSample = `
+INSERT INTO
+	explore_samples (campaign_id, job_key, block_start)
+VALUES
+	($1, $2, $3)
+ON CONFLICT (campaign_id, job_key)
+	DO NOTHING
+`
+
+// Only the samples enqueued for the campaign count, and only the blocks that
+// are being sampled are looked at, so the cost doesn't grow with the blocks
+// that have been judged for good.
+const sqlGetExploreStats = `
+SELECT
+	es.block_start,
+	count(*) FILTER (WHERE sj.status IN ('created', 'retry', 'running', 'paused')),
+	count(*) FILTER (WHERE sj.status = 'success'),
+	count(*) FILTER (WHERE sj.status = 'success' AND sj.outcome = 'found')
+FROM
+	explore_blocks eb
+	INNER JOIN explore_samples es ON es.campaign_id = eb.campaign_id AND es.block_start = eb.block_start
+	INNER JOIN campaigns c ON c.id = es.campaign_id
+	INNER JOIN scrape_jobs sj ON sj.tracker = c.tracker AND sj.job_key = es.job_key AND sj.follow_of IS NULL
+WHERE
+	eb.campaign_id = $1
+	AND
+	eb.state = 'sampling'
+	AND
+	sj.campaign_id = $1
+GROUP BY
+	es.block_start
+ORDER BY
+	es.block_start ASC
+`
+
+// Exploration is how the range of a campaign is explored: sparsely at first,
+// and more densely in the blocks of the range where the samples find
+// something.
+type Exploration struct {
+	CampaignID int64
+	// BlockSize is how many ids of the range are judged together
+	BlockSize int64
+	// Stride is how far apart the first samples of a block are
+	Stride int64
+	// Factor is how much denser each round of samples of a block is than
+	// the one before.
+	Factor int64
+	// MinHitRate is the share of the samples of a block that must find
+	// something for the block to get more samples.
+	MinHitRate float64
+	CreatedAt  time.Time
+}
+
+// validate checks an exploration that is about to be created
+func (e *Exploration) validate() error {
+	switch {
+	case e.BlockSize <= 0:
+		return errors.New("the block size of an exploration must be positive")
+	case e.Stride <= 0:
+		return errors.New("the stride of an exploration must be positive")
+	case e.Factor <= 1:
+		return errors.New("the factor of an exploration must be more than 1")
+	case e.MinHitRate < 0 || e.MinHitRate > 1:
+		return errors.New("the minimum hit rate of an exploration must be between 0 and 1")
+	}
+	return nil
+}
+
+// ExploreBlock is how far the exploration of a block of ids has come
+type ExploreBlock struct {
+	// Start is the first id of the block
+	Start int64
+	// Stride is how far apart the samples enqueued for the block so far
+	// are.
+	Stride int64
+	State  string
+	// Samples and Hits are how many samples of the block had been
+	// performed when it was last judged, and how many found something.
+	Samples   int64
+	Hits      int64
+	UpdatedAt time.Time
+}
+
+// ExploreSample is a sample enqueued for a block of an exploration
+type ExploreSample struct {
+	// Key is the key of the job of the sample
+	Key string
+	// Block is the start of the block the sample is of
+	Block int64
+}
+
+// BlockStats is how far the samples of a block have come
+type BlockStats struct {
+	// Start is the first id of the block
+	Start int64
+	// Pending is how many samples are waiting or running
+	Pending int64
+	// Samples and Hits are how many samples have been performed, and how
+	// many of those found something.
+	Samples int64
+	Hits    int64
+}
+
+// CreateExploration records how the range of a campaign is to be explored
+func (s *Store) CreateExploration(ctx context.Context, e *Exploration) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, sqlCreateExploration, e.CampaignID, e.BlockSize, e.Stride, e.Factor, e.MinHitRate)
+	if err != nil {
+		return err
+	}
+
+	created, err := s.Exploration(ctx, e.CampaignID)
+	if err != nil {
+		return err
+	}
+	*e = *created
+	return nil
+}
+
+// Exploration returns the exploration of the campaign with the given id, or
+// sql.ErrNoRows if it isn't being explored.
+func (s *Store) Exploration(ctx context.Context, campaign int64) (*Exploration, error) {
+	var e Exploration
+	err := s.db.QueryRowContext(ctx, sqlGetExploration, campaign).Scan(&e.CampaignID, &e.BlockSize, &e.Stride,
+		&e.Factor, &e.MinHitRate, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ExploreBlocks returns the blocks of the exploration, ordered by start
+func (s *Store) ExploreBlocks(ctx context.Context, e *Exploration) ([]ExploreBlock, error) {
+	rows, err := s.db.QueryContext(ctx, sqlGetExploreBlocks, e.CampaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := make([]ExploreBlock, 0)
+	for rows.Next() {
+		var b ExploreBlock
+		if err := rows.Scan(&b.Start, &b.Stride, &b.State, &b.Samples, &b.Hits, &b.UpdatedAt); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// SaveExploreBlocks creates or updates the given blocks of the exploration
+func (s *Store) SaveExploreBlocks(ctx context.Context, e *Exploration, blocks []ExploreBlock) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqlSaveExploreBlock)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, b := range blocks {
+		if err := validBlockState(b.State); err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, e.CampaignID, b.Start, b.Stride, b.State, b.Samples, b.Hits); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddExploreSamples records the given samples of the exploration, skipping
+// those recorded already.
+func (s *Store) AddExploreSamples(ctx context.Context, e *Exploration, samples []ExploreSample) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqlAddExploreSample)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, es := range samples {
+		if _, err := stmt.ExecContext(ctx, e.CampaignID, es.Key, es.Block); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ExploreStats sums up the samples of the blocks of the exploration that are
+// being sampled, ordered by start. Blocks without samples are left out.
+func (s *Store) ExploreStats(ctx context.Context, e *Exploration) ([]BlockStats, error) {
+	rows, err := s.db.QueryContext(ctx, sqlGetExploreStats, e.CampaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]BlockStats, 0)
+	for rows.Next() {
+		var st BlockStats
+		if err := rows.Scan(&st.Start, &st.Pending, &st.Samples, &st.Hits); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// validBlockState checks that state is one a block can be in
+func validBlockState(state string) error {
+	switch state {
+	case BlockSampling, BlockDone, BlockAbandoned:
+		return nil
+	}
+	return errors.New("unknown block state " + state)
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The states a follow can be in
+const (
+	// FollowWaiting means the latest job of the follow is waiting to be
+	// performed, or to be judged once it has been.
+	FollowWaiting = "waiting"
+	// FollowScheduled means a follow-up is to be enqueued at NextAt
+	FollowScheduled = "scheduled"
+	// FollowStopped means what was found has gotten where it is going,
+	// or has been followed for long enough.
+	FollowStopped = "stopped"
+)
+
+const sqlStartFollows = `
+INSERT INTO
+	follows (job_id, tracker, last_job_id, state, found_at)
+SELECT
+	sj.id,
+	sj.tracker,
+	sj.id,
+	'waiting',
+	COALESCE(sj.end_time, now())
+FROM
+	scrape_jobs sj
+WHERE
+	sj.tracker = $1
+	AND
+	sj.outcome = 'found'
+	AND
+	sj.follow_of IS NULL
+	AND
+	sj.status = 'success'
+	AND
+	NOT EXISTS (SELECT 1 FROM follows f WHERE f.job_id = sj.id)
+ORDER BY
+	sj.id ASC
+ON CONFLICT (job_id)
+	DO NOTHING
+`
+
+// A follow is judged once its latest job is done with, one way or the
+// other.
+const sqlGetWaitingFollows = `
+SELECT
+	f.job_id,
+	t.name,
+	f.last_job_id,
+	f.state,
+	f.status,
+	f.checks,
+	f.found_at,
+	f.next_at,
+	f.created_at,
+	f.updated_at,
+	sj.status,
+	sj.outcome,
+	sj.end_time,
+	sj.resp
+FROM
+	follows f
+	INNER JOIN trackers t ON t.id = f.tracker
+	INNER JOIN scrape_jobs sj ON sj.id = f.last_job_id
+WHERE
+	f.tracker = $1
+	AND
+	f.state = 'waiting'
+	AND
+	sj.status IN ('success', 'failed', 'dead', 'cancelled')
+ORDER BY
+	f.job_id ASC
+LIMIT
+	$2
+`
+
+const sqlSaveFollow = `
+UPDATE
+	follows
+SET
+	state = $3,
+	status = $4,
+	next_at = $5,
+	updated_at = now()
+WHERE
+	job_id = $1
+	AND
+	last_job_id = $2
+`
+
+// The follow-ups are new jobs with the key and args of the job that found
+// what is followed, and the follows move on to wait for them.
+const sqlFollowUp = `
+WITH due AS (
+	SELECT
+		f.job_id,
+		sj.tracker,
+		sj.job_key,
+		sj.args
+	FROM
+		follows f
+		INNER JOIN scrape_jobs sj ON sj.id = f.job_id
+	WHERE
+		f.tracker = $1
+		AND
+		f.state = 'scheduled'
+		AND
+		f.next_at <= $2
+	ORDER BY
+		f.next_at ASC
+	LIMIT
+		$4
+	FOR UPDATE OF f
+	SKIP LOCKED
+), follow_ups AS (
+	INSERT INTO
+		scrape_jobs (tracker, job_key, args, created_at, follow_of, priority)
+	SELECT
+		tracker,
+		job_key,
+		args,
+		now(),
+		job_id,
+		$3
+	FROM
+		due
+	RETURNING
+		id,
+		follow_of
+)
+UPDATE
+	follows f
+SET
+	last_job_id = fu.id,
+	state = 'waiting',
+	checks = f.checks + 1,
+	next_at = NULL,
+	updated_at = now()
+FROM
+	follow_ups fu
+WHERE
+	f.job_id = fu.follow_of
+`
+
+// Follow is a job that found something, which is scraped again now and then
+// to see where it has gotten to.
+type Follow struct {
+	// JobID is the job that found it, which the follow-ups are follow-ups
+	// of.
+	JobID   int64
+	Tracker string
+	// LastJobID is the latest follow-up, or JobID before there are any
+	LastJobID int64
+	State     string
+	// Status is the status of what is followed, as its tracker put it
+	// the last time it was judged.
+	Status string
+	// Checks is how many follow-ups have been enqueued
+	Checks int
+	// FoundAt is when JobID found it
+	FoundAt time.Time
+	// NextAt is when the next follow-up is due, if one is scheduled
+	NextAt    time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Last is the latest job, which the follow is judged by. Only its ID,
+	// Status, Outcome, EndTime and Resp are filled in, and only by
+	// WaitingFollows.
+	Last JobInfo
+}
+
+// validate checks a follow that is about to be saved
+func (f *Follow) validate() error {
+	switch f.State {
+	case FollowWaiting, FollowStopped:
+	case FollowScheduled:
+		if f.NextAt.IsZero() {
+			return fmt.Errorf("follow of job %d is scheduled without a time", f.JobID)
+		}
+	default:
+		return fmt.Errorf("follow of job %d has the unknown state %q", f.JobID, f.State)
+	}
+	return nil
+}
+
+// nullTime is t, or NULL if it is zero
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// StartFollows starts following every job of the tracker that has found
+// something, and isn't followed already. It returns how many were started.
+func (s *Store) StartFollows(ctx context.Context, tracker int) (int64, error) {
+	r, err := s.db.ExecContext(ctx, sqlStartFollows, tracker)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// WaitingFollows returns up to limit follows of the tracker that are
+// waiting on a job that is done, with the job in Last.
+func (s *Store) WaitingFollows(ctx context.Context, tracker int, limit int) ([]Follow, error) {
+	rows, err := s.db.QueryContext(ctx, sqlGetWaitingFollows, tracker, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	follows := make([]Follow, 0)
+	for rows.Next() {
+		var f Follow
+		var nextAt, endTime sql.NullTime
+		var outcome sql.NullString
+		if err := rows.Scan(&f.JobID, &f.Tracker, &f.LastJobID, &f.State, &f.Status, &f.Checks, &f.FoundAt, &nextAt,
+			&f.CreatedAt, &f.UpdatedAt, &f.Last.Status, &outcome, &endTime, &f.Last.Resp); err != nil {
+			return nil, err
+		}
+		f.NextAt = nextAt.Time
+		f.Last.ID = f.LastJobID
+		f.Last.Outcome = outcome.String
+		f.Last.EndTime = endTime.Time
+		follows = append(follows, f)
+	}
+	return follows, rows.Err()
+}
+
+// SaveFollows saves the state, status and next time of the given follows,
+// all of them or none. Follows that have moved on to another job since
+// they were read are left alone.
+func (s *Store) SaveFollows(ctx context.Context, follows []Follow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqlSaveFollow)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, f := range follows {
+		if err := f.validate(); err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, f.JobID, f.LastJobID, f.State, f.Status, nullTime(f.NextAt)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FollowUp enqueues a follow-up job with the given priority for up to limit
+// follows of the tracker that are due by now. It returns how many were
+// enqueued.
+func (s *Store) FollowUp(ctx context.Context, tracker int, now time.Time, priority int, limit int) (int64, error) {
+	r, err := s.db.ExecContext(ctx, sqlFollowUp, tracker, now, priority, limit)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
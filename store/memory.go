@@ -0,0 +1,999 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// memoryJob is a row of scrape_jobs
+type memoryJob struct {
+	JobInfo
+	tracker    int
+	campaign   int64
+	rateLimits int
+	leaseUntil time.Time
+}
+
+// Memory is a JobQueue kept in memory, for tests and for trying things out
+// without a database. It starts out with the same trackers as a freshly
+// migrated database.
+type Memory struct {
+	id    string
+	retry RetryPolicy
+	lease time.Duration
+
+	mu        sync.Mutex
+	trackers  []Tracker
+	jobs      []*memoryJob
+	byKey     map[uniqueKey]*memoryJob
+	nextID    int64
+	campaigns []*Campaign
+
+	explorations map[int64]*Exploration
+	blocks       map[int64][]ExploreBlock
+	// samples are the blocks of the samples of each exploration, by key
+	samples map[int64]map[string]int64
+
+	// follows are ordered by JobID
+	follows []*Follow
+
+	// consignments are what each job found, by job id
+	consignments map[int64][]trackers.Consignment
+}
+
+// NewMemory creates an empty in-memory queue
+func NewMemory(cfg Config) *Memory {
+	lease := cfg.LeaseDuration
+	if lease <= 0 {
+		lease = DefaultLeaseDuration
+	}
+
+	return &Memory{
+		id:    cfg.NodeID,
+		retry: cfg.Retry,
+		lease: lease,
+
+		trackers: []Tracker{
+			{ID: 1, Name: "bring", Description: "the norwegian postal service", URL: "https://developer.bring.com/"},
+		},
+		byKey:  make(map[uniqueKey]*memoryJob),
+		nextID: 1,
+
+		explorations: make(map[int64]*Exploration),
+		blocks:       make(map[int64][]ExploreBlock),
+		samples:      make(map[int64]map[string]int64),
+
+		consignments: make(map[int64][]trackers.Consignment),
+	}
+}
+
+// Close implements JobQueue. The jobs are gone afterwards.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs = nil
+	m.byKey = nil
+	m.campaigns = nil
+	m.follows = nil
+	return nil
+}
+
+// Trackers implements JobQueue
+func (m *Memory) Trackers(ctx context.Context) ([]Tracker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Tracker(nil), m.trackers...), nil
+}
+
+// InsertJob implements JobQueue
+func (m *Memory) InsertJob(ctx context.Context, tracker int, args []byte, createdAt time.Time) error {
+	_, err := m.InsertJobs(ctx, InsertSkip, []int{tracker}, [][]byte{args}, []time.Time{createdAt})
+	return err
+}
+
+// InsertJobs implements JobQueue
+func (m *Memory) InsertJobs(ctx context.Context, mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time) (InsertResult, error) {
+	if len(tracker) != len(args) || len(args) != len(createdAt) {
+		return InsertResult{}, errors.New("All arrays must be equally long")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insertJobs(mode, tracker, args, createdAt, nil)
+}
+
+// insertJobs does the work of InsertJobs with the lock held, putting the
+// jobs in the campaign c if it isn't nil.
+func (m *Memory) insertJobs(mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time, c *Campaign) (InsertResult, error) {
+	var res InsertResult
+
+	// Check everything first, so we insert all of them or none.
+	keys, err := jobKeys(m.trackers, tracker, args)
+	if err != nil {
+		return res, err
+	}
+	for i := range args {
+		if !json.Valid(args[i]) {
+			return res, fmt.Errorf("args of job %d are not valid JSON", i)
+		}
+	}
+
+	var campaign int64
+	var priority int
+	if c != nil {
+		campaign, priority = c.ID, c.Priority
+	}
+
+	now := time.Now()
+	seen := make(map[uniqueKey]bool)
+	for i := range tracker {
+		k := uniqueKey{tracker[i], keys[i]}
+		if seen[k] {
+			res.Existing++
+			continue
+		}
+		seen[k] = true
+
+		if j, ok := m.byKey[k]; ok {
+			res.Existing++
+			if mode == InsertUpdate && j.Status != StatusRunning {
+				j.Args = append([]byte(nil), args[i]...)
+				j.Status = StatusCreated
+				j.Attempts = 0
+				j.rateLimits = 0
+				j.LastError = ""
+				j.Outcome = ""
+				j.StartTime = time.Time{}
+				j.EndTime = time.Time{}
+				j.Stats = []byte("{}")
+				j.Resp = nil
+				j.RunAt = now
+				if c != nil {
+					j.campaign = campaign
+					j.Priority = priority
+				}
+				res.Updated++
+			}
+			continue
+		}
+
+		var name string
+		for _, t := range m.trackers {
+			if t.ID == tracker[i] {
+				name = t.Name
+			}
+		}
+		j := &memoryJob{
+			JobInfo: JobInfo{
+				ID:        m.nextID,
+				Tracker:   name,
+				Args:      append([]byte(nil), args[i]...),
+				Status:    StatusCreated,
+				Priority:  priority,
+				CreatedAt: createdAt[i],
+				RunAt:     now,
+				Stats:     []byte("{}"),
+			},
+			tracker:  tracker[i],
+			campaign: campaign,
+		}
+		m.jobs = append(m.jobs, j)
+		m.byKey[k] = j
+		m.nextID++
+		res.New++
+	}
+	return res, nil
+}
+
+// ClaimJob implements JobQueue
+func (m *Memory) ClaimJob(ctx context.Context, q Queue) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var best *memoryJob
+	for _, j := range m.jobs {
+		if j.tracker != q.Tracker || (j.Status != StatusCreated && j.Status != StatusRetry) || j.RunAt.After(now) {
+			continue
+		}
+		switch q.Campaign {
+		case 0:
+		case NoCampaign:
+			if j.campaign != 0 {
+				continue
+			}
+		default:
+			if j.campaign != q.Campaign {
+				continue
+			}
+		}
+		// The jobs are ordered by id, so the first of a priority wins.
+		if best == nil || j.Priority > best.Priority {
+			best = j
+		}
+	}
+
+	j := best
+	if j == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	j.Status = StatusRunning
+	j.ClaimedBy = m.id
+	j.leaseUntil = now.Add(m.lease)
+	j.StartTime = now
+	j.EndTime = time.Time{}
+
+	return &Job{
+		ID:         j.ID,
+		Tracker:    j.Tracker,
+		Args:       append([]byte(nil), j.Args...),
+		Attempts:   j.Attempts,
+		RateLimits: j.rateLimits,
+		StartedAt:  now,
+	}, nil
+}
+
+// claimed returns the job if we hold the lease on it
+func (m *Memory) claimed(id int64) *memoryJob {
+	for _, j := range m.jobs {
+		if j.ID == id && j.ClaimedBy == m.id && j.Status == StatusRunning {
+			return j
+		}
+	}
+	return nil
+}
+
+// FinishJob implements JobQueue
+func (m *Memory) FinishJob(ctx context.Context, job *Job, res *trackers.Result, err error) error {
+	f, err := finish(m.id, m.retry, job, res, err)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j := m.claimed(job.ID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+
+	now := time.Now()
+	j.Status = f.status
+	if f.status == StatusRetry {
+		j.Status = m.hold(j, StatusRetry)
+	}
+	j.EndTime = now
+	j.Stats = f.stats
+	j.Resp = f.resp
+	j.Attempts = f.attempts
+	j.rateLimits = f.rateLimits
+	j.LastError = f.lastError.String
+	j.Outcome = f.outcome
+	j.RunAt = now.Add(f.retryIn)
+	j.ClaimedBy = ""
+	j.leaseUntil = time.Time{}
+
+	return f.err
+}
+
+// ReleaseJob implements JobQueue
+func (m *Memory) ReleaseJob(ctx context.Context, job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j := m.claimed(job.ID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+
+	j.Status = StatusRetry
+	if j.Attempts == 0 {
+		j.Status = StatusCreated
+	}
+	j.Status = m.hold(j, j.Status)
+	j.StartTime = time.Time{}
+	j.ClaimedBy = ""
+	j.leaseUntil = time.Time{}
+	j.RunAt = time.Now()
+	return nil
+}
+
+// ReapLeases implements JobQueue
+func (m *Memory) ReapLeases(ctx context.Context) (int64, error) {
+	maxAttempts := m.retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var n int64
+	for _, j := range m.jobs {
+		if j.Status != StatusRunning || !j.leaseUntil.Before(now) {
+			continue
+		}
+
+		j.Attempts++
+		j.Status = m.hold(j, StatusRetry)
+		if j.Attempts >= maxAttempts {
+			j.Status = StatusDead
+		}
+		j.LastError = "lease held by " + j.ClaimedBy + " expired"
+		j.ClaimedBy = ""
+		j.leaseUntil = time.Time{}
+		j.RunAt = now
+		n++
+	}
+	return n, nil
+}
+
+// JobCounts implements JobQueue
+func (m *Memory) JobCounts(ctx context.Context) ([]JobCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type key struct{ tracker, status string }
+	n := make(map[key]int64)
+	for _, j := range m.jobs {
+		n[key{j.Tracker, j.Status}]++
+	}
+
+	counts := make([]JobCount, 0, len(n))
+	for k, v := range n {
+		counts = append(counts, JobCount{Tracker: k.tracker, Status: k.status, N: v})
+	}
+	sort.Slice(counts, func(a, b int) bool {
+		if counts[a].Tracker != counts[b].Tracker {
+			return counts[a].Tracker < counts[b].Tracker
+		}
+		return counts[a].Status < counts[b].Status
+	})
+	return counts, nil
+}
+
+// Jobs implements JobQueue
+func (m *Memory) Jobs(ctx context.Context, f JobFilter) ([]JobInfo, error) {
+	jobs := make([]JobInfo, 0)
+	for _, j := range m.filter(f) {
+		j.Resp = nil
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// ExportJobs implements JobQueue
+func (m *Memory) ExportJobs(ctx context.Context, f JobFilter, fn func(*JobInfo) error) error {
+	for _, j := range m.filter(f) {
+		if err := fn(&j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filter returns copies of the jobs matching f
+func (m *Memory) filter(f JobFilter) []JobInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]JobInfo, 0)
+	for _, j := range m.jobs {
+		if f.Limit > 0 && len(jobs) >= f.Limit {
+			break
+		}
+		if (f.Tracker != 0 && j.tracker != f.Tracker) || (f.Status != "" && j.Status != f.Status) || j.ID <= f.AfterID ||
+			(f.Campaign != 0 && j.campaign != f.Campaign) || (f.Outcome != "" && j.Outcome != f.Outcome) {
+			continue
+		}
+		jobs = append(jobs, j.JobInfo)
+	}
+	return jobs
+}
+
+// hold returns the status a job goes back to waiting in: its campaign's if
+// that is paused or cancelled, status if not. The lock must be held.
+func (m *Memory) hold(j *memoryJob, status string) string {
+	if c := m.campaign(j.campaign); c != nil && (c.Status == CampaignPaused || c.Status == CampaignCancelled) {
+		return c.Status
+	}
+	return status
+}
+
+// campaign returns the campaign with the given id, with the lock held
+func (m *Memory) campaign(id int64) *Campaign {
+	for _, c := range m.campaigns {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// CreateCampaign implements JobQueue
+func (m *Memory) CreateCampaign(ctx context.Context, c *Campaign) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var name string
+	for _, t := range m.trackers {
+		if t.ID == c.TrackerID {
+			name = t.Name
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("there is no tracker with id %d", c.TrackerID)
+	}
+	for _, mc := range m.campaigns {
+		if mc.Name == c.Name {
+			return fmt.Errorf("there is already a campaign named %q", c.Name)
+		}
+	}
+
+	now := time.Now()
+	mc := &Campaign{
+		ID:          int64(len(m.campaigns) + 1),
+		Name:        c.Name,
+		TrackerID:   c.TrackerID,
+		Tracker:     name,
+		Description: c.Description,
+		RangeStart:  c.RangeStart,
+		RangeEnd:    c.RangeEnd,
+		Generator:   c.Generator,
+		Source:      c.Source,
+		CreatedBy:   c.CreatedBy,
+		Status:      CampaignActive,
+		Next:        c.RangeStart,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Weight:      c.weight(),
+		Priority:    c.Priority,
+	}
+	m.campaigns = append(m.campaigns, mc)
+	*c = *mc
+	return nil
+}
+
+// Campaign implements JobQueue
+func (m *Memory) Campaign(ctx context.Context, name string) (*Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.campaigns {
+		if c.Name == name {
+			cc := *c
+			return &cc, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// InsertCampaignJobs implements JobQueue
+func (m *Memory) InsertCampaignJobs(ctx context.Context, c *Campaign, mode InsertMode, args [][]byte, createdAt []time.Time, next int64) (InsertResult, error) {
+	if c.Status != CampaignActive {
+		return InsertResult{}, errCampaignStatus(c)
+	}
+	if len(args) != len(createdAt) {
+		return InsertResult{}, errors.New("All arrays must be equally long")
+	}
+	tracker := make([]int, len(args))
+	for i := range tracker {
+		tracker[i] = c.TrackerID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc := m.campaign(c.ID)
+	if mc == nil || mc.Next != c.Next || mc.Status != CampaignActive {
+		return InsertResult{}, ErrCampaignChanged
+	}
+	if mc.Source == "" && (next < mc.RangeStart || next > mc.RangeEnd) {
+		return InsertResult{}, fmt.Errorf("%d is outside the range of campaign %s", next, c.Name)
+	}
+
+	res, err := m.insertJobs(mode, tracker, args, createdAt, mc)
+	if err != nil {
+		return res, err
+	}
+
+	mc.Next = next
+	mc.UpdatedAt = time.Now()
+	if mc.Source == "" && mc.Next >= mc.RangeEnd {
+		mc.FinishedAt = mc.UpdatedAt
+	}
+	*c = *mc
+	return res, nil
+}
+
+// FinishCampaign implements JobQueue
+func (m *Memory) FinishCampaign(ctx context.Context, c *Campaign) error {
+	if c.Status != CampaignActive {
+		return errCampaignStatus(c)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc := m.campaign(c.ID)
+	if mc == nil || mc.Next != c.Next || mc.Status != CampaignActive || mc.Finished() {
+		return ErrCampaignChanged
+	}
+	mc.UpdatedAt = time.Now()
+	mc.FinishedAt = mc.UpdatedAt
+	*c = *mc
+	return nil
+}
+
+// SetCampaignStatus implements JobQueue
+func (m *Memory) SetCampaignStatus(ctx context.Context, c *Campaign, status string) (int64, error) {
+	if err := validCampaignStatus(status); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc := m.campaign(c.ID)
+	if mc == nil {
+		return 0, sql.ErrNoRows
+	}
+	if mc.Status == CampaignCancelled {
+		return 0, ErrCampaignCancelled
+	}
+	mc.Status = status
+	mc.UpdatedAt = time.Now()
+	c.Status = status
+
+	var n int64
+	for _, j := range m.jobs {
+		if j.campaign != mc.ID {
+			continue
+		}
+		waiting := j.Status == StatusCreated || j.Status == StatusRetry
+		switch {
+		case status == CampaignActive && j.Status == StatusPaused:
+			j.Status = StatusRetry
+			if j.Attempts == 0 {
+				j.Status = StatusCreated
+			}
+		case status == CampaignPaused && waiting:
+			j.Status = StatusPaused
+		case status == CampaignCancelled && (waiting || j.Status == StatusPaused):
+			j.Status = StatusCancelled
+		default:
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// SetCampaignSchedule implements JobQueue
+func (m *Memory) SetCampaignSchedule(ctx context.Context, c *Campaign, weight, priority int) (int64, error) {
+	if err := validWeight(weight); err != nil {
+		return 0, err
+	}
+	if weight == 0 {
+		weight = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc := m.campaign(c.ID)
+	if mc == nil {
+		return 0, sql.ErrNoRows
+	}
+	if mc.Status == CampaignCancelled {
+		return 0, ErrCampaignCancelled
+	}
+	mc.Weight, mc.Priority = weight, priority
+	mc.UpdatedAt = time.Now()
+	c.Weight, c.Priority = weight, priority
+
+	var n int64
+	for _, j := range m.jobs {
+		if j.campaign != mc.ID {
+			continue
+		}
+		if j.Status == StatusCreated || j.Status == StatusRetry || j.Status == StatusPaused {
+			j.Priority = priority
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Campaigns implements JobQueue
+func (m *Memory) Campaigns(ctx context.Context) ([]Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	campaigns := make([]Campaign, 0, len(m.campaigns))
+	for _, c := range m.campaigns {
+		campaigns = append(campaigns, *c)
+	}
+	return campaigns, nil
+}
+
+// CampaignProgress implements JobQueue
+func (m *Memory) CampaignProgress(ctx context.Context, c *Campaign) (*CampaignProgress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := &CampaignProgress{Campaign: *c}
+	hourAgo := time.Now().Add(-time.Hour)
+	for _, j := range m.jobs {
+		if j.campaign != c.ID {
+			continue
+		}
+		p.Jobs++
+		switch j.Status {
+		case StatusCreated, StatusRetry:
+			p.Waiting++
+		case StatusRunning:
+			p.Running++
+		case StatusPaused:
+			p.Paused++
+		case StatusSuccess:
+			p.Done++
+			if j.Outcome == trackers.OutcomeFound.String() {
+				p.Hits++
+			}
+		case StatusFailed, StatusDead:
+			p.Failed++
+		case StatusCancelled:
+			p.Cancelled++
+		}
+		switch j.Status {
+		case StatusSuccess, StatusFailed, StatusDead:
+			if j.EndTime.After(hourAgo) {
+				p.FinishedLastHour++
+			}
+		}
+	}
+	return p, nil
+}
+
+// CreateExploration implements JobQueue
+func (m *Memory) CreateExploration(ctx context.Context, e *Exploration) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.campaign(e.CampaignID) == nil {
+		return fmt.Errorf("there is no campaign with id %d", e.CampaignID)
+	}
+	if m.explorations[e.CampaignID] != nil {
+		return fmt.Errorf("campaign %d is being explored already", e.CampaignID)
+	}
+	me := *e
+	me.CreatedAt = time.Now()
+	m.explorations[e.CampaignID] = &me
+	*e = me
+	return nil
+}
+
+// Exploration implements JobQueue
+func (m *Memory) Exploration(ctx context.Context, campaign int64) (*Exploration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	me := m.explorations[campaign]
+	if me == nil {
+		return nil, sql.ErrNoRows
+	}
+	e := *me
+	return &e, nil
+}
+
+// ExploreBlocks implements JobQueue
+func (m *Memory) ExploreBlocks(ctx context.Context, e *Exploration) ([]ExploreBlock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append(make([]ExploreBlock, 0), m.blocks[e.CampaignID]...), nil
+}
+
+// SaveExploreBlocks implements JobQueue
+func (m *Memory) SaveExploreBlocks(ctx context.Context, e *Exploration, blocks []ExploreBlock) error {
+	for _, b := range blocks {
+		if err := validBlockState(b.State); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.explorations[e.CampaignID] == nil {
+		return fmt.Errorf("campaign %d isn't being explored", e.CampaignID)
+	}
+	saved := m.blocks[e.CampaignID]
+	now := time.Now()
+	for _, b := range blocks {
+		b.UpdatedAt = now
+		i := sort.Search(len(saved), func(i int) bool { return saved[i].Start >= b.Start })
+		if i < len(saved) && saved[i].Start == b.Start {
+			saved[i] = b
+			continue
+		}
+		saved = append(saved, ExploreBlock{})
+		copy(saved[i+1:], saved[i:])
+		saved[i] = b
+	}
+	m.blocks[e.CampaignID] = saved
+	return nil
+}
+
+// AddExploreSamples implements JobQueue
+func (m *Memory) AddExploreSamples(ctx context.Context, e *Exploration, samples []ExploreSample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.explorations[e.CampaignID] == nil {
+		return fmt.Errorf("campaign %d isn't being explored", e.CampaignID)
+	}
+	recorded := m.samples[e.CampaignID]
+	if recorded == nil {
+		recorded = make(map[string]int64)
+		m.samples[e.CampaignID] = recorded
+	}
+	for _, es := range samples {
+		if _, ok := recorded[es.Key]; !ok {
+			recorded[es.Key] = es.Block
+		}
+	}
+	return nil
+}
+
+// ExploreStats implements JobQueue
+func (m *Memory) ExploreStats(ctx context.Context, e *Exploration) ([]BlockStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.campaign(e.CampaignID)
+	if c == nil {
+		return nil, fmt.Errorf("there is no campaign with id %d", e.CampaignID)
+	}
+	sampling := make(map[int64]bool)
+	for _, b := range m.blocks[e.CampaignID] {
+		sampling[b.Start] = b.State == BlockSampling
+	}
+
+	byBlock := make(map[int64]*BlockStats)
+	for key, block := range m.samples[e.CampaignID] {
+		j := m.byKey[uniqueKey{c.TrackerID, key}]
+		if !sampling[block] || j == nil || j.campaign != c.ID {
+			continue
+		}
+		st := byBlock[block]
+		if st == nil {
+			st = &BlockStats{Start: block}
+			byBlock[block] = st
+		}
+		switch j.Status {
+		case StatusCreated, StatusRetry, StatusRunning, StatusPaused:
+			st.Pending++
+		case StatusSuccess:
+			st.Samples++
+			if j.Outcome == trackers.OutcomeFound.String() {
+				st.Hits++
+			}
+		}
+	}
+
+	stats := make([]BlockStats, 0, len(byBlock))
+	for _, st := range byBlock {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Start < stats[j].Start })
+	return stats, nil
+}
+
+// job returns the job with the given id, with the lock held
+func (m *Memory) job(id int64) *memoryJob {
+	i := sort.Search(len(m.jobs), func(i int) bool { return m.jobs[i].ID >= id })
+	if i < len(m.jobs) && m.jobs[i].ID == id {
+		return m.jobs[i]
+	}
+	return nil
+}
+
+// StartFollows implements JobQueue
+func (m *Memory) StartFollows(ctx context.Context, tracker int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	followed := make(map[int64]bool, len(m.follows))
+	for _, f := range m.follows {
+		followed[f.JobID] = true
+	}
+
+	var n int64
+	now := time.Now()
+	for _, j := range m.jobs {
+		if j.tracker != tracker || j.Outcome != trackers.OutcomeFound.String() || j.FollowOf != 0 ||
+			j.Status != StatusSuccess || followed[j.ID] {
+			continue
+		}
+		m.follows = append(m.follows, &Follow{
+			JobID:     j.ID,
+			Tracker:   j.Tracker,
+			LastJobID: j.ID,
+			State:     FollowWaiting,
+			FoundAt:   j.EndTime,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		n++
+	}
+	sort.Slice(m.follows, func(a, b int) bool { return m.follows[a].JobID < m.follows[b].JobID })
+	return n, nil
+}
+
+// WaitingFollows implements JobQueue
+func (m *Memory) WaitingFollows(ctx context.Context, tracker int, limit int) ([]Follow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	follows := make([]Follow, 0)
+	for _, f := range m.follows {
+		if len(follows) >= limit {
+			break
+		}
+		last := m.job(f.LastJobID)
+		if f.State != FollowWaiting || last.tracker != tracker {
+			continue
+		}
+		switch last.Status {
+		case StatusSuccess, StatusFailed, StatusDead, StatusCancelled:
+		default:
+			continue
+		}
+
+		c := *f
+		c.Last = JobInfo{
+			ID:      last.ID,
+			Status:  last.Status,
+			Outcome: last.Outcome,
+			EndTime: last.EndTime,
+			Resp:    append([]byte(nil), last.Resp...),
+		}
+		follows = append(follows, c)
+	}
+	return follows, nil
+}
+
+// SaveFollows implements JobQueue
+func (m *Memory) SaveFollows(ctx context.Context, follows []Follow) error {
+	for _, f := range follows {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, f := range follows {
+		i := sort.Search(len(m.follows), func(i int) bool { return m.follows[i].JobID >= f.JobID })
+		if i == len(m.follows) || m.follows[i].JobID != f.JobID || m.follows[i].LastJobID != f.LastJobID {
+			continue
+		}
+		saved := m.follows[i]
+		saved.State = f.State
+		saved.Status = f.Status
+		saved.NextAt = f.NextAt
+		saved.UpdatedAt = now
+	}
+	return nil
+}
+
+// FollowUp implements JobQueue
+func (m *Memory) FollowUp(ctx context.Context, tracker int, now time.Time, priority int, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []*Follow
+	for _, f := range m.follows {
+		if f.State == FollowScheduled && !f.NextAt.After(now) && m.job(f.JobID).tracker == tracker {
+			due = append(due, f)
+		}
+	}
+	sort.SliceStable(due, func(a, b int) bool { return due[a].NextAt.Before(due[b].NextAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	createdAt := time.Now()
+	for _, f := range due {
+		first := m.job(f.JobID)
+		j := &memoryJob{
+			JobInfo: JobInfo{
+				ID:        m.nextID,
+				Tracker:   first.Tracker,
+				Args:      append([]byte(nil), first.Args...),
+				Status:    StatusCreated,
+				Priority:  priority,
+				CreatedAt: createdAt,
+				RunAt:     createdAt,
+				Stats:     []byte("{}"),
+				FollowOf:  first.ID,
+			},
+			tracker: first.tracker,
+		}
+		m.jobs = append(m.jobs, j)
+		m.nextID++
+
+		f.LastJobID = j.ID
+		f.State = FollowWaiting
+		f.Checks++
+		f.NextAt = time.Time{}
+		f.UpdatedAt = createdAt
+	}
+	return int64(len(due)), nil
+}
+
+// SaveConsignments saves what the job found, in place of anything saved for
+// it before.
+func (m *Memory) SaveConsignments(ctx context.Context, job int64, consignments []trackers.Consignment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.job(job) == nil {
+		return fmt.Errorf("there is no job with id %d", job)
+	}
+	m.consignments[job] = copyConsignments(consignments)
+	return nil
+}
+
+// Consignments returns what was saved for the job, in the order it was saved
+func (m *Memory) Consignments(ctx context.Context, job int64) ([]trackers.Consignment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copyConsignments(m.consignments[job]), nil
+}
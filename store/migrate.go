@@ -0,0 +1,261 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const sqlCreateSchemaMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)
+`
+
+const sqlGetSchemaMigrations = `
+SELECT
+	version,
+	applied_at
+FROM
+	schema_migrations
+ORDER BY
+	version ASC
+`
+
+const sqlGetSchemaVersion = `
+SELECT
+	COALESCE(max(version), 0)
+FROM
+	schema_migrations
+`
+
+const sqlInsertSchemaMigration = `
+INSERT INTO
+	schema_migrations (
+		version,
+		name
+	)
+VALUES
+	($1, $2)
+`
+
+const sqlDeleteSchemaMigration = `
+DELETE FROM
+	schema_migrations
+WHERE
+	version = $1
+`
+
+// migrationLockID is the advisory lock held while migrating, so that two
+// nodes never try to migrate at the same time.
+const migrationLockID = 7370617
+
+// ErrNoMigration is returned by Down when there is nothing to revert
+var ErrNoMigration = errors.New("no migration to revert")
+
+// SchemaVersion is the version of the schema this code works against
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationStatus is the status of a single migration
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts migrations. It works on a plain connection,
+// since New refuses to work against a schema that is out of date.
+type Migrator struct {
+	db *sql.DB
+}
+
+// NewMigrator creates a migrator for the database at connString
+func NewMigrator(connString string) (*Migrator, error) {
+	if _, ok := sqlitePath(connString); ok {
+		return nil, errors.New("SQLite databases are migrated when they are opened")
+	}
+
+	db, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(context.Background(), sqlCreateSchemaMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Migrator{db: db}, nil
+}
+
+// Close closes the connection to the database
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Status returns the status of every migration we know about
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	rows, err := m.db.QueryContext(ctx, sqlGetSchemaMigrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, mig := range migrations {
+		at, ok := applied[mig.version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   mig.version,
+			Name:      mig.name,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return statuses, nil
+}
+
+// Up applies all the migrations that haven't been applied yet, each in its
+// own transaction. It returns the number of migrations applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	n := 0
+	for _, mig := range migrations {
+		applied, err := m.apply(ctx, mig)
+		if err != nil {
+			return n, fmt.Errorf("migration %d (%s): %s", mig.version, mig.name, err.Error())
+		}
+		if applied {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// apply applies a single migration, unless it has already been applied
+func (m *Migrator) apply(ctx context.Context, mig migration) (bool, error) {
+	tx, err := m.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, sqlGetSchemaVersion).Scan(&version); err != nil {
+		return false, err
+	}
+	if version >= mig.version {
+		return false, nil
+	}
+
+	log.Printf("Applying migration %d: %s\n", mig.version, mig.name)
+	if _, err := tx.ExecContext(ctx, mig.up); err != nil {
+		return false, err
+	}
+	if mig.fill != nil {
+		if err := mig.fill(tx); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, sqlInsertSchemaMigration, mig.version, mig.name); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Down reverts the latest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+	tx, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, sqlGetSchemaVersion).Scan(&version); err != nil {
+		return err
+	}
+	if version == 0 {
+		return ErrNoMigration
+	}
+	if version > SchemaVersion() {
+		return fmt.Errorf("schema is at version %d, which is newer than this version of packtrack knows about", version)
+	}
+
+	mig := migrations[version-1]
+	log.Printf("Reverting migration %d: %s\n", mig.version, mig.name)
+	if _, err := tx.ExecContext(ctx, mig.down); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, sqlDeleteSchemaMigration, mig.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lock starts a transaction holding the migration lock
+func (m *Migrator) lock(ctx context.Context) (*sql.Tx, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// checkSchema returns an error unless the schema is at the version we need
+func checkSchema(db *sql.DB) error {
+	var version int
+	err := db.QueryRowContext(context.Background(), sqlGetSchemaVersion).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("couldn't get the schema version, has the database been migrated? %s", err.Error())
+	}
+
+	if version < SchemaVersion() {
+		return fmt.Errorf("schema is at version %d, but we need %d: run packtrack migrate up", version, SchemaVersion())
+	}
+	if version > SchemaVersion() {
+		return fmt.Errorf("schema is at version %d, which is newer than the %d this version of packtrack knows about", version, SchemaVersion())
+	}
+	return nil
+}
@@ -0,0 +1,798 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import "database/sql"
+
+// migration is a numbered change to the schema, with the SQL to apply it
+// and the SQL to revert it. The migrations that existed before we started
+// tracking them are written so they can be applied to a database that was
+// set up by hand.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+
+	// fill is run after up, in the same transaction, for the changes that
+	// can't be done in SQL.
+	fill func(tx *sql.Tx) error
+}
+
+// migrations must be kept in order, with no gaps in the versions. Never
+// change a migration once it has been released, add a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "trackers and scrape jobs",
+		up: `
+CREATE TABLE IF NOT EXISTS trackers (
+	id SERIAL PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	description TEXT NOT NULL,
+	url TEXT NOT NULL
+);
+
+INSERT INTO
+	trackers (name, description, url)
+VALUES
+	('bring', 'the norwegian postal service', 'https://developer.bring.com/')
+ON CONFLICT
+	DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS scrape_jobs (
+	id BIGSERIAL PRIMARY KEY,
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	args JSONB DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'created',
+	created_at TIMESTAMPTZ NOT NULL,
+	start_time TIMESTAMPTZ,
+	end_time TIMESTAMPTZ,
+	stats JSONB DEFAULT '{}',
+	resp JSONB,
+	CONSTRAINT created_before_started CHECK (created_at <= start_time),
+	CONSTRAINT started_before_ended CHECK (start_time <= end_time),
+	CONSTRAINT end_must_start CHECK ( (end_time IS NULL) OR (start_time IS NOT NULL))
+);
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_status ON scrape_jobs (status);
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_created_at ON scrape_jobs (created_at);
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_end_time ON scrape_jobs (end_time);
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_start_time ON scrape_jobs (start_time);
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_id_where_status_eq_created ON scrape_jobs(id) WHERE status = 'created';
+`,
+		down: `
+DROP TABLE IF EXISTS scrape_jobs;
+DROP TABLE IF EXISTS trackers;
+`,
+	},
+	{
+		version: 2,
+		name:    "retry states",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS last_error TEXT;
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_id_where_status_eq_retry ON scrape_jobs(id) WHERE status = 'retry';
+`,
+		down: `
+DROP INDEX IF EXISTS idx_scrape_jobs_id_where_status_eq_retry;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS last_error;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS attempts;
+`,
+	},
+	{
+		version: 3,
+		name:    "scheduled retries",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS run_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_run_at_where_status_eq_retry ON scrape_jobs(run_at) WHERE status = 'retry';
+`,
+		down: `
+DROP INDEX IF EXISTS idx_scrape_jobs_run_at_where_status_eq_retry;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS run_at;
+`,
+	},
+	{
+		version: 4,
+		name:    "job leases",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS claimed_by TEXT;
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_lease_until_where_status_eq_running ON scrape_jobs(lease_until) WHERE status = 'running';
+`,
+		down: `
+DROP INDEX IF EXISTS idx_scrape_jobs_lease_until_where_status_eq_running;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS lease_until;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS claimed_by;
+`,
+	},
+	{
+		version: 5,
+		name:    "shared rate limits",
+		up: `
+CREATE TABLE IF NOT EXISTS rate_limits (
+	tracker INTEGER PRIMARY KEY REFERENCES trackers(id),
+	rate DOUBLE PRECISION NOT NULL,
+	burst DOUBLE PRECISION NOT NULL,
+	tokens DOUBLE PRECISION NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	paused_until TIMESTAMPTZ,
+	CONSTRAINT positive_rate CHECK (rate > 0),
+	CONSTRAINT burst_at_least_one CHECK (burst >= 1)
+);
+`,
+		down: `
+DROP TABLE IF EXISTS rate_limits;
+`,
+	},
+	{
+		version: 6,
+		name:    "nodes",
+		up: `
+CREATE TABLE IF NOT EXISTS nodes (
+	id TEXT PRIMARY KEY,
+	version TEXT NOT NULL,
+	hostname TEXT NOT NULL,
+	workers INTEGER NOT NULL DEFAULT 0,
+	rate DOUBLE PRECISION,
+	last_error TEXT,
+	jobs_done BIGINT NOT NULL DEFAULT 0,
+	jobs_failed BIGINT NOT NULL DEFAULT 0,
+	started_at TIMESTAMPTZ NOT NULL,
+	last_heartbeat TIMESTAMPTZ NOT NULL,
+	status TEXT NOT NULL DEFAULT 'alive'
+);
+CREATE INDEX IF NOT EXISTS idx_nodes_last_heartbeat_where_status_eq_alive ON nodes(last_heartbeat) WHERE status = 'alive';
+`,
+		down: `
+DROP TABLE IF EXISTS nodes;
+`,
+	},
+	{
+		version: 7,
+		name:    "job keys",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN job_key TEXT;
+
+-- The jobs we have get the key their tracker would give them, which for
+-- bring is the q of the args. Where the same key was queued more than
+-- once, only the first job gets it, and the others are left without.
+UPDATE
+	scrape_jobs sj
+SET
+	job_key = k.job_key
+FROM
+	(
+		SELECT DISTINCT ON (tracker, job_key)
+			id,
+			job_key
+		FROM
+			(
+				SELECT
+					sj.id,
+					sj.tracker,
+					CASE WHEN t.name = 'bring' THEN sj.args->>'q' ELSE sj.args::text END AS job_key
+				FROM
+					scrape_jobs sj
+					INNER JOIN trackers t ON t.id = sj.tracker
+			) keys
+		WHERE
+			job_key IS NOT NULL
+		ORDER BY
+			tracker, job_key, id
+	) k
+WHERE
+	sj.id = k.id;
+
+CREATE UNIQUE INDEX idx_scrape_jobs_tracker_job_key ON scrape_jobs (tracker, job_key);
+`,
+		down: `
+DROP INDEX IF EXISTS idx_scrape_jobs_tracker_job_key;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS job_key;
+`,
+	},
+	{
+		version: 8,
+		name:    "campaigns",
+		up: `
+CREATE TABLE IF NOT EXISTS campaigns (
+	id BIGSERIAL PRIMARY KEY,
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	range_start BIGINT NOT NULL,
+	range_end BIGINT NOT NULL,
+	next_id BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	finished_at TIMESTAMPTZ,
+	CONSTRAINT start_before_end CHECK (range_start < range_end),
+	CONSTRAINT next_in_range CHECK (next_id BETWEEN range_start AND range_end)
+);
+CREATE INDEX IF NOT EXISTS idx_campaigns_tracker_where_unfinished ON campaigns (tracker) WHERE finished_at IS NULL;
+`,
+		down: `
+DROP TABLE IF EXISTS campaigns;
+`,
+	},
+	{
+		version: 9,
+		name:    "named campaigns",
+		up: `
+ALTER TABLE campaigns
+	ADD COLUMN IF NOT EXISTS name TEXT,
+	ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS source TEXT,
+	ADD COLUMN IF NOT EXISTS created_by TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active',
+	ALTER COLUMN range_start DROP NOT NULL,
+	ALTER COLUMN range_end DROP NOT NULL;
+
+-- The latest campaign for a range gets the name enqueue gives it, so an
+-- unfinished one is still picked up again. Older ones are named by id.
+UPDATE
+	campaigns c
+SET
+	name = CASE
+		WHEN c.id = (SELECT max(id) FROM campaigns l WHERE l.tracker = c.tracker AND l.range_start = c.range_start AND l.range_end = c.range_end)
+		THEN t.name || '-' || c.range_start || '-' || c.range_end
+		ELSE 'campaign-' || c.id
+	END
+FROM
+	trackers t
+WHERE
+	t.id = c.tracker;
+
+ALTER TABLE campaigns
+	ALTER COLUMN name SET NOT NULL,
+	ADD CONSTRAINT campaigns_name_key UNIQUE (name),
+	ADD CONSTRAINT range_or_source CHECK ((range_start IS NOT NULL AND range_end IS NOT NULL) <> (source IS NOT NULL));
+
+-- Jobs queued before this aren't part of any campaign.
+ALTER TABLE scrape_jobs
+	ADD COLUMN IF NOT EXISTS campaign_id BIGINT REFERENCES campaigns(id),
+	ADD COLUMN IF NOT EXISTS outcome TEXT;
+UPDATE scrape_jobs SET outcome = stats->>'Outcome' WHERE stats ? 'Outcome';
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_campaign_id_status ON scrape_jobs (campaign_id, status);
+
+CREATE VIEW campaign_progress AS
+SELECT
+	c.id,
+	c.name,
+	count(sj.id) AS jobs,
+	count(sj.id) FILTER (WHERE sj.status IN ('created', 'retry')) AS waiting,
+	count(sj.id) FILTER (WHERE sj.status = 'running') AS running,
+	count(sj.id) FILTER (WHERE sj.status = 'paused') AS paused,
+	count(sj.id) FILTER (WHERE sj.status = 'success') AS done,
+	count(sj.id) FILTER (WHERE sj.status IN ('failed', 'dead')) AS failed,
+	count(sj.id) FILTER (WHERE sj.status = 'cancelled') AS cancelled,
+	count(sj.id) FILTER (WHERE sj.status = 'success' AND sj.outcome = 'found') AS hits,
+	count(sj.id) FILTER (WHERE sj.status IN ('success', 'failed', 'dead') AND sj.end_time > now() - interval '1 hour') AS finished_last_hour
+FROM
+	campaigns c
+	LEFT JOIN scrape_jobs sj ON sj.campaign_id = c.id
+GROUP BY
+	c.id;
+`,
+		down: `
+DROP VIEW IF EXISTS campaign_progress;
+DROP INDEX IF EXISTS idx_scrape_jobs_campaign_id_status;
+ALTER TABLE scrape_jobs
+	DROP COLUMN IF EXISTS outcome,
+	DROP COLUMN IF EXISTS campaign_id;
+
+DELETE FROM campaigns WHERE source IS NOT NULL;
+ALTER TABLE campaigns
+	DROP CONSTRAINT IF EXISTS range_or_source,
+	DROP CONSTRAINT IF EXISTS campaigns_name_key,
+	DROP COLUMN IF EXISTS status,
+	DROP COLUMN IF EXISTS created_by,
+	DROP COLUMN IF EXISTS source,
+	DROP COLUMN IF EXISTS description,
+	DROP COLUMN IF EXISTS name,
+	ALTER COLUMN range_start SET NOT NULL,
+	ALTER COLUMN range_end SET NOT NULL;
+`,
+	},
+	{
+		version: 10,
+		name:    "priorities",
+		up: `
+ALTER TABLE campaigns
+	ADD COLUMN IF NOT EXISTS weight INTEGER NOT NULL DEFAULT 1,
+	ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0,
+	ADD CONSTRAINT positive_weight CHECK (weight > 0);
+
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_tracker_priority_id_where_waiting ON scrape_jobs (tracker, priority DESC, id) WHERE status IN ('created', 'retry');
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_campaign_id_priority_id_where_waiting ON scrape_jobs (campaign_id, priority DESC, id) WHERE status IN ('created', 'retry');
+`,
+		down: `
+DROP INDEX IF EXISTS idx_scrape_jobs_campaign_id_priority_id_where_waiting;
+DROP INDEX IF EXISTS idx_scrape_jobs_tracker_priority_id_where_waiting;
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS priority;
+
+ALTER TABLE campaigns
+	DROP CONSTRAINT IF EXISTS positive_weight,
+	DROP COLUMN IF EXISTS priority,
+	DROP COLUMN IF EXISTS weight;
+`,
+	},
+	{
+		version: 11,
+		name:    "id generators",
+		up: `
+ALTER TABLE campaigns
+	ADD COLUMN IF NOT EXISTS generator TEXT,
+	ADD CONSTRAINT generator_for_range CHECK (generator IS NULL OR source IS NULL);
+`,
+		down: `
+ALTER TABLE campaigns
+	DROP CONSTRAINT IF EXISTS generator_for_range,
+	DROP COLUMN IF EXISTS generator;
+`,
+	},
+	{
+		version: 12,
+		name:    "explorations",
+		up: `
+CREATE TABLE IF NOT EXISTS explorations (
+	campaign_id BIGINT PRIMARY KEY REFERENCES campaigns(id),
+	block_size BIGINT NOT NULL CHECK (block_size > 0),
+	stride BIGINT NOT NULL CHECK (stride > 0),
+	factor BIGINT NOT NULL CHECK (factor > 1),
+	min_hit_rate DOUBLE PRECISION NOT NULL CHECK (min_hit_rate BETWEEN 0 AND 1),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS explore_blocks (
+	campaign_id BIGINT NOT NULL REFERENCES explorations(campaign_id),
+	block_start BIGINT NOT NULL,
+	stride BIGINT NOT NULL CHECK (stride > 0),
+	state TEXT NOT NULL CHECK (state IN ('sampling', 'done', 'abandoned')),
+	samples BIGINT NOT NULL DEFAULT 0,
+	hits BIGINT NOT NULL DEFAULT 0,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (campaign_id, block_start)
+);
+
+-- The samples of an exploration, by block, so the blocks can be summed up
+-- without turning every job key back into a serial.
+CREATE TABLE IF NOT EXISTS explore_samples (
+	campaign_id BIGINT NOT NULL REFERENCES explorations(campaign_id),
+	job_key TEXT NOT NULL,
+	block_start BIGINT NOT NULL,
+	PRIMARY KEY (campaign_id, job_key)
+);
+CREATE INDEX IF NOT EXISTS idx_explore_samples_campaign_id_block_start ON explore_samples (campaign_id, block_start);
+`,
+		down: `
+DROP TABLE IF EXISTS explore_samples;
+DROP TABLE IF EXISTS explore_blocks;
+DROP TABLE IF EXISTS explorations;
+`,
+	},
+	{
+		version: 13,
+		name:    "follow-ups",
+		up: `
+-- A follow-up scrapes the same key again, so the key is only unique among
+-- the jobs that aren't follow-ups.
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS follow_of BIGINT REFERENCES scrape_jobs(id);
+DROP INDEX IF EXISTS idx_scrape_jobs_tracker_job_key;
+CREATE UNIQUE INDEX idx_scrape_jobs_tracker_job_key_where_first ON scrape_jobs (tracker, job_key) WHERE follow_of IS NULL;
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_follow_of ON scrape_jobs (follow_of) WHERE follow_of IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_scrape_jobs_tracker_id_where_found ON scrape_jobs (tracker, id) WHERE outcome = 'found' AND follow_of IS NULL;
+
+CREATE TABLE IF NOT EXISTS follows (
+	job_id BIGINT PRIMARY KEY REFERENCES scrape_jobs(id),
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	last_job_id BIGINT NOT NULL REFERENCES scrape_jobs(id),
+	state TEXT NOT NULL CHECK (state IN ('waiting', 'scheduled', 'stopped')),
+	status TEXT NOT NULL DEFAULT '',
+	checks INTEGER NOT NULL DEFAULT 0,
+	found_at TIMESTAMPTZ NOT NULL,
+	next_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	CONSTRAINT scheduled_has_next_at CHECK (state <> 'scheduled' OR next_at IS NOT NULL)
+);
+CREATE INDEX IF NOT EXISTS idx_follows_tracker_next_at_where_scheduled ON follows (tracker, next_at) WHERE state = 'scheduled';
+CREATE INDEX IF NOT EXISTS idx_follows_tracker_job_id_where_waiting ON follows (tracker, job_id) WHERE state = 'waiting';
+`,
+		down: `
+DROP TABLE IF EXISTS follows;
+
+-- The follow-ups have to go for the key to be unique again.
+DELETE FROM scrape_jobs WHERE follow_of IS NOT NULL;
+DROP INDEX IF EXISTS idx_scrape_jobs_tracker_id_where_found;
+DROP INDEX IF EXISTS idx_scrape_jobs_follow_of;
+DROP INDEX IF EXISTS idx_scrape_jobs_tracker_job_key_where_first;
+CREATE UNIQUE INDEX idx_scrape_jobs_tracker_job_key ON scrape_jobs (tracker, job_key);
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS follow_of;
+`,
+	},
+	{
+		version: 14,
+		name:    "consignments, packages and events",
+		up: `
+-- What the responses of the jobs that found something say, so it can be
+-- queried without digging through resp. Every job gets rows of its own, so
+-- the follow-ups of a package show how it moved along.
+CREATE TABLE IF NOT EXISTS consignments (
+	id BIGSERIAL PRIMARY KEY,
+	job_id BIGINT NOT NULL REFERENCES scrape_jobs(id),
+	number TEXT NOT NULL,
+	previous_number TEXT NOT NULL DEFAULT '',
+	sender_name TEXT NOT NULL DEFAULT '',
+	sender_reference TEXT NOT NULL DEFAULT '',
+	sender_country_code TEXT NOT NULL DEFAULT '',
+	recipient_country_code TEXT NOT NULL DEFAULT '',
+	total_weight_kg DOUBLE PRECISION NOT NULL DEFAULT 0,
+	total_volume_dm3 DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_consignments_job_id ON consignments (job_id);
+CREATE INDEX IF NOT EXISTS idx_consignments_number ON consignments (number);
+
+CREATE TABLE IF NOT EXISTS packages (
+	id BIGSERIAL PRIMARY KEY,
+	consignment_id BIGINT NOT NULL REFERENCES consignments(id),
+	number TEXT NOT NULL,
+	previous_number TEXT NOT NULL DEFAULT '',
+	product_name TEXT NOT NULL DEFAULT '',
+	product_code TEXT NOT NULL DEFAULT '',
+	brand TEXT NOT NULL DEFAULT '',
+	status_description TEXT NOT NULL DEFAULT '',
+	sender_name TEXT NOT NULL DEFAULT '',
+	recipient_postal_code TEXT NOT NULL DEFAULT '',
+	recipient_city TEXT NOT NULL DEFAULT '',
+	recipient_country TEXT NOT NULL DEFAULT '',
+	weight_kg DOUBLE PRECISION NOT NULL DEFAULT 0,
+	volume_dm3 DOUBLE PRECISION NOT NULL DEFAULT 0,
+	length_cm INTEGER NOT NULL DEFAULT 0,
+	width_cm INTEGER NOT NULL DEFAULT 0,
+	height_cm INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_packages_consignment_id ON packages (consignment_id);
+CREATE INDEX IF NOT EXISTS idx_packages_number ON packages (number);
+
+CREATE TABLE IF NOT EXISTS events (
+	id BIGSERIAL PRIMARY KEY,
+	package_id BIGINT NOT NULL REFERENCES packages(id),
+	occurred_at TIMESTAMPTZ,
+	status TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	unit_id TEXT NOT NULL DEFAULT '',
+	unit_type TEXT NOT NULL DEFAULT '',
+	postal_code TEXT NOT NULL DEFAULT '',
+	city TEXT NOT NULL DEFAULT '',
+	country_code TEXT NOT NULL DEFAULT '',
+	country TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_events_package_id_occurred_at ON events (package_id, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_events_status ON events (status);
+`,
+		down: `
+DROP TABLE IF EXISTS events;
+DROP TABLE IF EXISTS packages;
+DROP TABLE IF EXISTS consignments;
+`,
+	},
+	{
+		version: 15,
+		name:    "rate limits of jobs",
+		up: `
+-- How many times in a row a job has been rate limited, which it backs off
+-- on, as it doesn't count as an attempt.
+ALTER TABLE scrape_jobs ADD COLUMN IF NOT EXISTS rate_limits INTEGER NOT NULL DEFAULT 0;
+`,
+		down: `
+ALTER TABLE scrape_jobs DROP COLUMN IF EXISTS rate_limits;
+`,
+	},
+}
+
+// sqliteMigrations are the migrations of SQLite databases. They are applied
+// when the database is opened, and there is no going back, so they have no
+// down. The same rules as for migrations apply.
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "trackers, scrape jobs and nodes",
+		up: `
+CREATE TABLE trackers (
+	id INTEGER PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	description TEXT NOT NULL,
+	url TEXT NOT NULL
+);
+
+INSERT INTO
+	trackers (name, description, url)
+VALUES
+	('bring', 'the norwegian postal service', 'https://developer.bring.com/');
+
+-- The times are nanoseconds since the unix epoch.
+CREATE TABLE scrape_jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	args TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'created',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at INTEGER NOT NULL,
+	start_time INTEGER,
+	end_time INTEGER,
+	run_at INTEGER NOT NULL,
+	claimed_by TEXT,
+	lease_until INTEGER,
+	stats TEXT NOT NULL DEFAULT '{}',
+	resp TEXT
+);
+CREATE INDEX idx_scrape_jobs_status ON scrape_jobs (status);
+CREATE INDEX idx_scrape_jobs_tracker_id_where_waiting ON scrape_jobs (tracker, id) WHERE status IN ('created', 'retry');
+CREATE INDEX idx_scrape_jobs_lease_until_where_running ON scrape_jobs (lease_until) WHERE status = 'running';
+
+CREATE TABLE nodes (
+	id TEXT PRIMARY KEY,
+	version TEXT NOT NULL,
+	hostname TEXT NOT NULL,
+	workers INTEGER NOT NULL DEFAULT 0,
+	rate REAL,
+	last_error TEXT,
+	jobs_done INTEGER NOT NULL DEFAULT 0,
+	jobs_failed INTEGER NOT NULL DEFAULT 0,
+	started_at INTEGER NOT NULL,
+	last_heartbeat INTEGER NOT NULL,
+	status TEXT NOT NULL DEFAULT 'alive'
+);
+`,
+	},
+	{
+		version: 2,
+		name:    "job keys",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN job_key TEXT;
+`,
+		fill: fillSQLiteJobKeys,
+	},
+	{
+		version: 3,
+		name:    "unique job keys",
+		up: `
+CREATE UNIQUE INDEX idx_scrape_jobs_tracker_job_key ON scrape_jobs (tracker, job_key);
+`,
+	},
+	{
+		version: 4,
+		name:    "campaigns",
+		up: `
+CREATE TABLE campaigns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	range_start INTEGER NOT NULL,
+	range_end INTEGER NOT NULL,
+	next_id INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	finished_at INTEGER,
+	CHECK (range_start < range_end),
+	CHECK (next_id BETWEEN range_start AND range_end)
+);
+`,
+	},
+	{
+		version: 5,
+		name:    "named campaigns",
+		up: `
+CREATE TABLE campaigns_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	description TEXT NOT NULL DEFAULT '',
+	range_start INTEGER,
+	range_end INTEGER,
+	source TEXT,
+	created_by TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'active',
+	next_id INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	finished_at INTEGER,
+	CHECK (range_start < range_end),
+	CHECK (next_id BETWEEN range_start AND range_end),
+	CHECK ((range_start IS NOT NULL AND range_end IS NOT NULL) <> (source IS NOT NULL))
+);
+
+-- The latest campaign for a range gets the name enqueue gives it, so an
+-- unfinished one is still picked up again. Older ones are named by id.
+INSERT INTO
+	campaigns_new (id, name, tracker, range_start, range_end, next_id, created_at, updated_at, finished_at)
+SELECT
+	c.id,
+	CASE
+		WHEN c.id = (SELECT max(id) FROM campaigns l WHERE l.tracker = c.tracker AND l.range_start = c.range_start AND l.range_end = c.range_end)
+		THEN t.name || '-' || c.range_start || '-' || c.range_end
+		ELSE 'campaign-' || c.id
+	END,
+	c.tracker,
+	c.range_start,
+	c.range_end,
+	c.next_id,
+	c.created_at,
+	c.updated_at,
+	c.finished_at
+FROM
+	campaigns c
+	INNER JOIN trackers t ON t.id = c.tracker;
+
+DROP TABLE campaigns;
+ALTER TABLE campaigns_new RENAME TO campaigns;
+
+-- Jobs queued before this aren't part of any campaign.
+ALTER TABLE scrape_jobs ADD COLUMN campaign_id INTEGER REFERENCES campaigns(id);
+ALTER TABLE scrape_jobs ADD COLUMN outcome TEXT;
+CREATE INDEX idx_scrape_jobs_campaign_id_status ON scrape_jobs (campaign_id, status);
+`,
+		fill: fillSQLiteOutcomes,
+	},
+	{
+		version: 6,
+		name:    "priorities",
+		up: `
+ALTER TABLE campaigns ADD COLUMN weight INTEGER NOT NULL DEFAULT 1 CHECK (weight > 0);
+ALTER TABLE campaigns ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE scrape_jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+DROP INDEX idx_scrape_jobs_tracker_id_where_waiting;
+CREATE INDEX idx_scrape_jobs_tracker_priority_id_where_waiting ON scrape_jobs (tracker, priority DESC, id) WHERE status IN ('created', 'retry');
+CREATE INDEX idx_scrape_jobs_campaign_id_priority_id_where_waiting ON scrape_jobs (campaign_id, priority DESC, id) WHERE status IN ('created', 'retry');
+`,
+	},
+	{
+		version: 7,
+		name:    "id generators",
+		up: `
+ALTER TABLE campaigns ADD COLUMN generator TEXT CHECK (generator IS NULL OR source IS NULL);
+`,
+	},
+	{
+		version: 8,
+		name:    "explorations",
+		up: `
+CREATE TABLE explorations (
+	campaign_id INTEGER PRIMARY KEY REFERENCES campaigns(id),
+	block_size INTEGER NOT NULL CHECK (block_size > 0),
+	stride INTEGER NOT NULL CHECK (stride > 0),
+	factor INTEGER NOT NULL CHECK (factor > 1),
+	min_hit_rate REAL NOT NULL CHECK (min_hit_rate BETWEEN 0 AND 1),
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE explore_blocks (
+	campaign_id INTEGER NOT NULL REFERENCES explorations(campaign_id),
+	block_start INTEGER NOT NULL,
+	stride INTEGER NOT NULL CHECK (stride > 0),
+	state TEXT NOT NULL CHECK (state IN ('sampling', 'done', 'abandoned')),
+	samples INTEGER NOT NULL DEFAULT 0,
+	hits INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL,
+	PRIMARY KEY (campaign_id, block_start)
+);
+
+CREATE TABLE explore_samples (
+	campaign_id INTEGER NOT NULL REFERENCES explorations(campaign_id),
+	job_key TEXT NOT NULL,
+	block_start INTEGER NOT NULL,
+	PRIMARY KEY (campaign_id, job_key)
+);
+CREATE INDEX idx_explore_samples_campaign_id_block_start ON explore_samples (campaign_id, block_start);
+`,
+	},
+	{
+		version: 9,
+		name:    "follow-ups",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN follow_of INTEGER REFERENCES scrape_jobs(id);
+DROP INDEX idx_scrape_jobs_tracker_job_key;
+CREATE UNIQUE INDEX idx_scrape_jobs_tracker_job_key_where_first ON scrape_jobs (tracker, job_key) WHERE follow_of IS NULL;
+CREATE INDEX idx_scrape_jobs_follow_of ON scrape_jobs (follow_of) WHERE follow_of IS NOT NULL;
+CREATE INDEX idx_scrape_jobs_tracker_id_where_found ON scrape_jobs (tracker, id) WHERE outcome = 'found' AND follow_of IS NULL;
+
+CREATE TABLE follows (
+	job_id INTEGER PRIMARY KEY REFERENCES scrape_jobs(id),
+	tracker INTEGER NOT NULL REFERENCES trackers(id),
+	last_job_id INTEGER NOT NULL REFERENCES scrape_jobs(id),
+	state TEXT NOT NULL CHECK (state IN ('waiting', 'scheduled', 'stopped')),
+	status TEXT NOT NULL DEFAULT '',
+	checks INTEGER NOT NULL DEFAULT 0,
+	found_at INTEGER NOT NULL,
+	next_at INTEGER,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	CHECK (state <> 'scheduled' OR next_at IS NOT NULL)
+);
+CREATE INDEX idx_follows_tracker_next_at_where_scheduled ON follows (tracker, next_at) WHERE state = 'scheduled';
+CREATE INDEX idx_follows_tracker_job_id_where_waiting ON follows (tracker, job_id) WHERE state = 'waiting';
+`,
+	},
+	{
+		version: 10,
+		name:    "consignments, packages and events",
+		up: `
+CREATE TABLE consignments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id INTEGER NOT NULL REFERENCES scrape_jobs(id),
+	number TEXT NOT NULL,
+	previous_number TEXT NOT NULL DEFAULT '',
+	sender_name TEXT NOT NULL DEFAULT '',
+	sender_reference TEXT NOT NULL DEFAULT '',
+	sender_country_code TEXT NOT NULL DEFAULT '',
+	recipient_country_code TEXT NOT NULL DEFAULT '',
+	total_weight_kg REAL NOT NULL DEFAULT 0,
+	total_volume_dm3 REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_consignments_job_id ON consignments (job_id);
+CREATE INDEX idx_consignments_number ON consignments (number);
+
+CREATE TABLE packages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	consignment_id INTEGER NOT NULL REFERENCES consignments(id),
+	number TEXT NOT NULL,
+	previous_number TEXT NOT NULL DEFAULT '',
+	product_name TEXT NOT NULL DEFAULT '',
+	product_code TEXT NOT NULL DEFAULT '',
+	brand TEXT NOT NULL DEFAULT '',
+	status_description TEXT NOT NULL DEFAULT '',
+	sender_name TEXT NOT NULL DEFAULT '',
+	recipient_postal_code TEXT NOT NULL DEFAULT '',
+	recipient_city TEXT NOT NULL DEFAULT '',
+	recipient_country TEXT NOT NULL DEFAULT '',
+	weight_kg REAL NOT NULL DEFAULT 0,
+	volume_dm3 REAL NOT NULL DEFAULT 0,
+	length_cm INTEGER NOT NULL DEFAULT 0,
+	width_cm INTEGER NOT NULL DEFAULT 0,
+	height_cm INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_packages_consignment_id ON packages (consignment_id);
+CREATE INDEX idx_packages_number ON packages (number);
+
+CREATE TABLE events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	package_id INTEGER NOT NULL REFERENCES packages(id),
+	occurred_at INTEGER,
+	status TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	unit_id TEXT NOT NULL DEFAULT '',
+	unit_type TEXT NOT NULL DEFAULT '',
+	postal_code TEXT NOT NULL DEFAULT '',
+	city TEXT NOT NULL DEFAULT '',
+	country_code TEXT NOT NULL DEFAULT '',
+	country TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_events_package_id_occurred_at ON events (package_id, occurred_at);
+CREATE INDEX idx_events_status ON events (status);
+`,
+	},
+	{
+		version: 11,
+		name:    "rate limits of jobs",
+		up: `
+ALTER TABLE scrape_jobs ADD COLUMN rate_limits INTEGER NOT NULL DEFAULT 0;
+`,
+	},
+}
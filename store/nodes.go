@@ -0,0 +1,251 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The statuses a node can be in
+const (
+	NodeAlive   = "alive"
+	NodeStopped = "stopped"
+	NodeDead    = "dead"
+)
+
+const sqlRegisterNode = `
+INSERT INTO
+	nodes (
+		id,
+		version,
+		hostname,
+		workers,
+		started_at,
+		last_heartbeat,
+		status
+	)
+VALUES
+	($1, $2, $3, $4, now(), now(), 'alive')
+ON CONFLICT (id)
+	DO UPDATE SET
+		version = EXCLUDED.version,
+		hostname = EXCLUDED.hostname,
+		workers = EXCLUDED.workers,
+		rate = NULL,
+		last_error = NULL,
+		jobs_done = 0,
+		jobs_failed = 0,
+		started_at = EXCLUDED.started_at,
+		last_heartbeat = EXCLUDED.last_heartbeat,
+		status = EXCLUDED.status
+`
+
+const sqlHeartbeat = `
+UPDATE
+	nodes
+SET
+	workers = $2,
+	rate = $3,
+	last_error = $4,
+	jobs_done = $5,
+	jobs_failed = $6,
+	last_heartbeat = now(),
+	status = 'alive'
+WHERE
+	id = $1
+	AND
+	status = 'alive'
+`
+
+const sqlStopNode = `
+UPDATE
+	nodes
+SET
+	status = 'stopped',
+	last_heartbeat = now()
+WHERE
+	id = $1
+`
+
+const sqlMarkDeadNodes = `
+UPDATE
+	nodes
+SET
+	status = 'dead'
+WHERE
+	status = 'alive'
+	AND
+	last_heartbeat < now() - $1::double precision * interval '1 second'
+`
+
+const sqlReleaseDeadNodeJobs = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE WHEN attempts + 1 >= $1 THEN 'dead' ELSE COALESCE(` + sqlCampaignHold + `, 'retry') END,
+	attempts = attempts + 1,
+	last_error = 'node ' || claimed_by || ' stopped sending heartbeats',
+	claimed_by = NULL,
+	lease_until = NULL,
+	run_at = now()
+WHERE
+	status = 'running'
+	AND
+	claimed_by IN (SELECT id FROM nodes WHERE status = 'dead')
+`
+
+const sqlGetNodes = `
+SELECT
+	id,
+	version,
+	hostname,
+	workers,
+	rate,
+	last_error,
+	jobs_done,
+	jobs_failed,
+	started_at,
+	last_heartbeat,
+	status
+FROM
+	nodes
+ORDER BY
+	id ASC
+`
+
+// Node is a packtrack process working on the queue
+type Node struct {
+	ID            string
+	Version       string
+	Hostname      string
+	Workers       int
+	Rate          float64
+	LastError     string
+	JobsDone      int64
+	JobsFailed    int64
+	StartedAt     time.Time
+	LastHeartbeat time.Time
+	Status        string
+}
+
+// RegisterNode announces that this node has started. Only the Version,
+// Hostname and Workers fields of n are used.
+func (s *Store) RegisterNode(ctx context.Context, n *Node) error {
+	_, err := s.db.ExecContext(ctx, sqlRegisterNode, s.id, n.Version, n.Hostname, n.Workers)
+	return err
+}
+
+// Heartbeat tells the others this node is still alive, and how it is doing.
+// It returns ErrNodeDead if the others have given up on us.
+func (s *Store) Heartbeat(ctx context.Context, n *Node) error {
+	lastError := sql.NullString{String: n.LastError, Valid: n.LastError != ""}
+	res, err := s.db.ExecContext(ctx, sqlHeartbeat, s.id, n.Workers, n.Rate, lastError, n.JobsDone, n.JobsFailed)
+	if err != nil {
+		return err
+	}
+	return heartbeatResult(res)
+}
+
+// heartbeatResult tells if a heartbeat found the node still alive
+func heartbeatResult(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNodeDead
+	}
+	return nil
+}
+
+// StopNode marks this node as stopped, for when it shuts down cleanly
+func (s *Store) StopNode(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, sqlStopNode, s.id)
+	return err
+}
+
+// ReapDeadNodes marks nodes that haven't sent a heartbeat within timeout as
+// dead, and returns the jobs they had claimed to the queue. It returns the
+// number of nodes and jobs affected.
+func (s *Store) ReapDeadNodes(ctx context.Context, timeout time.Duration) (int64, int64, error) {
+	maxAttempts := s.retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, sqlMarkDeadNodes, timeout.Seconds())
+	if err != nil {
+		return 0, 0, err
+	}
+	nodes, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err = tx.ExecContext(ctx, sqlReleaseDeadNodeJobs, maxAttempts)
+	if err != nil {
+		return 0, 0, err
+	}
+	jobs, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return nodes, jobs, nil
+}
+
+// Nodes returns all the nodes that have ever registered
+func (s *Store) Nodes(ctx context.Context) ([]Node, error) {
+	rows, err := s.db.QueryContext(ctx, sqlGetNodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make([]Node, 0)
+	for rows.Next() {
+		var n Node
+		var rate sql.NullFloat64
+		var lastError sql.NullString
+
+		if err := rows.Scan(&n.ID, &n.Version, &n.Hostname, &n.Workers, &rate, &lastError,
+			&n.JobsDone, &n.JobsFailed, &n.StartedAt, &n.LastHeartbeat, &n.Status); err != nil {
+			return nil, err
+		}
+		n.Rate = rate.Float64
+		n.LastError = lastError.String
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const sqlGetJobCounts = `
+SELECT
+	t.name,
+	sj.status,
+	count(*)
+FROM
+	scrape_jobs sj
+	INNER JOIN trackers t ON t.id = sj.tracker
+GROUP BY
+	1, 2
+ORDER BY
+	1, 2
+`
+
+// A zero or empty filter value matches everything, and LIMIT NULL is no
+// limit at all.
+const sqlGetJobs = `
+SELECT
+	sj.id,
+	t.name,
+	sj.args,
+	sj.status,
+	sj.attempts,
+	sj.priority,
+	sj.last_error,
+	sj.created_at,
+	sj.start_time,
+	sj.end_time,
+	sj.run_at,
+	sj.claimed_by,
+	sj.stats,
+	sj.outcome,
+	sj.follow_of
+FROM
+	scrape_jobs sj
+	INNER JOIN trackers t ON t.id = sj.tracker
+WHERE
+	($1 = 0 OR sj.tracker = $1)
+	AND
+	($2 = '' OR sj.status = $2)
+	AND
+	sj.id > $3
+	AND
+	($5 = 0 OR sj.campaign_id = $5)
+	AND
+	($6 = '' OR sj.outcome = $6)
+ORDER BY
+	sj.id ASC
+LIMIT
+	NULLIF($4, 0)
+`
+
+// The same as sqlGetJobs, with the response.
+const sqlExportJobs = `
+SELECT
+	sj.id,
+	t.name,
+	sj.args,
+	sj.status,
+	sj.attempts,
+	sj.priority,
+	sj.last_error,
+	sj.created_at,
+	sj.start_time,
+	sj.end_time,
+	sj.run_at,
+	sj.claimed_by,
+	sj.stats,
+	sj.outcome,
+	sj.follow_of,
+	sj.resp
+FROM
+	scrape_jobs sj
+	INNER JOIN trackers t ON t.id = sj.tracker
+WHERE
+	($1 = 0 OR sj.tracker = $1)
+	AND
+	($2 = '' OR sj.status = $2)
+	AND
+	sj.id > $3
+	AND
+	($5 = 0 OR sj.campaign_id = $5)
+	AND
+	($6 = '' OR sj.outcome = $6)
+ORDER BY
+	sj.id ASC
+LIMIT
+	NULLIF($4, 0)
+`
+
+// JobCount is the number of jobs a tracker has in a status
+type JobCount struct {
+	Tracker string
+	Status  string
+	N       int64
+}
+
+// JobFilter selects jobs. Zero values match all jobs.
+type JobFilter struct {
+	Tracker  int
+	Status   string
+	Campaign int64
+	// Outcome is a trackers.Outcome as a string, like "found"
+	Outcome string
+	AfterID int64
+	Limit   int
+}
+
+// JobInfo is what we know about a job. Times that haven't happened yet are
+// zero.
+type JobInfo struct {
+	ID        int64
+	Tracker   string
+	Args      []byte
+	Status    string
+	Attempts  int
+	Priority  int
+	LastError string
+	CreatedAt time.Time
+	StartTime time.Time
+	EndTime   time.Time
+	RunAt     time.Time
+	ClaimedBy string
+	Stats     []byte
+	// Outcome is what the tracker said about the job, once it has been
+	// performed successfully.
+	Outcome string
+	// FollowOf is the job this job is a follow-up of, or 0 if it isn't
+	// one.
+	FollowOf int64
+
+	// Resp is only filled in by ExportJobs
+	Resp []byte
+}
+
+// JobCounts returns how many jobs each tracker has in each status
+func (s *Store) JobCounts(ctx context.Context) ([]JobCount, error) {
+	rows, err := s.db.QueryContext(ctx, sqlGetJobCounts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]JobCount, 0)
+	for rows.Next() {
+		var c JobCount
+		if err := rows.Scan(&c.Tracker, &c.Status, &c.N); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Jobs returns the jobs matching the filter, without their responses
+func (s *Store) Jobs(ctx context.Context, f JobFilter) ([]JobInfo, error) {
+	jobs := make([]JobInfo, 0)
+	err := s.queryJobs(ctx, sqlGetJobs, f, false, func(j *JobInfo) error {
+		jobs = append(jobs, *j)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ExportJobs calls fn for every job matching the filter, with the response
+// filled in. The jobs are streamed, so it works for any number of jobs.
+func (s *Store) ExportJobs(ctx context.Context, f JobFilter, fn func(*JobInfo) error) error {
+	return s.queryJobs(ctx, sqlExportJobs, f, true, fn)
+}
+
+func (s *Store) queryJobs(ctx context.Context, query string, f JobFilter, withResp bool, fn func(*JobInfo) error) error {
+	rows, err := s.db.QueryContext(ctx, query, f.Tracker, f.Status, f.AfterID, f.Limit, f.Campaign, f.Outcome)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var j JobInfo
+		var lastError, claimedBy, outcome sql.NullString
+		var startTime, endTime sql.NullTime
+		var followOf sql.NullInt64
+
+		dest := []interface{}{&j.ID, &j.Tracker, &j.Args, &j.Status, &j.Attempts, &j.Priority, &lastError,
+			&j.CreatedAt, &startTime, &endTime, &j.RunAt, &claimedBy, &j.Stats, &outcome, &followOf}
+		if withResp {
+			dest = append(dest, &j.Resp)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		j.LastError = lastError.String
+		j.ClaimedBy = claimedBy.String
+		j.Outcome = outcome.String
+		j.FollowOf = followOf.Int64
+		j.StartTime = startTime.Time
+		j.EndTime = endTime.Time
+
+		if err := fn(&j); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
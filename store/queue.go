@@ -0,0 +1,345 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// JobQueue is the queue of scrape jobs. Store keeps it in Postgres, SQLite
+// in a SQLite database and Memory in memory, and they must all behave the
+// same. The package storetest checks that they do.
+type JobQueue interface {
+	// Trackers returns the trackers jobs can be created for
+	Trackers(ctx context.Context) ([]Tracker, error)
+
+	// InsertJob creates a single job, unless its key is already queued
+	InsertJob(ctx context.Context, tracker int, args []byte, createdAt time.Time) error
+
+	// InsertJobs creates all the jobs or none of them. Jobs whose key is
+	// already queued are handled according to mode.
+	InsertJobs(ctx context.Context, mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time) (InsertResult, error)
+
+	// ClaimJob leases the job of the queue with the highest priority that
+	// is ready to run, the oldest first, skipping jobs claimed by others. It
+	// returns sql.ErrNoRows when there is nothing to claim.
+	ClaimJob(ctx context.Context, q Queue) (*Job, error)
+
+	// FinishJob records the result of performing a claimed job, and
+	// returns the error the job failed with. ErrLeaseLost is returned if
+	// we no longer hold the lease.
+	FinishJob(ctx context.Context, job *Job, res *trackers.Result, err error) error
+
+	// ReleaseJob gives a claimed job back without it counting as an
+	// attempt. ErrLeaseLost is returned if we no longer hold the lease.
+	ReleaseJob(ctx context.Context, job *Job) error
+
+	// ReapLeases returns jobs with expired leases to the queue, counting
+	// it as a failed attempt. It returns how many jobs were returned.
+	ReapLeases(ctx context.Context) (int64, error)
+
+	// JobCounts returns how many jobs each tracker has in each status,
+	// ordered by tracker and status.
+	JobCounts(ctx context.Context) ([]JobCount, error)
+
+	// Jobs returns the jobs matching the filter, ordered by id, without
+	// their responses.
+	Jobs(ctx context.Context, f JobFilter) ([]JobInfo, error)
+
+	// ExportJobs calls fn for every job matching the filter, ordered by
+	// id, with the response filled in. fn may use the queue.
+	ExportJobs(ctx context.Context, f JobFilter, fn func(*JobInfo) error) error
+
+	// CreateCampaign creates the campaign c describes, and fills in the
+	// rest of it.
+	CreateCampaign(ctx context.Context, c *Campaign) error
+
+	// Campaign returns the campaign with the given name, or sql.ErrNoRows
+	// if there is none.
+	Campaign(ctx context.Context, name string) (*Campaign, error)
+
+	// Campaigns returns all the campaigns, ordered by id
+	Campaigns(ctx context.Context) ([]Campaign, error)
+
+	// InsertCampaignJobs inserts jobs for the tracker of the campaign like
+	// InsertJobs, and records in the same transaction that enqueueing has
+	// come to next. The campaign must be active, and ErrCampaignChanged is
+	// returned if c is out of date. c is updated to match.
+	InsertCampaignJobs(ctx context.Context, c *Campaign, mode InsertMode, args [][]byte, createdAt []time.Time, next int64) (InsertResult, error)
+
+	// FinishCampaign records that every id of a campaign with a Source
+	// has been enqueued, which a range campaign does by itself when it
+	// reaches the end of the range. The campaign must be active, and
+	// ErrCampaignChanged is returned if c is out of date.
+	FinishCampaign(ctx context.Context, c *Campaign) error
+
+	// SetCampaignStatus pauses, resumes or cancels the campaign. Its
+	// waiting jobs are paused, resumed or cancelled along with it, while
+	// running jobs are left to finish. It returns how many jobs were
+	// affected, and ErrCampaignCancelled if the campaign was cancelled
+	// already.
+	SetCampaignStatus(ctx context.Context, c *Campaign, status string) (int64, error)
+
+	// SetCampaignSchedule changes the weight and priority of the campaign.
+	// The priority is given to its waiting and paused jobs too, and the
+	// number of those is returned. ErrCampaignCancelled is returned if the
+	// campaign has been cancelled.
+	SetCampaignSchedule(ctx context.Context, c *Campaign, weight, priority int) (int64, error)
+
+	// CampaignProgress returns how far the jobs of the campaign have come
+	CampaignProgress(ctx context.Context, c *Campaign) (*CampaignProgress, error)
+
+	// CreateExploration records how the range of a campaign is to be
+	// explored, and fills in the rest of e.
+	CreateExploration(ctx context.Context, e *Exploration) error
+
+	// Exploration returns the exploration of the campaign with the given
+	// id, or sql.ErrNoRows if the campaign isn't being explored.
+	Exploration(ctx context.Context, campaign int64) (*Exploration, error)
+
+	// ExploreBlocks returns the blocks of the exploration, ordered by
+	// start.
+	ExploreBlocks(ctx context.Context, e *Exploration) ([]ExploreBlock, error)
+
+	// SaveExploreBlocks creates or updates the given blocks of the
+	// exploration, all of them or none.
+	SaveExploreBlocks(ctx context.Context, e *Exploration, blocks []ExploreBlock) error
+
+	// AddExploreSamples records the given samples of the exploration,
+	// skipping those recorded already.
+	AddExploreSamples(ctx context.Context, e *Exploration, samples []ExploreSample) error
+
+	// ExploreStats sums up the samples of the blocks of the exploration
+	// that are being sampled, ordered by start. Only the jobs of the
+	// campaign count, and blocks without any are left out.
+	ExploreStats(ctx context.Context, e *Exploration) ([]BlockStats, error)
+
+	// StartFollows starts following every job of the tracker that has
+	// found something and isn't a follow-up, unless it is followed
+	// already. It returns how many were started.
+	StartFollows(ctx context.Context, tracker int) (int64, error)
+
+	// WaitingFollows returns up to limit follows of the tracker that are
+	// waiting on a job that is done with, ordered by JobID, with the job
+	// in Last.
+	WaitingFollows(ctx context.Context, tracker int, limit int) ([]Follow, error)
+
+	// SaveFollows saves the state, status and next time of the given
+	// follows, all of them or none. A follow that has moved on to
+	// another job since it was read is left alone.
+	SaveFollows(ctx context.Context, follows []Follow) error
+
+	// FollowUp enqueues a follow-up job with the given priority for up
+	// to limit follows of the tracker that are scheduled by now, and
+	// makes them wait for it. It returns how many were enqueued.
+	FollowUp(ctx context.Context, tracker int, now time.Time, priority int, limit int) (int64, error)
+
+	// SaveConsignments saves the consignments the job with the given id
+	// found, in place of any saved for it before.
+	SaveConsignments(ctx context.Context, job int64, consignments []trackers.Consignment) error
+
+	// Consignments returns the consignments saved for the job with the
+	// given id, in the order they were saved.
+	Consignments(ctx context.Context, job int64) ([]trackers.Consignment, error)
+
+	Close() error
+}
+
+// NodeRegistry keeps track of the nodes working on the queue
+type NodeRegistry interface {
+	// RegisterNode announces that this node has started
+	RegisterNode(ctx context.Context, n *Node) error
+
+	// Heartbeat tells the others this node is still alive. It returns
+	// ErrNodeDead if the node has been marked dead since, as its jobs have
+	// been given to others then.
+	Heartbeat(ctx context.Context, n *Node) error
+
+	// StopNode marks this node as stopped
+	StopNode(ctx context.Context) error
+
+	// ReapDeadNodes marks nodes without a heartbeat within timeout as
+	// dead, and returns their jobs to the queue. It returns the number of
+	// nodes and jobs affected.
+	ReapDeadNodes(ctx context.Context, timeout time.Duration) (int64, int64, error)
+
+	// Nodes returns all the nodes that have ever registered
+	Nodes(ctx context.Context) ([]Node, error)
+}
+
+// Backend is a queue along with the nodes working on it, which is what
+// packtrack needs from a database.
+type Backend interface {
+	JobQueue
+	NodeRegistry
+}
+
+var (
+	_ Backend  = (*Store)(nil)
+	_ Backend  = (*SQLite)(nil)
+	_ JobQueue = (*Memory)(nil)
+)
+
+// Open opens the backend the connection string of cfg is for. Connection
+// strings starting with sqlite:// are followed by the path to a SQLite
+// database, anything else is for Postgres.
+func Open(cfg Config) (Backend, error) {
+	if path, ok := sqlitePath(cfg.ConnString); ok {
+		return NewSQLite(path, cfg)
+	}
+	return New(cfg)
+}
+
+// NoCampaign is the campaign of a Queue of the jobs that aren't part of any
+// campaign.
+const NoCampaign int64 = -1
+
+// Queue is a part of the queue that jobs can be claimed from
+type Queue struct {
+	Tracker int
+
+	// Campaign limits the queue to the jobs of the campaign with this id,
+	// or to the jobs outside any campaign if it is NoCampaign. Zero is all
+	// the jobs of the tracker.
+	Campaign int64
+}
+
+// InsertMode decides what happens when inserting a job whose key is
+// already queued for the tracker.
+type InsertMode int
+
+const (
+	// InsertSkip leaves the existing job alone
+	InsertSkip InsertMode = iota
+	// InsertUpdate gives the existing job the new args and queues it to be
+	// performed again, unless it is running.
+	InsertUpdate
+)
+
+// InsertResult tells what became of the jobs given to InsertJobs
+type InsertResult struct {
+	// New is the number of jobs that weren't queued before
+	New int64
+	// Existing is the number of jobs that were, including any that were
+	// given more than once.
+	Existing int64
+	// Updated is how many of the existing jobs were queued again
+	Updated int64
+}
+
+// uniqueKey is what makes a job unique
+type uniqueKey struct {
+	tracker int
+	key     string
+}
+
+// jobKeys asks the trackers for the keys of the given jobs
+func jobKeys(ts []Tracker, tracker []int, args [][]byte) ([]string, error) {
+	names := make(map[int]string, len(ts))
+	for _, t := range ts {
+		names[t.ID] = t.Name
+	}
+
+	keys := make([]string, len(args))
+	for i := range args {
+		name, ok := names[tracker[i]]
+		if !ok {
+			return nil, fmt.Errorf("there is no tracker with id %d", tracker[i])
+		}
+		t, ok := trackers.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("tracker %q isn't known to this version of packtrack", name)
+		}
+		key, err := t.Key(args[i])
+		if err != nil {
+			return nil, fmt.Errorf("job %d: %s", i, err.Error())
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// finishing is what should be written for a job that is finished
+type finishing struct {
+	status    string
+	attempts  int
+	lastError sql.NullString
+	retryIn   time.Duration
+	stats     []byte
+	resp      []byte
+	outcome   string
+	// rateLimits is how many times in a row the job has been rate limited
+	rateLimits int
+
+	// err is the error the job failed with, if any
+	err error
+}
+
+// finish works out what to write for a job being finished by the node
+// nodeID, with res or err from performing it.
+func finish(nodeID string, retry RetryPolicy, job *Job, res *trackers.Result, err error) (*finishing, error) {
+	f := &finishing{
+		status:   StatusSuccess,
+		attempts: job.Attempts,
+	}
+	if res != nil {
+		f.resp = res.Body
+	}
+
+	if je := classify(res, err); je != nil {
+		f.err = je.err
+		if je.class == classRateLimit {
+			// Being rate limited is not the job's fault, so it doesn't count
+			// as an attempt. We back off on the times in a row it happened
+			// instead.
+			f.rateLimits = job.RateLimits + 1
+			f.retryIn = retry.delay(f.rateLimits, je)
+		} else {
+			f.attempts++
+			f.retryIn = retry.delay(f.attempts, je)
+		}
+		f.status = retry.status(f.attempts, je)
+		f.lastError = sql.NullString{String: je.Error(), Valid: true}
+		if f.status == StatusRetry {
+			log.Printf("Job %d failed on attempt %d, retrying in %s: %s\n", job.ID, f.attempts, f.retryIn, je.Error())
+		} else {
+			log.Printf("Job %d failed on attempt %d, marking it %s: %s\n", job.ID, f.attempts, f.status, je.Error())
+		}
+	}
+
+	// The resp column is jsonb, so we only keep what we can store there.
+	if !json.Valid(f.resp) {
+		f.resp = nil
+	}
+
+	stats := newPerformStats(nodeID, job.Attempts+1, res)
+	f.outcome = stats.Outcome
+	if f.stats, err = json.Marshal(stats); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rhermes/packtrack/ratelimit"
+)
+
+const sqlUpsertRateLimit = `
+INSERT INTO
+	rate_limits (
+		tracker,
+		rate,
+		burst,
+		tokens
+	)
+VALUES
+	($1, $2, $3, $3)
+ON CONFLICT (tracker)
+	DO UPDATE SET
+		rate = EXCLUDED.rate,
+		burst = EXCLUDED.burst
+`
+
+// The bucket is refilled lazily, based on the time since it was last
+// touched, so taking a token is a single statement that either succeeds
+// for exactly one caller or not at all.
+const sqlTakeToken = `
+UPDATE
+	rate_limits
+SET
+	tokens = LEAST(burst, tokens + EXTRACT(EPOCH FROM (now() - updated_at)) * rate) - 1,
+	updated_at = now()
+WHERE
+	tracker = $1
+	AND
+	(paused_until IS NULL OR paused_until <= now())
+	AND
+	LEAST(burst, tokens + EXTRACT(EPOCH FROM (now() - updated_at)) * rate) >= 1
+`
+
+const sqlTokenWait = `
+SELECT
+	GREATEST(
+		COALESCE(EXTRACT(EPOCH FROM (paused_until - now())), 0),
+		(1 - LEAST(burst, tokens + EXTRACT(EPOCH FROM (now() - updated_at)) * rate)) / rate
+	)
+FROM
+	rate_limits
+WHERE
+	tracker = $1
+`
+
+const sqlPauseRateLimit = `
+UPDATE
+	rate_limits
+SET
+	paused_until = GREATEST(paused_until, now() + $2::double precision * interval '1 second'),
+	tokens = 0,
+	updated_at = now()
+WHERE
+	tracker = $1
+`
+
+// maxTokenWait is the longest we sleep before asking the database again,
+// so we notice when someone changes the rate or lifts a pause.
+const maxTokenWait = 10 * time.Second
+
+// SharedLimiter is implemented by the backends that can share a rate limit
+// between nodes.
+type SharedLimiter interface {
+	RateLimiter(ctx context.Context, tracker int, rate, burst float64) (*RateLimiter, error)
+}
+
+// RateLimiter is a token bucket kept in the database, shared by every node
+// working on the same tracker. It implements ratelimit.Limiter and
+// ratelimit.Pauser.
+type RateLimiter struct {
+	s       *Store
+	tracker int
+}
+
+// RateLimiter returns the shared rate limiter for a tracker, allowing rate
+// requests per second for the whole fleet, with bursts of up to burst
+// requests. The rate and burst are written to the database, so the last
+// node to start decides them.
+func (s *Store) RateLimiter(ctx context.Context, tracker int, rate, burst float64) (*RateLimiter, error) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	_, err := s.db.ExecContext(ctx, sqlUpsertRateLimit, tracker, rate, burst)
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimiter{s: s, tracker: tracker}, nil
+}
+
+// Wait implements ratelimit.Limiter
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		res, err := l.s.db.ExecContext(ctx, sqlTakeToken, l.tracker)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			return nil
+		}
+
+		var secs float64
+		err = l.s.db.QueryRowContext(ctx, sqlTokenWait, l.tracker).Scan(&secs)
+		if err == sql.ErrNoRows {
+			return errors.New("no rate limit registered for the tracker")
+		} else if err != nil {
+			return err
+		}
+
+		wait := time.Duration(secs * float64(time.Second))
+		if wait > maxTokenWait {
+			wait = maxTokenWait
+		}
+		// The jitter keeps the nodes from all asking at the same time.
+		if err := ratelimit.Sleep(ctx, wait+jitter(wait/10)); err != nil {
+			return err
+		}
+	}
+}
+
+// Pause implements ratelimit.Pauser. It stops every node from making
+// requests to the tracker for d.
+func (l *RateLimiter) Pause(ctx context.Context, d time.Duration) error {
+	_, err := l.s.db.ExecContext(ctx, sqlPauseRateLimit, l.tracker, d.Seconds())
+	return err
+}
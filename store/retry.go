@@ -0,0 +1,170 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// Defaults for the RetryPolicy fields that are left as zero
+const (
+	DefaultMaxAttempts    = 5
+	DefaultBaseDelay      = 10 * time.Second
+	DefaultMaxDelay       = 6 * time.Hour
+	DefaultRateLimitDelay = 1 * time.Minute
+)
+
+// errorClass is the kind of error a job failed with. It decides if and when
+// the job is tried again.
+type errorClass int
+
+const (
+	classPermanent errorClass = iota
+	classNetwork
+	classServer
+	classRateLimit
+)
+
+// jobError is the error from a failed attempt at performing a job
+type jobError struct {
+	err        error
+	class      errorClass
+	retryAfter time.Duration
+}
+
+func (e *jobError) Error() string { return e.err.Error() }
+
+// classify turns what we got from performing a job into a *jobError, or nil
+// if the job was a success.
+func classify(res *trackers.Result, err error) *jobError {
+	if err != nil {
+		if _, ok := err.(*trackers.ArgsError); ok {
+			return &jobError{err: err, class: classPermanent}
+		}
+		return &jobError{err: err, class: classNetwork}
+	}
+
+	switch res.Outcome {
+	case trackers.OutcomeRateLimited:
+		return &jobError{err: ErrRateLimit, class: classRateLimit, retryAfter: res.RetryAfter}
+	case trackers.OutcomeError:
+		if res.StatusCode >= 500 {
+			return &jobError{err: res.Err, class: classServer}
+		}
+		return &jobError{err: res.Err, class: classPermanent}
+	}
+	return nil
+}
+
+// RetryPolicy decides how failed jobs are retried
+type RetryPolicy struct {
+	// MaxAttempts is how many failed attempts a job gets before it is dead
+	MaxAttempts int
+
+	// BaseDelay is how long we wait after the first failed attempt. The
+	// delay doubles for every attempt after that.
+	BaseDelay time.Duration
+
+	// MaxDelay is the longest we will ever wait between attempts
+	MaxDelay time.Duration
+
+	// RateLimitDelay is the base delay used when the tracker rate limits us.
+	// Being rate limited doesn't count as an attempt, so it never makes a
+	// job dead, but the delay doubles for every time in a row it happens,
+	// up to MaxDelay.
+	RateLimitDelay time.Duration
+}
+
+// status returns the status a job should get after failing with err
+func (p RetryPolicy) status(attempts int, err *jobError) string {
+	if err.class == classPermanent {
+		return StatusFailed
+	}
+
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	if attempts >= maxAttempts {
+		return StatusDead
+	}
+	return StatusRetry
+}
+
+// delay returns how long to wait before the job is tried again. It is
+// exponential in the number of attempts, or of rate limits in a row for
+// classRateLimit, with jitter so that jobs that
+// failed together don't all come back at the same time.
+func (p RetryPolicy) delay(attempts int, err *jobError) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = DefaultBaseDelay
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxDelay
+	}
+
+	switch err.class {
+	case classPermanent:
+		return 0
+	case classServer:
+		// The other side is having trouble, give them some room.
+		base *= 2
+	case classRateLimit:
+		base = p.RateLimitDelay
+		if base <= 0 {
+			base = DefaultRateLimitDelay
+		}
+	}
+
+	d := base
+	for i := 1; i < attempts && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	d = d/2 + jitter(d/2)
+	if d < err.retryAfter {
+		d = err.retryAfter
+	}
+	return d
+}
+
+var (
+	rndMu sync.Mutex
+	rnd   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration in [0, d]
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	rndMu.Lock()
+	defer rndMu.Unlock()
+	return time.Duration(rnd.Int63n(int64(d) + 1))
+}
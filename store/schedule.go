@@ -0,0 +1,221 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Scheduler claims jobs from a JobQueue for the trackers a node works, so
+// the node shares its time between the trackers, and between the campaigns
+// of each tracker, instead of draining the queues one after the other.
+//
+// The claims are shared between the trackers by their weights, using smooth
+// weighted round-robin, skipping the trackers that have nothing to claim or
+// aren't ready for more. Within a tracker, the campaigns with the highest
+// priority that have jobs waiting always go first. Between campaigns of the
+// same priority the claims are shared by their weights in the same way, and
+// the jobs outside any campaign are a queue of weight 1 and priority 0 of
+// their own.
+//
+// A Scheduler is not safe for concurrent use.
+type Scheduler struct {
+	q     JobQueue
+	every time.Duration
+
+	trackers  []*scheduledTracker
+	refreshed time.Time
+}
+
+// scheduledTracker is a tracker the scheduler claims for, with its queues
+type scheduledTracker struct {
+	id     int
+	weight int
+	queues []*scheduled
+
+	// current is the credit of the tracker in the round-robin
+	current int
+}
+
+// scheduled is a queue the scheduler claims from
+type scheduled struct {
+	Queue
+	weight   int
+	priority int
+
+	// current is the credit of the queue in the round-robin
+	current int
+	// empty is set when the queue had nothing to claim, and it is skipped
+	// until the next refresh.
+	empty bool
+}
+
+// NewScheduler returns a scheduler for the trackers with the given ids,
+// which get a share of the claims by the weight they map to. It looks for
+// changes to the campaigns every so often.
+func NewScheduler(q JobQueue, weights map[int]int, every time.Duration) *Scheduler {
+	s := &Scheduler{q: q, every: every}
+	for id, weight := range weights {
+		if weight < 1 {
+			weight = 1
+		}
+		s.trackers = append(s.trackers, &scheduledTracker{id: id, weight: weight})
+	}
+	// The order breaks ties in the round-robin, so it has to be the same
+	// every time.
+	sort.Slice(s.trackers, func(i, j int) bool { return s.trackers[i].id < s.trackers[j].id })
+	return s
+}
+
+// refresh reads the active campaigns of the trackers, keeping the credit of
+// the queues we had already.
+func (s *Scheduler) refresh(ctx context.Context) error {
+	campaigns, err := s.q.Campaigns(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range s.trackers {
+		old := make(map[int64]*scheduled, len(st.queues))
+		for _, sq := range st.queues {
+			old[sq.Campaign] = sq
+		}
+
+		queues := []*scheduled{{Queue: Queue{Tracker: st.id, Campaign: NoCampaign}, weight: 1}}
+		for _, c := range campaigns {
+			if c.TrackerID != st.id || c.Status != CampaignActive {
+				continue
+			}
+			queues = append(queues, &scheduled{
+				Queue:    Queue{Tracker: st.id, Campaign: c.ID},
+				weight:   c.weight(),
+				priority: c.Priority,
+			})
+		}
+		for _, sq := range queues {
+			if o := old[sq.Campaign]; o != nil {
+				sq.current = o.current
+			}
+		}
+		st.queues = queues
+	}
+
+	s.refreshed = time.Now()
+	return nil
+}
+
+// nextTracker picks the tracker to claim for among those that are ready,
+// or returns nil if none of them has anything to claim.
+func (s *Scheduler) nextTracker(ready func(tracker int) bool) *scheduledTracker {
+	var best *scheduledTracker
+	total := 0
+	for _, st := range s.trackers {
+		if st.idle() || (ready != nil && !ready(st.id)) {
+			continue
+		}
+		st.current += st.weight
+		total += st.weight
+		if best == nil || st.current > best.current {
+			best = st
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// next picks the queue of the tracker to claim from, or returns nil if they
+// are all empty.
+func (st *scheduledTracker) next() *scheduled {
+	var candidates []*scheduled
+	for _, sq := range st.queues {
+		switch {
+		case sq.empty:
+		case len(candidates) == 0 || sq.priority > candidates[0].priority:
+			candidates = append(candidates[:0], sq)
+		case sq.priority == candidates[0].priority:
+			candidates = append(candidates, sq)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var best *scheduled
+	total := 0
+	for _, sq := range candidates {
+		sq.current += sq.weight
+		total += sq.weight
+		if best == nil || sq.current > best.current {
+			best = sq
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// idle tells if every queue of the tracker was empty the last time we
+// looked.
+func (st *scheduledTracker) idle() bool {
+	for _, sq := range st.queues {
+		if !sq.empty {
+			return false
+		}
+	}
+	return true
+}
+
+// ClaimJob claims the next job of the trackers for which ready returns
+// true, or of all of them if ready is nil. It returns sql.ErrNoRows if none
+// of the queues of those trackers has anything to claim.
+func (s *Scheduler) ClaimJob(ctx context.Context, ready func(tracker int) bool) (*Job, error) {
+	if s.refreshed.IsZero() || time.Since(s.refreshed) >= s.every || s.idle() {
+		if err := s.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	for st := s.nextTracker(ready); st != nil; st = s.nextTracker(ready) {
+		for sq := st.next(); sq != nil; sq = st.next() {
+			job, err := s.q.ClaimJob(ctx, sq.Queue)
+			if err == sql.ErrNoRows {
+				sq.empty = true
+				continue
+			}
+			return job, err
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// idle tells if every queue of every tracker was empty the last time we
+// looked.
+func (s *Scheduler) idle() bool {
+	for _, st := range s.trackers {
+		if !st.idle() {
+			return false
+		}
+	}
+	return true
+}
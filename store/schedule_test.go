@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rhermes/packtrack/store"
+)
+
+// queues is a JobQueue with a number of jobs waiting in each queue, for
+// testing the scheduler without a second tracker in the database.
+type queues struct {
+	store.JobQueue
+	campaigns []store.Campaign
+	waiting   map[store.Queue]int
+}
+
+func (q *queues) Campaigns(ctx context.Context) ([]store.Campaign, error) {
+	return q.campaigns, nil
+}
+
+func (q *queues) ClaimJob(ctx context.Context, sq store.Queue) (*store.Job, error) {
+	if q.waiting[sq] == 0 {
+		return nil, sql.ErrNoRows
+	}
+	q.waiting[sq]--
+
+	// The id tells where the job came from: the tracker, and then the
+	// campaign or 0.
+	id := int64(sq.Tracker) * 100
+	if sq.Campaign != store.NoCampaign {
+		id += sq.Campaign
+	}
+	return &store.Job{ID: id}, nil
+}
+
+func TestSchedulerTrackers(t *testing.T) {
+	ctx := context.Background()
+	q := &queues{
+		campaigns: []store.Campaign{
+			{ID: 1, TrackerID: 1, Status: store.CampaignActive, Weight: 3},
+			{ID: 2, TrackerID: 2, Status: store.CampaignActive, Priority: 1},
+			{ID: 3, TrackerID: 3, Status: store.CampaignActive},
+		},
+		waiting: map[store.Queue]int{
+			{Tracker: 1, Campaign: 1}:                30,
+			{Tracker: 1, Campaign: store.NoCampaign}: 10,
+			{Tracker: 2, Campaign: 2}:                3,
+			{Tracker: 2, Campaign: store.NoCampaign}: 5,
+			{Tracker: 3, Campaign: 3}:                10,
+		},
+	}
+	// Tracker 3 isn't worked, so its jobs are never claimed.
+	s := store.NewScheduler(q, map[int]int{1: 2, 2: 1}, time.Hour)
+
+	claim := func(n int, ready func(int) bool) []int64 {
+		t.Helper()
+		var got []int64
+		for i := 0; i < n; i++ {
+			job, err := s.ClaimJob(ctx, ready)
+			if err != nil {
+				t.Fatalf("ClaimJob: %s", err)
+			}
+			got = append(got, job.ID)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name  string
+		n     int
+		ready func(int) bool
+		want  []int64
+	}{
+		{
+			// Tracker 1 gets twice the claims of tracker 2, and shares
+			// them 3 to 1 between its campaign and the rest. Tracker 2
+			// claims from its campaign of higher priority first.
+			name: "by weight",
+			n:    9,
+			want: []int64{101, 202, 100, 101, 202, 101, 101, 202, 100},
+		},
+		{
+			// A tracker that isn't ready is skipped, without it losing
+			// its share once it is ready again.
+			name:  "not ready",
+			n:     3,
+			ready: func(tracker int) bool { return tracker != 1 },
+			want:  []int64{200, 200, 200},
+		},
+		{
+			name: "ready again",
+			n:    3,
+			want: []int64{101, 200, 101},
+		},
+		{
+			// Once tracker 2 has nothing left, tracker 1 gets it all.
+			name: "drained",
+			n:    9,
+			want: []int64{101, 200, 100, 101, 101, 101, 100, 101, 101},
+		},
+	}
+	for _, tt := range tests {
+		if got := claim(tt.n, tt.ready); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: claimed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
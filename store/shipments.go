@@ -0,0 +1,332 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// A job's consignments are replaced by deleting what hangs off them first,
+// as the foreign keys don't cascade.
+var sqlDeleteConsignments = []string{`
+DELETE FROM
+	events
+WHERE
+	package_id IN (
+		SELECT p.id FROM packages p INNER JOIN consignments c ON c.id = p.consignment_id WHERE c.job_id = $1
+	)
+`, `
+DELETE FROM
+	packages
+WHERE
+	consignment_id IN (SELECT c.id FROM consignments c WHERE c.job_id = $1)
+`, `
+DELETE FROM
+	consignments
+WHERE
+	job_id = $1
+`}
+
+const sqlInsertConsignment = `
+INSERT INTO
+	consignments (job_id, number, previous_number, sender_name, sender_reference, sender_country_code,
+		recipient_country_code, total_weight_kg, total_volume_dm3)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING
+	id
+`
+
+const sqlInsertPackage = `
+INSERT INTO
+	packages (consignment_id, number, previous_number, product_name, product_code, brand, status_description,
+		sender_name, recipient_postal_code, recipient_city, recipient_country, weight_kg, volume_dm3,
+		length_cm, width_cm, height_cm)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+RETURNING
+	id
+`
+
+const sqlInsertEvent = `
+INSERT INTO
+	events (package_id, occurred_at, status, description, unit_id, unit_type, postal_code, city,
+		country_code, country)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+const sqlGetConsignments = `
+SELECT
+	c.id,
+	c.number,
+	c.previous_number,
+	c.sender_name,
+	c.sender_reference,
+	c.sender_country_code,
+	c.recipient_country_code,
+	c.total_weight_kg,
+	c.total_volume_dm3
+FROM
+	consignments c
+WHERE
+	c.job_id = $1
+ORDER BY
+	c.id ASC
+`
+
+const sqlGetPackages = `
+SELECT
+	p.id,
+	p.consignment_id,
+	p.number,
+	p.previous_number,
+	p.product_name,
+	p.product_code,
+	p.brand,
+	p.status_description,
+	p.sender_name,
+	p.recipient_postal_code,
+	p.recipient_city,
+	p.recipient_country,
+	p.weight_kg,
+	p.volume_dm3,
+	p.length_cm,
+	p.width_cm,
+	p.height_cm
+FROM
+	packages p
+	INNER JOIN consignments c ON c.id = p.consignment_id
+WHERE
+	c.job_id = $1
+ORDER BY
+	p.id ASC
+`
+
+const sqlGetEvents = `
+SELECT
+	e.package_id,
+	e.occurred_at,
+	e.status,
+	e.description,
+	e.unit_id,
+	e.unit_type,
+	e.postal_code,
+	e.city,
+	e.country_code,
+	e.country
+FROM
+	events e
+	INNER JOIN packages p ON p.id = e.package_id
+	INNER JOIN consignments c ON c.id = p.consignment_id
+WHERE
+	c.job_id = $1
+ORDER BY
+	e.id ASC
+`
+
+// shipments puts the consignments of a job back together from their rows,
+// which must come parents first.
+type shipments struct {
+	consignments []trackers.Consignment
+	// byConsignment and byPackage map row ids to where they are
+	byConsignment map[int64]int
+	byPackage     map[int64][2]int
+}
+
+func newShipments() *shipments {
+	return &shipments{
+		consignments:  make([]trackers.Consignment, 0),
+		byConsignment: make(map[int64]int),
+		byPackage:     make(map[int64][2]int),
+	}
+}
+
+func (sh *shipments) addConsignment(id int64, c trackers.Consignment) {
+	c.Packages = make([]trackers.Package, 0)
+	sh.byConsignment[id] = len(sh.consignments)
+	sh.consignments = append(sh.consignments, c)
+}
+
+func (sh *shipments) addPackage(id int64, consignment int64, p trackers.Package) error {
+	ci, ok := sh.byConsignment[consignment]
+	if !ok {
+		return fmt.Errorf("package %d belongs to unknown consignment %d", id, consignment)
+	}
+	p.Events = make([]trackers.Event, 0)
+	c := &sh.consignments[ci]
+	sh.byPackage[id] = [2]int{ci, len(c.Packages)}
+	c.Packages = append(c.Packages, p)
+	return nil
+}
+
+func (sh *shipments) addEvent(pkg int64, e trackers.Event) error {
+	at, ok := sh.byPackage[pkg]
+	if !ok {
+		return fmt.Errorf("event belongs to unknown package %d", pkg)
+	}
+	p := &sh.consignments[at[0]].Packages[at[1]]
+	p.Events = append(p.Events, e)
+	return nil
+}
+
+// copyConsignments copies cs all the way down, so it can be kept while the
+// caller changes its own.
+func copyConsignments(cs []trackers.Consignment) []trackers.Consignment {
+	out := make([]trackers.Consignment, len(cs))
+	for i, c := range cs {
+		ps := make([]trackers.Package, len(c.Packages))
+		for j, p := range c.Packages {
+			p.Events = append(make([]trackers.Event, 0, len(p.Events)), p.Events...)
+			ps[j] = p
+		}
+		c.Packages = ps
+		out[i] = c
+	}
+	return out
+}
+
+// SaveConsignments saves what the job found, in place of anything saved for
+// it before.
+func (s *Store) SaveConsignments(ctx context.Context, job int64, consignments []trackers.Consignment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range sqlDeleteConsignments {
+		if _, err := tx.ExecContext(ctx, q, job); err != nil {
+			return err
+		}
+	}
+
+	insConsignment, err := tx.PrepareContext(ctx, sqlInsertConsignment)
+	if err != nil {
+		return err
+	}
+	defer insConsignment.Close()
+	insPackage, err := tx.PrepareContext(ctx, sqlInsertPackage)
+	if err != nil {
+		return err
+	}
+	defer insPackage.Close()
+	insEvent, err := tx.PrepareContext(ctx, sqlInsertEvent)
+	if err != nil {
+		return err
+	}
+	defer insEvent.Close()
+
+	for _, c := range consignments {
+		var cid int64
+		if err := insConsignment.QueryRowContext(ctx, job, c.ID, c.PreviousID, c.SenderName, c.SenderReference,
+			c.SenderCountryCode, c.RecipientCountryCode, c.TotalWeightKg, c.TotalVolumeDm3).Scan(&cid); err != nil {
+			return err
+		}
+		for _, p := range c.Packages {
+			var pid int64
+			if err := insPackage.QueryRowContext(ctx, cid, p.Number, p.PreviousNumber, p.ProductName, p.ProductCode,
+				p.Brand, p.StatusDescription, p.SenderName, p.RecipientPostalCode, p.RecipientCity,
+				p.RecipientCountry, p.WeightKg, p.VolumeDm3, p.LengthCm, p.WidthCm, p.HeightCm).Scan(&pid); err != nil {
+				return err
+			}
+			for _, e := range p.Events {
+				if _, err := insEvent.ExecContext(ctx, pid, nullTime(e.Time), e.Status, e.Description, e.UnitID,
+					e.UnitType, e.PostalCode, e.City, e.CountryCode, e.Country); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Consignments returns what was saved for the job, in the order it was saved
+func (s *Store) Consignments(ctx context.Context, job int64) ([]trackers.Consignment, error) {
+	sh := newShipments()
+
+	rows, err := s.db.QueryContext(ctx, sqlGetConsignments, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var c trackers.Consignment
+		if err := rows.Scan(&id, &c.ID, &c.PreviousID, &c.SenderName, &c.SenderReference, &c.SenderCountryCode,
+			&c.RecipientCountryCode, &c.TotalWeightKg, &c.TotalVolumeDm3); err != nil {
+			return nil, err
+		}
+		sh.addConsignment(id, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, sqlGetPackages, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, cid int64
+		var p trackers.Package
+		if err := rows.Scan(&id, &cid, &p.Number, &p.PreviousNumber, &p.ProductName, &p.ProductCode, &p.Brand,
+			&p.StatusDescription, &p.SenderName, &p.RecipientPostalCode, &p.RecipientCity, &p.RecipientCountry,
+			&p.WeightKg, &p.VolumeDm3, &p.LengthCm, &p.WidthCm, &p.HeightCm); err != nil {
+			return nil, err
+		}
+		if err := sh.addPackage(id, cid, p); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, sqlGetEvents, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int64
+		var at sql.NullTime
+		var e trackers.Event
+		if err := rows.Scan(&pid, &at, &e.Status, &e.Description, &e.UnitID, &e.UnitType, &e.PostalCode, &e.City,
+			&e.CountryCode, &e.Country); err != nil {
+			return nil, err
+		}
+		e.Time = at.Time
+		if err := sh.addEvent(pid, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sh.consignments, nil
+}
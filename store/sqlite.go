@@ -0,0 +1,2015 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// sqliteScheme starts the connection strings of SQLite databases
+const sqliteScheme = "sqlite://"
+
+// sqliteParams make the driver wait for other processes using the database,
+// and take the write lock when a transaction starts, so two claims can't
+// pick the same job.
+const sqliteParams = "?_busy_timeout=10000&_journal_mode=WAL&_foreign_keys=1&_txlock=immediate"
+
+// sqlitePath returns the path of the database if connString is for SQLite
+func sqlitePath(connString string) (string, bool) {
+	if !strings.HasPrefix(connString, sqliteScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(connString, sqliteScheme), true
+}
+
+const sqliteGetTrackers = `SELECT id, name, description, url FROM trackers ORDER BY id`
+
+const sqliteCreateScrapeJob = `
+INSERT INTO
+	scrape_jobs (
+		tracker,
+		job_key,
+		args,
+		created_at,
+		run_at,
+		campaign_id,
+		priority
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (tracker, job_key) WHERE follow_of IS NULL
+	DO NOTHING
+`
+
+const sqliteUpdateScrapeJob = `
+UPDATE
+	scrape_jobs
+SET
+	args = ?1,
+	status = 'created',
+	attempts = 0,
+	rate_limits = 0,
+	last_error = NULL,
+	outcome = NULL,
+	start_time = NULL,
+	end_time = NULL,
+	stats = '{}',
+	resp = NULL,
+	run_at = ?2,
+	campaign_id = COALESCE(?3, campaign_id),
+	priority = CASE WHEN ?3 IS NULL THEN priority ELSE ?4 END
+WHERE
+	tracker = ?5
+	AND
+	job_key = ?6
+	AND
+	follow_of IS NULL
+	AND
+	status <> 'running'
+`
+
+// sqliteFindJobFormat finds a job of the tracker to claim, from the jobs
+// matching the extra condition put in the %s.
+const sqliteFindJobFormat = `
+SELECT
+	sj.id,
+	t.name,
+	sj.args,
+	sj.attempts,
+	sj.rate_limits
+FROM
+	scrape_jobs sj
+	INNER JOIN trackers t ON t.id = sj.tracker
+WHERE
+	sj.status IN ('created', 'retry')
+	AND
+	sj.run_at <= ?
+	AND
+	sj.tracker = ?
+	%s
+ORDER BY
+	sj.priority DESC,
+	sj.id ASC
+LIMIT 1
+`
+
+var (
+	sqliteFindJob           = fmt.Sprintf(sqliteFindJobFormat, "")
+	sqliteFindCampaignJob   = fmt.Sprintf(sqliteFindJobFormat, "AND sj.campaign_id = ?")
+	sqliteFindNoCampaignJob = fmt.Sprintf(sqliteFindJobFormat, "AND sj.campaign_id IS NULL")
+)
+
+const sqliteClaimJob = `
+UPDATE
+	scrape_jobs
+SET
+	status = 'running',
+	claimed_by = ?,
+	lease_until = ?,
+	start_time = ?,
+	end_time = NULL
+WHERE
+	id = ?
+`
+
+// The status is given twice, to be held back by the campaign if it is a retry.
+const sqliteFinishJob = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE ? WHEN 'retry' THEN COALESCE(` + sqlCampaignHold + `, 'retry') ELSE ? END,
+	end_time = ?,
+	stats = ?,
+	resp = ?,
+	attempts = ?,
+	last_error = ?,
+	run_at = ?,
+	outcome = ?,
+	rate_limits = ?,
+	claimed_by = NULL,
+	lease_until = NULL
+WHERE
+	id = ?
+	AND
+	claimed_by = ?
+	AND
+	status = 'running'
+`
+
+const sqliteReleaseJob = `
+UPDATE
+	scrape_jobs
+SET
+	status = COALESCE(` + sqlCampaignHold + `, CASE WHEN attempts = 0 THEN 'created' ELSE 'retry' END),
+	start_time = NULL,
+	claimed_by = NULL,
+	lease_until = NULL,
+	run_at = ?
+WHERE
+	id = ?
+	AND
+	claimed_by = ?
+	AND
+	status = 'running'
+`
+
+const sqliteReapLeases = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE WHEN attempts + 1 >= ? THEN 'dead' ELSE COALESCE(` + sqlCampaignHold + `, 'retry') END,
+	attempts = attempts + 1,
+	last_error = 'lease held by ' || claimed_by || ' expired',
+	claimed_by = NULL,
+	lease_until = NULL,
+	run_at = ?
+WHERE
+	status = 'running'
+	AND
+	lease_until < ?
+`
+
+const sqliteGetJobCounts = `
+SELECT
+	t.name,
+	sj.status,
+	count(*)
+FROM
+	scrape_jobs sj
+	INNER JOIN trackers t ON t.id = sj.tracker
+GROUP BY
+	1, 2
+ORDER BY
+	1, 2
+`
+
+// A negative limit is no limit at all in SQLite.
+const sqliteGetJobs = `
+SELECT
+	sj.id,
+	t.name,
+	sj.args,
+	sj.status,
+	sj.attempts,
+	sj.priority,
+	sj.last_error,
+	sj.created_at,
+	sj.start_time,
+	sj.end_time,
+	sj.run_at,
+	sj.claimed_by,
+	sj.stats,
+	sj.outcome,
+	sj.follow_of,
+	sj.resp
+FROM
+	scrape_jobs sj
+	INNER JOIN trackers t ON t.id = sj.tracker
+WHERE
+	(?1 = 0 OR sj.tracker = ?1)
+	AND
+	(?2 = '' OR sj.status = ?2)
+	AND
+	sj.id > ?3
+	AND
+	(?5 = 0 OR sj.campaign_id = ?5)
+	AND
+	(?6 = '' OR sj.outcome = ?6)
+ORDER BY
+	sj.id ASC
+LIMIT
+	CASE WHEN ?4 = 0 THEN -1 ELSE ?4 END
+`
+
+const sqliteRegisterNode = `
+INSERT INTO
+	nodes (
+		id,
+		version,
+		hostname,
+		workers,
+		started_at,
+		last_heartbeat,
+		status
+	)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?5, 'alive')
+ON CONFLICT (id)
+	DO UPDATE SET
+		version = excluded.version,
+		hostname = excluded.hostname,
+		workers = excluded.workers,
+		rate = NULL,
+		last_error = NULL,
+		jobs_done = 0,
+		jobs_failed = 0,
+		started_at = excluded.started_at,
+		last_heartbeat = excluded.last_heartbeat,
+		status = excluded.status
+`
+
+const sqliteHeartbeat = `
+UPDATE
+	nodes
+SET
+	workers = ?,
+	rate = ?,
+	last_error = ?,
+	jobs_done = ?,
+	jobs_failed = ?,
+	last_heartbeat = ?,
+	status = 'alive'
+WHERE
+	id = ?
+	AND
+	status = 'alive'
+`
+
+const sqliteStopNode = `
+UPDATE
+	nodes
+SET
+	status = 'stopped',
+	last_heartbeat = ?
+WHERE
+	id = ?
+`
+
+const sqliteMarkDeadNodes = `
+UPDATE
+	nodes
+SET
+	status = 'dead'
+WHERE
+	status = 'alive'
+	AND
+	last_heartbeat < ?
+`
+
+const sqliteReleaseDeadNodeJobs = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE WHEN attempts + 1 >= ? THEN 'dead' ELSE COALESCE(` + sqlCampaignHold + `, 'retry') END,
+	attempts = attempts + 1,
+	last_error = 'node ' || claimed_by || ' stopped sending heartbeats',
+	claimed_by = NULL,
+	lease_until = NULL,
+	run_at = ?
+WHERE
+	status = 'running'
+	AND
+	claimed_by IN (SELECT id FROM nodes WHERE status = 'dead')
+`
+
+const sqliteGetNodes = `
+SELECT
+	id,
+	version,
+	hostname,
+	workers,
+	rate,
+	last_error,
+	jobs_done,
+	jobs_failed,
+	started_at,
+	last_heartbeat,
+	status
+FROM
+	nodes
+ORDER BY
+	id ASC
+`
+
+const sqliteSelectCampaigns = `
+SELECT
+	c.id,
+	c.name,
+	c.tracker,
+	t.name,
+	c.description,
+	c.range_start,
+	c.range_end,
+	c.source,
+	c.created_by,
+	c.status,
+	c.next_id,
+	c.created_at,
+	c.updated_at,
+	c.finished_at,
+	c.weight,
+	c.priority,
+	c.generator
+FROM
+	campaigns c
+	INNER JOIN trackers t ON t.id = c.tracker
+`
+
+const sqliteGetCampaigns = sqliteSelectCampaigns + `
+ORDER BY
+	c.id ASC
+`
+
+const sqliteGetCampaign = sqliteSelectCampaigns + `
+WHERE
+	c.name = ?
+`
+
+const sqliteGetCampaignProgress = `
+SELECT
+	count(*),
+	count(*) FILTER (WHERE status IN ('created', 'retry')),
+	count(*) FILTER (WHERE status = 'running'),
+	count(*) FILTER (WHERE status = 'paused'),
+	count(*) FILTER (WHERE status = 'success'),
+	count(*) FILTER (WHERE status IN ('failed', 'dead')),
+	count(*) FILTER (WHERE status = 'cancelled'),
+	count(*) FILTER (WHERE status = 'success' AND outcome = 'found'),
+	count(*) FILTER (WHERE status IN ('success', 'failed', 'dead') AND end_time > ?2)
+FROM
+	scrape_jobs
+WHERE
+	campaign_id = ?1
+`
+
+const sqliteCreateCampaign = `
+INSERT INTO
+	campaigns (name, tracker, description, range_start, range_end, source, created_by, next_id, created_at, updated_at, weight, priority, generator)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?6, ?7, COALESCE(?4, 0), ?8, ?8, ?9, ?10, ?11)
+`
+
+const sqliteAdvanceCampaign = `
+UPDATE
+	campaigns
+SET
+	next_id = ?3,
+	updated_at = ?4,
+	finished_at = CASE WHEN ?3 >= range_end THEN ?4 END
+WHERE
+	id = ?1
+	AND
+	next_id = ?2
+	AND
+	status = 'active'
+`
+
+const sqliteFinishCampaign = `
+UPDATE
+	campaigns
+SET
+	updated_at = ?3,
+	finished_at = ?3
+WHERE
+	id = ?1
+	AND
+	next_id = ?2
+	AND
+	status = 'active'
+	AND
+	finished_at IS NULL
+`
+
+const sqliteSetCampaignStatus = `
+UPDATE
+	campaigns
+SET
+	status = ?2,
+	updated_at = ?3
+WHERE
+	id = ?1
+	AND
+	status <> 'cancelled'
+`
+
+const sqliteSetCampaignSchedule = `
+UPDATE
+	campaigns
+SET
+	weight = ?2,
+	priority = ?3,
+	updated_at = ?4
+WHERE
+	id = ?1
+	AND
+	status <> 'cancelled'
+`
+
+const sqliteSetCampaignJobPriority = `
+UPDATE
+	scrape_jobs
+SET
+	priority = ?2
+WHERE
+	campaign_id = ?1
+	AND
+	status IN ('created', 'retry', 'paused')
+`
+
+const sqliteSetCampaignJobStatus = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE
+		WHEN ?2 = 'active' THEN (CASE WHEN attempts = 0 THEN 'created' ELSE 'retry' END)
+		ELSE ?2
+	END
+WHERE
+	campaign_id = ?1
+	AND
+	status IN ('created', 'retry', 'paused')
+	AND
+	CASE ?2
+		WHEN 'active' THEN status = 'paused'
+		WHEN 'paused' THEN status <> 'paused'
+		ELSE 1
+	END
+`
+
+const sqliteCreateExploration = `
+INSERT INTO
+	explorations (campaign_id, block_size, stride, factor, min_hit_rate, created_at)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?6)
+`
+
+const sqliteGetExploration = `
+SELECT
+	campaign_id,
+	block_size,
+	stride,
+	factor,
+	min_hit_rate,
+	created_at
+FROM
+	explorations
+WHERE
+	campaign_id = ?1
+`
+
+const sqliteGetExploreBlocks = `
+SELECT
+	block_start,
+	stride,
+	state,
+	samples,
+	hits,
+	updated_at
+FROM
+	explore_blocks
+WHERE
+	campaign_id = ?1
+ORDER BY
+	block_start ASC
+`
+
+const sqliteSaveExploreBlock = `
+INSERT INTO
+	explore_blocks (campaign_id, block_start, stride, state, samples, hits, updated_at)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?6, ?7)
+ON CONFLICT (campaign_id, block_start)
+	DO UPDATE SET
+		stride = excluded.stride,
+		state = excluded.state,
+		samples = excluded.samples,
+		hits = excluded.hits,
+		updated_at = excluded.updated_at
+`
+
+const sqliteAddExploreSample = `
+INSERT INTO
+	explore_samples (campaign_id, job_key, block_start)
+VALUES
+	(?1, ?2, ?3)
+ON CONFLICT (campaign_id, job_key)
+	DO NOTHING
+`
+
+const sqliteGetExploreStats = `
+SELECT
+	es.block_start,
+	count(*) FILTER (WHERE sj.status IN ('created', 'retry', 'running', 'paused')),
+	count(*) FILTER (WHERE sj.status = 'success'),
+	count(*) FILTER (WHERE sj.status = 'success' AND sj.outcome = 'found')
+FROM
+	explore_blocks eb
+	INNER JOIN explore_samples es ON es.campaign_id = eb.campaign_id AND es.block_start = eb.block_start
+	INNER JOIN campaigns c ON c.id = es.campaign_id
+	INNER JOIN scrape_jobs sj ON sj.tracker = c.tracker AND sj.job_key = es.job_key AND sj.follow_of IS NULL
+WHERE
+	eb.campaign_id = ?1
+	AND
+	eb.state = 'sampling'
+	AND
+	sj.campaign_id = ?1
+GROUP BY
+	es.block_start
+ORDER BY
+	es.block_start ASC
+`
+
+const sqliteStartFollows = `
+INSERT INTO
+	follows (job_id, tracker, last_job_id, state, found_at, created_at, updated_at)
+SELECT
+	sj.id,
+	sj.tracker,
+	sj.id,
+	'waiting',
+	COALESCE(sj.end_time, ?2),
+	?2,
+	?2
+FROM
+	scrape_jobs sj
+WHERE
+	sj.tracker = ?1
+	AND
+	sj.outcome = 'found'
+	AND
+	sj.follow_of IS NULL
+	AND
+	sj.status = 'success'
+	AND
+	NOT EXISTS (SELECT 1 FROM follows f WHERE f.job_id = sj.id)
+ORDER BY
+	sj.id ASC
+`
+
+const sqliteGetWaitingFollows = `
+SELECT
+	f.job_id,
+	t.name,
+	f.last_job_id,
+	f.state,
+	f.status,
+	f.checks,
+	f.found_at,
+	f.next_at,
+	f.created_at,
+	f.updated_at,
+	sj.status,
+	sj.outcome,
+	sj.end_time,
+	sj.resp
+FROM
+	follows f
+	INNER JOIN trackers t ON t.id = f.tracker
+	INNER JOIN scrape_jobs sj ON sj.id = f.last_job_id
+WHERE
+	f.tracker = ?1
+	AND
+	f.state = 'waiting'
+	AND
+	sj.status IN ('success', 'failed', 'dead', 'cancelled')
+ORDER BY
+	f.job_id ASC
+LIMIT
+	?2
+`
+
+const sqliteSaveFollow = `
+UPDATE
+	follows
+SET
+	state = ?3,
+	status = ?4,
+	next_at = ?5,
+	updated_at = ?6
+WHERE
+	job_id = ?1
+	AND
+	last_job_id = ?2
+`
+
+const sqliteGetDueFollows = `
+SELECT
+	f.job_id,
+	sj.job_key,
+	sj.args
+FROM
+	follows f
+	INNER JOIN scrape_jobs sj ON sj.id = f.job_id
+WHERE
+	f.tracker = ?1
+	AND
+	f.state = 'scheduled'
+	AND
+	f.next_at <= ?2
+ORDER BY
+	f.next_at ASC
+LIMIT
+	?3
+`
+
+const sqliteCreateFollowUp = `
+INSERT INTO
+	scrape_jobs (tracker, job_key, args, created_at, run_at, follow_of, priority)
+VALUES
+	(?1, ?2, ?3, ?4, ?4, ?5, ?6)
+`
+
+const sqliteWaitForFollowUp = `
+UPDATE
+	follows
+SET
+	last_job_id = ?2,
+	state = 'waiting',
+	checks = checks + 1,
+	next_at = NULL,
+	updated_at = ?3
+WHERE
+	job_id = ?1
+`
+
+var sqliteDeleteConsignments = []string{`
+DELETE FROM
+	events
+WHERE
+	package_id IN (
+		SELECT p.id FROM packages p INNER JOIN consignments c ON c.id = p.consignment_id WHERE c.job_id = ?1
+	)
+`, `
+DELETE FROM
+	packages
+WHERE
+	consignment_id IN (SELECT c.id FROM consignments c WHERE c.job_id = ?1)
+`, `
+DELETE FROM
+	consignments
+WHERE
+	job_id = ?1
+`}
+
+const sqliteInsertConsignment = `
+INSERT INTO
+	consignments (job_id, number, previous_number, sender_name, sender_reference, sender_country_code,
+		recipient_country_code, total_weight_kg, total_volume_dm3)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)
+`
+
+const sqliteInsertPackage = `
+INSERT INTO
+	packages (consignment_id, number, previous_number, product_name, product_code, brand, status_description,
+		sender_name, recipient_postal_code, recipient_city, recipient_country, weight_kg, volume_dm3,
+		length_cm, width_cm, height_cm)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16)
+`
+
+const sqliteInsertEvent = `
+INSERT INTO
+	events (package_id, occurred_at, status, description, unit_id, unit_type, postal_code, city,
+		country_code, country)
+VALUES
+	(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10)
+`
+
+const sqliteGetConsignments = `
+SELECT
+	c.id,
+	c.number,
+	c.previous_number,
+	c.sender_name,
+	c.sender_reference,
+	c.sender_country_code,
+	c.recipient_country_code,
+	c.total_weight_kg,
+	c.total_volume_dm3
+FROM
+	consignments c
+WHERE
+	c.job_id = ?1
+ORDER BY
+	c.id ASC
+`
+
+const sqliteGetPackages = `
+SELECT
+	p.id,
+	p.consignment_id,
+	p.number,
+	p.previous_number,
+	p.product_name,
+	p.product_code,
+	p.brand,
+	p.status_description,
+	p.sender_name,
+	p.recipient_postal_code,
+	p.recipient_city,
+	p.recipient_country,
+	p.weight_kg,
+	p.volume_dm3,
+	p.length_cm,
+	p.width_cm,
+	p.height_cm
+FROM
+	packages p
+	INNER JOIN consignments c ON c.id = p.consignment_id
+WHERE
+	c.job_id = ?1
+ORDER BY
+	p.id ASC
+`
+
+const sqliteGetEvents = `
+SELECT
+	e.package_id,
+	e.occurred_at,
+	e.status,
+	e.description,
+	e.unit_id,
+	e.unit_type,
+	e.postal_code,
+	e.city,
+	e.country_code,
+	e.country
+FROM
+	events e
+	INNER JOIN packages p ON p.id = e.package_id
+	INNER JOIN consignments c ON c.id = p.consignment_id
+WHERE
+	c.job_id = ?1
+ORDER BY
+	e.id ASC
+`
+
+// SQLite is a Backend kept in a SQLite database, for when a single machine
+// is enough. Any number of workers in one process can use it, and other
+// processes can use the same database at the same time, but only one of
+// them writes at a time.
+type SQLite struct {
+	db    *sql.DB
+	id    string
+	retry RetryPolicy
+	lease time.Duration
+}
+
+// NewSQLite opens the SQLite database at path, creating and migrating it
+// if needed.
+func NewSQLite(path string, cfg Config) (*SQLite, error) {
+	if path == "" {
+		return nil, errors.New("the path to the SQLite database is empty")
+	}
+
+	db, err := sql.Open("sqlite3", path+sqliteParams)
+	if err != nil {
+		return nil, err
+	}
+	// There is only one writer at a time anyway, and with a single
+	// connection we never wait on ourselves.
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	lease := cfg.LeaseDuration
+	if lease <= 0 {
+		lease = DefaultLeaseDuration
+	}
+
+	s := &SQLite{
+		db:    db,
+		id:    cfg.NodeID,
+		retry: cfg.Retry,
+		lease: lease,
+	}
+	return s, nil
+}
+
+// migrateSQLite applies the migrations the database is missing, keeping
+// the version in the user_version pragma.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema is at version %d, which is newer than this version of packtrack knows about", version)
+	}
+
+	for _, mig := range sqliteMigrations[version:] {
+		log.Printf("Applying migration %d: %s\n", mig.version, mig.name)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(mig.up); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %s", mig.version, mig.name, err.Error())
+		}
+		if mig.fill != nil {
+			if err := mig.fill(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %s", mig.version, mig.name, err.Error())
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", mig.version)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillSQLiteJobKeys gives the jobs we have the key their tracker would give
+// them. Where the same key was queued more than once, only the first job
+// gets it, and the others are left without. Jobs of trackers we don't know
+// are left without too.
+func fillSQLiteJobKeys(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT sj.id, sj.tracker, t.name, sj.args FROM scrape_jobs sj INNER JOIN trackers t ON t.id = sj.tracker ORDER BY sj.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type keyed struct {
+		id  int64
+		key string
+	}
+	var found []keyed
+	seen := make(map[uniqueKey]bool)
+	for rows.Next() {
+		var id int64
+		var tracker int
+		var name string
+		var args []byte
+		if err := rows.Scan(&id, &tracker, &name, &args); err != nil {
+			return err
+		}
+
+		t, ok := trackers.Get(name)
+		if !ok {
+			continue
+		}
+		key, err := t.Key(args)
+		if err != nil {
+			continue
+		}
+		if seen[uniqueKey{tracker, key}] {
+			continue
+		}
+		seen[uniqueKey{tracker, key}] = true
+		found = append(found, keyed{id, key})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, k := range found {
+		if _, err := tx.Exec(`UPDATE scrape_jobs SET job_key = ? WHERE id = ?`, k.key, k.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillSQLiteOutcomes copies the outcome of the jobs that have been tried out
+// of their stats, which we can't look into from SQL without JSON1.
+func fillSQLiteOutcomes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, stats FROM scrape_jobs WHERE end_time IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	outcomes := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var stats []byte
+		if err := rows.Scan(&id, &stats); err != nil {
+			return err
+		}
+
+		var ps PerformStats
+		if err := json.Unmarshal(stats, &ps); err != nil || ps.Outcome == "" {
+			continue
+		}
+		outcomes[id] = ps.Outcome
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for id, outcome := range outcomes {
+		if _, err := tx.Exec(`UPDATE scrape_jobs SET outcome = ? WHERE id = ?`, outcome, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteTime is how we store times in SQLite
+func sqliteTime(t time.Time) int64 { return t.UnixNano() }
+
+// fromSQLiteTime turns a stored time back into a time.Time, zero if NULL
+func fromSQLiteTime(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64)
+}
+
+// Close closes the database
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Trackers implements JobQueue
+func (s *SQLite) Trackers(ctx context.Context) ([]Tracker, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetTrackers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ts := make([]Tracker, 0)
+	for rows.Next() {
+		var t Tracker
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.URL); err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// InsertJob implements JobQueue
+func (s *SQLite) InsertJob(ctx context.Context, tracker int, args []byte, createdAt time.Time) error {
+	_, err := s.InsertJobs(ctx, InsertSkip, []int{tracker}, [][]byte{args}, []time.Time{createdAt})
+	return err
+}
+
+// InsertJobs implements JobQueue
+func (s *SQLite) InsertJobs(ctx context.Context, mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time) (InsertResult, error) {
+	return s.insertJobs(ctx, mode, tracker, args, createdAt, nil, nil)
+}
+
+// insertJobs does the work of InsertJobs, putting the jobs in the campaign c
+// if it isn't nil, and calling then, if it is given, before committing.
+func (s *SQLite) insertJobs(ctx context.Context, mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time, c *Campaign, then func(tx *sql.Tx) error) (InsertResult, error) {
+	var res InsertResult
+	var campaign sql.NullInt64
+	var priority int
+	if c != nil {
+		campaign, priority = sql.NullInt64{Int64: c.ID, Valid: true}, c.Priority
+	}
+	if len(tracker) != len(args) || len(args) != len(createdAt) {
+		return res, errors.New("All arrays must be equally long")
+	}
+
+	ts, err := s.Trackers(ctx)
+	if err != nil {
+		return res, err
+	}
+	keys, err := jobKeys(ts, tracker, args)
+	if err != nil {
+		return res, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareContext(ctx, sqliteCreateScrapeJob)
+	if err != nil {
+		return res, err
+	}
+	defer insert.Close()
+
+	update, err := tx.PrepareContext(ctx, sqliteUpdateScrapeJob)
+	if err != nil {
+		return res, err
+	}
+	defer update.Close()
+
+	now := sqliteTime(time.Now())
+	seen := make(map[uniqueKey]bool)
+	for i := range tracker {
+		// Postgres checks this for us, as args is jsonb there.
+		if !json.Valid(args[i]) {
+			return res, fmt.Errorf("args of job %d are not valid JSON", i)
+		}
+
+		k := uniqueKey{tracker[i], keys[i]}
+		if seen[k] {
+			res.Existing++
+			continue
+		}
+		seen[k] = true
+
+		r, err := insert.ExecContext(ctx, tracker[i], keys[i], string(args[i]), sqliteTime(createdAt[i]), now, campaign, priority)
+		if err != nil {
+			return res, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return res, err
+		}
+		if n > 0 {
+			res.New++
+			continue
+		}
+
+		res.Existing++
+		if mode != InsertUpdate {
+			continue
+		}
+		r, err = update.ExecContext(ctx, string(args[i]), now, campaign, priority, tracker[i], keys[i])
+		if err != nil {
+			return res, err
+		}
+		if n, err = r.RowsAffected(); err != nil {
+			return res, err
+		}
+		res.Updated += n
+	}
+
+	if then != nil {
+		if err := then(tx); err != nil {
+			return InsertResult{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return InsertResult{}, err
+	}
+	return res, nil
+}
+
+// ClaimJob implements JobQueue
+func (s *SQLite) ClaimJob(ctx context.Context, q Queue) (*Job, error) {
+	job := &Job{StartedAt: time.Now()}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := sqliteTime(job.StartedAt)
+	query, args := sqliteFindJob, []interface{}{now, q.Tracker}
+	switch {
+	case q.Campaign == NoCampaign:
+		query = sqliteFindNoCampaignJob
+	case q.Campaign != 0:
+		query, args = sqliteFindCampaignJob, append(args, q.Campaign)
+	}
+
+	row := tx.QueryRowContext(ctx, query, args...)
+	if err := row.Scan(&job.ID, &job.Tracker, &job.Args, &job.Attempts, &job.RateLimits); err != nil {
+		return nil, err
+	}
+
+	leaseUntil := sqliteTime(job.StartedAt.Add(s.lease))
+	if _, err := tx.ExecContext(ctx, sqliteClaimJob, s.id, leaseUntil, now, job.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// FinishJob implements JobQueue
+func (s *SQLite) FinishJob(ctx context.Context, job *Job, res *trackers.Result, err error) error {
+	f, err := finish(s.id, s.retry, job, res, err)
+	if err != nil {
+		return err
+	}
+
+	var resp sql.NullString
+	if f.resp != nil {
+		resp = sql.NullString{String: string(f.resp), Valid: true}
+	}
+
+	now := time.Now()
+	r, err := s.db.ExecContext(ctx, sqliteFinishJob, f.status, f.status, sqliteTime(now), string(f.stats), resp,
+		f.attempts, f.lastError, sqliteTime(now.Add(f.retryIn)), f.outcome, f.rateLimits, job.ID, s.id)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+
+	return f.err
+}
+
+// ReleaseJob implements JobQueue
+func (s *SQLite) ReleaseJob(ctx context.Context, job *Job) error {
+	r, err := s.db.ExecContext(ctx, sqliteReleaseJob, sqliteTime(time.Now()), job.ID, s.id)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// maxAttempts returns the number of attempts a job gets
+func (s *SQLite) maxAttempts() int {
+	if s.retry.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return s.retry.MaxAttempts
+}
+
+// ReapLeases implements JobQueue
+func (s *SQLite) ReapLeases(ctx context.Context) (int64, error) {
+	now := sqliteTime(time.Now())
+	res, err := s.db.ExecContext(ctx, sqliteReapLeases, s.maxAttempts(), now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// JobCounts implements JobQueue
+func (s *SQLite) JobCounts(ctx context.Context) ([]JobCount, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetJobCounts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]JobCount, 0)
+	for rows.Next() {
+		var c JobCount
+		if err := rows.Scan(&c.Tracker, &c.Status, &c.N); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Jobs implements JobQueue
+func (s *SQLite) Jobs(ctx context.Context, f JobFilter) ([]JobInfo, error) {
+	jobs := make([]JobInfo, 0)
+	err := s.queryJobs(ctx, f, func(j *JobInfo) error {
+		j.Resp = nil
+		jobs = append(jobs, *j)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// sqliteExportPage is how many jobs ExportJobs reads at a time
+const sqliteExportPage = 100
+
+// ExportJobs implements JobQueue. The jobs are read a page at a time, and
+// the page is closed before fn sees any of it, so that fn can use the only
+// connection to the database.
+func (s *SQLite) ExportJobs(ctx context.Context, f JobFilter, fn func(*JobInfo) error) error {
+	left := f.Limit
+	for {
+		page := f
+		page.Limit = sqliteExportPage
+		if left > 0 && left < page.Limit {
+			page.Limit = left
+		}
+
+		jobs := make([]JobInfo, 0, page.Limit)
+		err := s.queryJobs(ctx, page, func(j *JobInfo) error {
+			jobs = append(jobs, *j)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range jobs {
+			if err := fn(&jobs[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(jobs) < page.Limit {
+			return nil
+		}
+		if left > 0 {
+			left -= len(jobs)
+			if left == 0 {
+				return nil
+			}
+		}
+		f.AfterID = jobs[len(jobs)-1].ID
+	}
+}
+
+func (s *SQLite) queryJobs(ctx context.Context, f JobFilter, fn func(*JobInfo) error) error {
+	rows, err := s.db.QueryContext(ctx, sqliteGetJobs, f.Tracker, f.Status, f.AfterID, f.Limit, f.Campaign, f.Outcome)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var j JobInfo
+		var lastError, claimedBy, outcome, resp sql.NullString
+		var createdAt, startTime, endTime, runAt, followOf sql.NullInt64
+
+		if err := rows.Scan(&j.ID, &j.Tracker, &j.Args, &j.Status, &j.Attempts, &j.Priority, &lastError,
+			&createdAt, &startTime, &endTime, &runAt, &claimedBy, &j.Stats, &outcome, &followOf, &resp); err != nil {
+			return err
+		}
+		j.FollowOf = followOf.Int64
+		j.LastError = lastError.String
+		j.ClaimedBy = claimedBy.String
+		j.Outcome = outcome.String
+		j.CreatedAt = fromSQLiteTime(createdAt)
+		j.StartTime = fromSQLiteTime(startTime)
+		j.EndTime = fromSQLiteTime(endTime)
+		j.RunAt = fromSQLiteTime(runAt)
+		if resp.Valid {
+			j.Resp = []byte(resp.String)
+		}
+
+		if err := fn(&j); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// RegisterNode implements NodeRegistry
+func (s *SQLite) RegisterNode(ctx context.Context, n *Node) error {
+	_, err := s.db.ExecContext(ctx, sqliteRegisterNode, s.id, n.Version, n.Hostname, n.Workers, sqliteTime(time.Now()))
+	return err
+}
+
+// Heartbeat implements NodeRegistry
+func (s *SQLite) Heartbeat(ctx context.Context, n *Node) error {
+	lastError := sql.NullString{String: n.LastError, Valid: n.LastError != ""}
+	res, err := s.db.ExecContext(ctx, sqliteHeartbeat, n.Workers, n.Rate, lastError, n.JobsDone, n.JobsFailed,
+		sqliteTime(time.Now()), s.id)
+	if err != nil {
+		return err
+	}
+	return heartbeatResult(res)
+}
+
+// StopNode implements NodeRegistry
+func (s *SQLite) StopNode(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, sqliteStopNode, sqliteTime(time.Now()), s.id)
+	return err
+}
+
+// ReapDeadNodes implements NodeRegistry
+func (s *SQLite) ReapDeadNodes(ctx context.Context, timeout time.Duration) (int64, int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.ExecContext(ctx, sqliteMarkDeadNodes, sqliteTime(now.Add(-timeout)))
+	if err != nil {
+		return 0, 0, err
+	}
+	nodes, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err = tx.ExecContext(ctx, sqliteReleaseDeadNodeJobs, s.maxAttempts(), sqliteTime(now))
+	if err != nil {
+		return 0, 0, err
+	}
+	jobs, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return nodes, jobs, nil
+}
+
+// Nodes implements NodeRegistry
+func (s *SQLite) Nodes(ctx context.Context) ([]Node, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetNodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make([]Node, 0)
+	for rows.Next() {
+		var n Node
+		var rate sql.NullFloat64
+		var lastError sql.NullString
+		var startedAt, lastHeartbeat sql.NullInt64
+
+		if err := rows.Scan(&n.ID, &n.Version, &n.Hostname, &n.Workers, &rate, &lastError,
+			&n.JobsDone, &n.JobsFailed, &startedAt, &lastHeartbeat, &n.Status); err != nil {
+			return nil, err
+		}
+		n.Rate = rate.Float64
+		n.LastError = lastError.String
+		n.StartedAt = fromSQLiteTime(startedAt)
+		n.LastHeartbeat = fromSQLiteTime(lastHeartbeat)
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// scanSQLiteCampaign reads a row of sqliteSelectCampaigns
+func scanSQLiteCampaign(row interface{ Scan(...interface{}) error }) (*Campaign, error) {
+	var c Campaign
+	var rangeStart, rangeEnd sql.NullInt64
+	var source, generator sql.NullString
+	var createdAt, updatedAt, finishedAt sql.NullInt64
+
+	err := row.Scan(&c.ID, &c.Name, &c.TrackerID, &c.Tracker, &c.Description, &rangeStart, &rangeEnd,
+		&source, &c.CreatedBy, &c.Status, &c.Next, &createdAt, &updatedAt, &finishedAt, &c.Weight, &c.Priority,
+		&generator)
+	if err != nil {
+		return nil, err
+	}
+	c.RangeStart = rangeStart.Int64
+	c.RangeEnd = rangeEnd.Int64
+	c.Source = source.String
+	c.Generator = generator.String
+	c.CreatedAt = fromSQLiteTime(createdAt)
+	c.UpdatedAt = fromSQLiteTime(updatedAt)
+	c.FinishedAt = fromSQLiteTime(finishedAt)
+	return &c, nil
+}
+
+// CreateCampaign implements JobQueue
+func (s *SQLite) CreateCampaign(ctx context.Context, c *Campaign) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	rangeStart, rangeEnd, source, generator := campaignColumns(c)
+	_, err := s.db.ExecContext(ctx, sqliteCreateCampaign, c.Name, c.TrackerID, c.Description, rangeStart, rangeEnd,
+		source, c.CreatedBy, sqliteTime(time.Now()), c.weight(), c.Priority, generator)
+	if err != nil {
+		return err
+	}
+
+	created, err := s.Campaign(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	*c = *created
+	return nil
+}
+
+// Campaign implements JobQueue
+func (s *SQLite) Campaign(ctx context.Context, name string) (*Campaign, error) {
+	return scanSQLiteCampaign(s.db.QueryRowContext(ctx, sqliteGetCampaign, name))
+}
+
+// InsertCampaignJobs implements JobQueue
+func (s *SQLite) InsertCampaignJobs(ctx context.Context, c *Campaign, mode InsertMode, args [][]byte, createdAt []time.Time, next int64) (InsertResult, error) {
+	if c.Status != CampaignActive {
+		return InsertResult{}, errCampaignStatus(c)
+	}
+
+	tracker := make([]int, len(args))
+	for i := range tracker {
+		tracker[i] = c.TrackerID
+	}
+
+	res, err := s.insertJobs(ctx, mode, tracker, args, createdAt, c, func(tx *sql.Tx) error {
+		r, err := tx.ExecContext(ctx, sqliteAdvanceCampaign, c.ID, c.Next, next, sqliteTime(time.Now()))
+		if err != nil {
+			return err
+		}
+		if n, err := r.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrCampaignChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	updated, err := s.Campaign(ctx, c.Name)
+	if err != nil {
+		return res, err
+	}
+	*c = *updated
+	return res, nil
+}
+
+// FinishCampaign implements JobQueue
+func (s *SQLite) FinishCampaign(ctx context.Context, c *Campaign) error {
+	if c.Status != CampaignActive {
+		return errCampaignStatus(c)
+	}
+
+	r, err := s.db.ExecContext(ctx, sqliteFinishCampaign, c.ID, c.Next, sqliteTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCampaignChanged
+	}
+
+	updated, err := s.Campaign(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	*c = *updated
+	return nil
+}
+
+// SetCampaignStatus implements JobQueue
+func (s *SQLite) SetCampaignStatus(ctx context.Context, c *Campaign, status string) (int64, error) {
+	if err := validCampaignStatus(status); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	r, err := tx.ExecContext(ctx, sqliteSetCampaignStatus, c.ID, status, sqliteTime(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrCampaignCancelled
+	}
+
+	r, err = tx.ExecContext(ctx, sqliteSetCampaignJobStatus, c.ID, status)
+	if err != nil {
+		return 0, err
+	}
+	jobs, err := r.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	c.Status = status
+	return jobs, nil
+}
+
+// SetCampaignSchedule implements JobQueue
+func (s *SQLite) SetCampaignSchedule(ctx context.Context, c *Campaign, weight, priority int) (int64, error) {
+	if err := validWeight(weight); err != nil {
+		return 0, err
+	}
+	if weight == 0 {
+		weight = 1
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	r, err := tx.ExecContext(ctx, sqliteSetCampaignSchedule, c.ID, weight, priority, sqliteTime(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrCampaignCancelled
+	}
+
+	r, err = tx.ExecContext(ctx, sqliteSetCampaignJobPriority, c.ID, priority)
+	if err != nil {
+		return 0, err
+	}
+	jobs, err := r.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	c.Weight, c.Priority = weight, priority
+	return jobs, nil
+}
+
+// Campaigns implements JobQueue
+func (s *SQLite) Campaigns(ctx context.Context) ([]Campaign, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetCampaigns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := make([]Campaign, 0)
+	for rows.Next() {
+		c, err := scanSQLiteCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, *c)
+	}
+	return campaigns, rows.Err()
+}
+
+// CampaignProgress implements JobQueue
+func (s *SQLite) CampaignProgress(ctx context.Context, c *Campaign) (*CampaignProgress, error) {
+	p := &CampaignProgress{Campaign: *c}
+	hourAgo := sqliteTime(time.Now().Add(-time.Hour))
+	err := s.db.QueryRowContext(ctx, sqliteGetCampaignProgress, c.ID, hourAgo).Scan(&p.Jobs, &p.Waiting, &p.Running,
+		&p.Paused, &p.Done, &p.Failed, &p.Cancelled, &p.Hits, &p.FinishedLastHour)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CreateExploration implements JobQueue
+func (s *SQLite) CreateExploration(ctx context.Context, e *Exploration) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, sqliteCreateExploration, e.CampaignID, e.BlockSize, e.Stride, e.Factor, e.MinHitRate,
+		sqliteTime(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	created, err := s.Exploration(ctx, e.CampaignID)
+	if err != nil {
+		return err
+	}
+	*e = *created
+	return nil
+}
+
+// Exploration implements JobQueue
+func (s *SQLite) Exploration(ctx context.Context, campaign int64) (*Exploration, error) {
+	var e Exploration
+	var createdAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, sqliteGetExploration, campaign).Scan(&e.CampaignID, &e.BlockSize, &e.Stride,
+		&e.Factor, &e.MinHitRate, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	e.CreatedAt = fromSQLiteTime(createdAt)
+	return &e, nil
+}
+
+// ExploreBlocks implements JobQueue
+func (s *SQLite) ExploreBlocks(ctx context.Context, e *Exploration) ([]ExploreBlock, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetExploreBlocks, e.CampaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := make([]ExploreBlock, 0)
+	for rows.Next() {
+		var b ExploreBlock
+		var updatedAt sql.NullInt64
+		if err := rows.Scan(&b.Start, &b.Stride, &b.State, &b.Samples, &b.Hits, &updatedAt); err != nil {
+			return nil, err
+		}
+		b.UpdatedAt = fromSQLiteTime(updatedAt)
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// SaveExploreBlocks implements JobQueue
+func (s *SQLite) SaveExploreBlocks(ctx context.Context, e *Exploration, blocks []ExploreBlock) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqliteSaveExploreBlock)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := sqliteTime(time.Now())
+	for _, b := range blocks {
+		if err := validBlockState(b.State); err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, e.CampaignID, b.Start, b.Stride, b.State, b.Samples, b.Hits, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddExploreSamples implements JobQueue
+func (s *SQLite) AddExploreSamples(ctx context.Context, e *Exploration, samples []ExploreSample) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqliteAddExploreSample)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, es := range samples {
+		if _, err := stmt.ExecContext(ctx, e.CampaignID, es.Key, es.Block); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ExploreStats implements JobQueue
+func (s *SQLite) ExploreStats(ctx context.Context, e *Exploration) ([]BlockStats, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetExploreStats, e.CampaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]BlockStats, 0)
+	for rows.Next() {
+		var st BlockStats
+		if err := rows.Scan(&st.Start, &st.Pending, &st.Samples, &st.Hits); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// StartFollows implements JobQueue
+func (s *SQLite) StartFollows(ctx context.Context, tracker int) (int64, error) {
+	r, err := s.db.ExecContext(ctx, sqliteStartFollows, tracker, sqliteTime(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// WaitingFollows implements JobQueue
+func (s *SQLite) WaitingFollows(ctx context.Context, tracker int, limit int) ([]Follow, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGetWaitingFollows, tracker, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	follows := make([]Follow, 0)
+	for rows.Next() {
+		var f Follow
+		var foundAt, nextAt, createdAt, updatedAt, endTime sql.NullInt64
+		var outcome, resp sql.NullString
+		if err := rows.Scan(&f.JobID, &f.Tracker, &f.LastJobID, &f.State, &f.Status, &f.Checks, &foundAt, &nextAt,
+			&createdAt, &updatedAt, &f.Last.Status, &outcome, &endTime, &resp); err != nil {
+			return nil, err
+		}
+		f.FoundAt = fromSQLiteTime(foundAt)
+		f.NextAt = fromSQLiteTime(nextAt)
+		f.CreatedAt = fromSQLiteTime(createdAt)
+		f.UpdatedAt = fromSQLiteTime(updatedAt)
+		f.Last.ID = f.LastJobID
+		f.Last.Outcome = outcome.String
+		f.Last.EndTime = fromSQLiteTime(endTime)
+		if resp.Valid {
+			f.Last.Resp = []byte(resp.String)
+		}
+		follows = append(follows, f)
+	}
+	return follows, rows.Err()
+}
+
+// SaveFollows implements JobQueue
+func (s *SQLite) SaveFollows(ctx context.Context, follows []Follow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqliteSaveFollow)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := sqliteTime(time.Now())
+	for _, f := range follows {
+		if err := f.validate(); err != nil {
+			return err
+		}
+		var nextAt sql.NullInt64
+		if !f.NextAt.IsZero() {
+			nextAt = sql.NullInt64{Int64: sqliteTime(f.NextAt), Valid: true}
+		}
+		if _, err := stmt.ExecContext(ctx, f.JobID, f.LastJobID, f.State, f.Status, nextAt, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FollowUp implements JobQueue
+func (s *SQLite) FollowUp(ctx context.Context, tracker int, now time.Time, priority int, limit int) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type due struct {
+		jobID int64
+		key   string
+		args  string
+	}
+	rows, err := tx.QueryContext(ctx, sqliteGetDueFollows, tracker, sqliteTime(now), limit)
+	if err != nil {
+		return 0, err
+	}
+	var follows []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.jobID, &d.key, &d.args); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		follows = append(follows, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	createdAt := sqliteTime(time.Now())
+	for _, d := range follows {
+		r, err := tx.ExecContext(ctx, sqliteCreateFollowUp, tracker, d.key, d.args, createdAt, d.jobID, priority)
+		if err != nil {
+			return 0, err
+		}
+		id, err := r.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteWaitForFollowUp, d.jobID, id, createdAt); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(follows)), nil
+}
+
+// SaveConsignments saves what the job found, in place of anything saved for
+// it before.
+func (s *SQLite) SaveConsignments(ctx context.Context, job int64, consignments []trackers.Consignment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range sqliteDeleteConsignments {
+		if _, err := tx.ExecContext(ctx, q, job); err != nil {
+			return err
+		}
+	}
+
+	insConsignment, err := tx.PrepareContext(ctx, sqliteInsertConsignment)
+	if err != nil {
+		return err
+	}
+	defer insConsignment.Close()
+	insPackage, err := tx.PrepareContext(ctx, sqliteInsertPackage)
+	if err != nil {
+		return err
+	}
+	defer insPackage.Close()
+	insEvent, err := tx.PrepareContext(ctx, sqliteInsertEvent)
+	if err != nil {
+		return err
+	}
+	defer insEvent.Close()
+
+	for _, c := range consignments {
+		res, err := insConsignment.ExecContext(ctx, job, c.ID, c.PreviousID, c.SenderName, c.SenderReference,
+			c.SenderCountryCode, c.RecipientCountryCode, c.TotalWeightKg, c.TotalVolumeDm3)
+		if err != nil {
+			return err
+		}
+		cid, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, p := range c.Packages {
+			res, err := insPackage.ExecContext(ctx, cid, p.Number, p.PreviousNumber, p.ProductName, p.ProductCode,
+				p.Brand, p.StatusDescription, p.SenderName, p.RecipientPostalCode, p.RecipientCity,
+				p.RecipientCountry, p.WeightKg, p.VolumeDm3, p.LengthCm, p.WidthCm, p.HeightCm)
+			if err != nil {
+				return err
+			}
+			pid, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			for _, e := range p.Events {
+				var at sql.NullInt64
+				if !e.Time.IsZero() {
+					at = sql.NullInt64{Int64: sqliteTime(e.Time), Valid: true}
+				}
+				if _, err := insEvent.ExecContext(ctx, pid, at, e.Status, e.Description, e.UnitID,
+					e.UnitType, e.PostalCode, e.City, e.CountryCode, e.Country); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Consignments returns what was saved for the job, in the order it was saved
+func (s *SQLite) Consignments(ctx context.Context, job int64) ([]trackers.Consignment, error) {
+	sh := newShipments()
+
+	// There is only the one connection, so each query is read to the end
+	// before the next is made.
+	rows, err := s.db.QueryContext(ctx, sqliteGetConsignments, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var c trackers.Consignment
+		if err := rows.Scan(&id, &c.ID, &c.PreviousID, &c.SenderName, &c.SenderReference, &c.SenderCountryCode,
+			&c.RecipientCountryCode, &c.TotalWeightKg, &c.TotalVolumeDm3); err != nil {
+			return nil, err
+		}
+		sh.addConsignment(id, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, sqliteGetPackages, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, cid int64
+		var p trackers.Package
+		if err := rows.Scan(&id, &cid, &p.Number, &p.PreviousNumber, &p.ProductName, &p.ProductCode, &p.Brand,
+			&p.StatusDescription, &p.SenderName, &p.RecipientPostalCode, &p.RecipientCity, &p.RecipientCountry,
+			&p.WeightKg, &p.VolumeDm3, &p.LengthCm, &p.WidthCm, &p.HeightCm); err != nil {
+			return nil, err
+		}
+		if err := sh.addPackage(id, cid, p); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, sqliteGetEvents, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int64
+		var at sql.NullInt64
+		var e trackers.Event
+		if err := rows.Scan(&pid, &at, &e.Status, &e.Description, &e.UnitID, &e.UnitType, &e.PostalCode, &e.City,
+			&e.CountryCode, &e.Country); err != nil {
+			return nil, err
+		}
+		e.Time = fromSQLiteTime(at)
+		if err := sh.addEvent(pid, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sh.consignments, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/store/storetest"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packtrack")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	storetest.Run(t, func(t *testing.T, cfg store.Config) store.JobQueue {
+		n++
+		cfg.ConnString = "sqlite://" + filepath.Join(dir, fmt.Sprintf("%d.db", n))
+		s, err := store.Open(cfg)
+		if err != nil {
+			t.Fatalf("store.Open: %s", err)
+		}
+		return s
+	})
+}
+
+// TestSQLiteExportJobsUsingQueue checks that the queue can be used while
+// exporting jobs, even though SQLite has a single connection. There are
+// enough jobs for several pages.
+func TestSQLiteExportJobsUsingQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packtrack")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := store.Open(store.Config{ConnString: "sqlite://" + filepath.Join(dir, "export.db"), NodeID: "test"})
+	if err != nil {
+		t.Fatalf("store.Open: %s", err)
+	}
+	defer s.Close()
+
+	// A deadlock fails the test rather than hanging it.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	ts, err := s.Trackers(ctx)
+	if err != nil || len(ts) == 0 {
+		t.Fatalf("Trackers gave %v, %v", ts, err)
+	}
+	const n = 250
+	ids := make([]int, n)
+	args := make([][]byte, n)
+	createdAt := make([]time.Time, n)
+	for i := range args {
+		ids[i] = ts[0].ID
+		args[i] = []byte(fmt.Sprintf(`{"q":"%d"}`, i))
+		createdAt[i] = time.Now()
+	}
+	if _, err := s.InsertJobs(ctx, store.InsertSkip, ids, args, createdAt); err != nil {
+		t.Fatalf("InsertJobs: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		f    store.JobFilter
+		want int
+	}{
+		{"all", store.JobFilter{}, n},
+		{"limit", store.JobFilter{Limit: 150}, 150},
+		{"after", store.JobFilter{AfterID: 120}, n - 120},
+		{"after and limit", store.JobFilter{AfterID: 120, Limit: 100}, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last := tt.f.AfterID
+			got := 0
+			err := s.ExportJobs(ctx, tt.f, func(j *store.JobInfo) error {
+				if j.ID <= last {
+					return fmt.Errorf("job %d came after job %d", j.ID, last)
+				}
+				last = j.ID
+				got++
+
+				jobs, err := s.Jobs(ctx, store.JobFilter{AfterID: j.ID - 1, Limit: 1})
+				if err != nil {
+					return err
+				}
+				if len(jobs) != 1 || jobs[0].ID != j.ID {
+					return fmt.Errorf("Jobs gave %+v, want job %d", jobs, j.ID)
+				}
+				return s.SaveConsignments(ctx, j.ID, []trackers.Consignment{{ID: fmt.Sprint(j.ID)}})
+			})
+			if err != nil {
+				t.Fatalf("ExportJobs: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("exported %d jobs, want %d", got, tt.want)
+			}
+		})
+	}
+}
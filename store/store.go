@@ -22,20 +22,46 @@ package store
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
+
+	"github.com/rhermes/packtrack/trackers"
 )
 
 var (
 	ErrRateLimit = errors.New("RateLimited")
+
+	// ErrLeaseLost is returned when finishing a job we no longer hold the
+	// lease for, because it expired and the job was handed out again.
+	ErrLeaseLost = errors.New("lease on job lost")
+
+	// ErrNodeDead is returned by a heartbeat from a node the others have
+	// marked as dead, and taken its jobs back from.
+	ErrNodeDead = errors.New("node has been marked dead")
+)
+
+// The statuses a job can be in
+const (
+	// StatusCreated is a job that has never been tried
+	StatusCreated = "created"
+	// StatusRunning is a job some node holds a lease on
+	StatusRunning = "running"
+	// StatusSuccess is a job we got an answer for
+	StatusSuccess = "success"
+	// StatusRetry is a job that failed, but will be tried again
+	StatusRetry = "retry"
+	// StatusFailed is a job that failed in a way retrying won't fix
+	StatusFailed = "failed"
+	// StatusDead is a job that failed too many times
+	StatusDead = "dead"
+	// StatusPaused is a job waiting for its campaign to be resumed
+	StatusPaused = "paused"
+	// StatusCancelled is a job whose campaign was cancelled before it ran
+	StatusCancelled = "cancelled"
 )
 
 const sqlGetTrackers = `SELECT id, name, description, url FROM trackers`
@@ -44,59 +70,217 @@ const sqlCreateScrapeJob = `
 INSERT INTO
 	scrape_jobs (
 		tracker,
+		job_key,
 		args,
 		created_at
 	)
 VALUES
-	($1, $2, $3)
+	($1, $2, $3, $4)
+ON CONFLICT (tracker, job_key) WHERE follow_of IS NULL
+	DO NOTHING
 `
 
-const sqlGetJobForUpdateByTracker = `
-SELECT
-	id,
-	args
+// The jobs to insert are copied into the staging table first, so we can
+// deal with the keys that are already queued in one go.
+const sqlCreateStaging = `
+CREATE TEMPORARY TABLE scrape_jobs_staging (
+	seq BIGINT NOT NULL,
+	tracker INTEGER NOT NULL,
+	job_key TEXT NOT NULL,
+	args JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	campaign_id BIGINT,
+	priority INTEGER NOT NULL
+) ON COMMIT DROP
+`
+
+const sqlUpdateFromStaging = `
+UPDATE
+	scrape_jobs sj
+SET
+	args = s.args,
+	status = 'created',
+	attempts = 0,
+	rate_limits = 0,
+	last_error = NULL,
+	outcome = NULL,
+	start_time = NULL,
+	end_time = NULL,
+	stats = '{}',
+	resp = NULL,
+	run_at = now(),
+	campaign_id = COALESCE(s.campaign_id, sj.campaign_id),
+	priority = CASE WHEN s.campaign_id IS NULL THEN sj.priority ELSE s.priority END
 FROM
-	scrape_jobs
+	(
+		SELECT DISTINCT ON (tracker, job_key)
+			tracker,
+			job_key,
+			args,
+			campaign_id,
+			priority
+		FROM
+			scrape_jobs_staging
+		ORDER BY
+			tracker, job_key, seq
+	) s
 WHERE
-	status = 'created'
+	sj.tracker = s.tracker
 	AND
-	tracker = $1
-ORDER BY
-	id ASC
-FOR UPDATE
-SKIP LOCKED
-LIMIT 1
+	sj.job_key = s.job_key
+	AND
+	sj.follow_of IS NULL
+	AND
+	sj.status <> 'running'
 `
 
-const sqlGetJobForUpdate = `
+// The jobs are inserted in the order they were given, so they are claimed
+// in that order too.
+const sqlInsertFromStaging = `
+INSERT INTO
+	scrape_jobs (
+		tracker,
+		job_key,
+		args,
+		created_at,
+		campaign_id,
+		priority
+	)
 SELECT
-	id,
 	tracker,
-	args
+	job_key,
+	args,
+	created_at,
+	campaign_id,
+	priority
 FROM
-	scrape_jobs
-WHERE
-	status = 'created'
+	(
+		SELECT DISTINCT ON (tracker, job_key)
+			*
+		FROM
+			scrape_jobs_staging
+		ORDER BY
+			tracker, job_key, seq
+	) s
 ORDER BY
-	id ASC
-FOR UPDATE
-SKIP LOCKED
-LIMIT 1
+	seq
+ON CONFLICT (tracker, job_key) WHERE follow_of IS NULL
+	DO NOTHING
 `
 
-const sqlUpdateJob = `
+// sqlClaimJobFormat claims a job of the tracker, from the jobs matching the
+// extra condition put in the %s.
+const sqlClaimJobFormat = `
 UPDATE
-	scrape_jobs
-SET 
-	status = $2,
+	scrape_jobs sj
+SET
+	status = 'running',
+	claimed_by = $1,
+	lease_until = now() + $2::double precision * interval '1 second',
 	start_time = $3,
+	end_time = NULL
+FROM
+	trackers t
+WHERE
+	t.id = sj.tracker
+	AND
+	sj.id = (
+		SELECT
+			id
+		FROM
+			scrape_jobs
+		WHERE
+			status IN ('created', 'retry')
+			AND
+			run_at <= now()
+			AND
+			tracker = $4
+			%s
+		ORDER BY
+			priority DESC,
+			id ASC
+		FOR UPDATE
+		SKIP LOCKED
+		LIMIT 1
+	)
+RETURNING
+	sj.id,
+	t.name,
+	sj.args,
+	sj.attempts,
+	sj.rate_limits
+`
+
+var (
+	sqlClaimJob           = fmt.Sprintf(sqlClaimJobFormat, "")
+	sqlClaimCampaignJob   = fmt.Sprintf(sqlClaimJobFormat, "AND campaign_id = $5")
+	sqlClaimNoCampaignJob = fmt.Sprintf(sqlClaimJobFormat, "AND campaign_id IS NULL")
+)
+
+// sqlCampaignHold is the status of the campaign of the job being updated if
+// it is paused or cancelled, and NULL otherwise. A job going back to wait
+// takes that status instead, as the campaign won't run it until resumed.
+const sqlCampaignHold = `(SELECT c.status FROM campaigns c WHERE c.id = scrape_jobs.campaign_id AND c.status IN ('paused', 'cancelled'))`
+
+const sqlFinishJob = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE $3::text WHEN 'retry' THEN COALESCE(` + sqlCampaignHold + `, 'retry') ELSE $3 END,
 	end_time = $4,
 	stats = $5,
-	resp = $6
+	resp = $6,
+	attempts = $7,
+	last_error = $8,
+	run_at = now() + $9::double precision * interval '1 second',
+	outcome = $10,
+	rate_limits = $11,
+	claimed_by = NULL,
+	lease_until = NULL
 WHERE
 	id = $1
+	AND
+	claimed_by = $2
+	AND
+	status = 'running'
 `
 
+const sqlReapLeases = `
+UPDATE
+	scrape_jobs
+SET
+	status = CASE WHEN attempts + 1 >= $1 THEN 'dead' ELSE COALESCE(` + sqlCampaignHold + `, 'retry') END,
+	attempts = attempts + 1,
+	last_error = 'lease held by ' || claimed_by || ' expired',
+	claimed_by = NULL,
+	lease_until = NULL,
+	run_at = now()
+WHERE
+	status = 'running'
+	AND
+	lease_until < now()
+`
+
+const sqlReleaseJob = `
+UPDATE
+	scrape_jobs
+SET
+	status = COALESCE(` + sqlCampaignHold + `, CASE WHEN attempts = 0 THEN 'created' ELSE 'retry' END),
+	start_time = NULL,
+	claimed_by = NULL,
+	lease_until = NULL,
+	run_at = now()
+WHERE
+	id = $1
+	AND
+	claimed_by = $2
+	AND
+	status = 'running'
+`
+
+// DefaultLeaseDuration is used when Config doesn't set LeaseDuration
+const DefaultLeaseDuration = 5 * time.Minute
+
 type Tracker struct {
 	ID          int
 	Name        string
@@ -104,27 +288,84 @@ type Tracker struct {
 	URL         string
 }
 
-// PerformStats is the statics we give back, when we finish a perform job
+// Job is a job that has been claimed from the queue
+type Job struct {
+	ID       int64
+	Tracker  string
+	Args     []byte
+	Attempts int
+	// RateLimits is how many times in a row the job has been rate limited
+	RateLimits int
+	StartedAt  time.Time
+}
+
+// PerformStats is the statics we give back, when we finish a perform job.
+// The timings are in milliseconds, and are zero when we got no response.
 type PerformStats struct {
-	NodeID string
+	NodeID         string
+	Attempt        int
+	Outcome        string
+	TrackerVersion string `json:",omitempty"`
+	StatusCode     int    `json:",omitempty"`
+	Bytes          int
+
+	DNSMs       float64
+	ConnectMs   float64
+	TLSMs       float64
+	FirstByteMs float64
+	TotalMs     float64
+}
+
+// newPerformStats creates the stats for an attempt at a job
+func newPerformStats(nodeID string, attempt int, res *trackers.Result) *PerformStats {
+	stat := &PerformStats{
+		NodeID:  nodeID,
+		Attempt: attempt,
+		Outcome: trackers.OutcomeError.String(),
+	}
+	if res == nil {
+		return stat
+	}
+
+	ms := func(d time.Duration) float64 { return d.Seconds() * 1000 }
+
+	stat.Outcome = res.Outcome.String()
+	stat.TrackerVersion = res.TrackerVersion
+	stat.StatusCode = res.StatusCode
+	stat.Bytes = len(res.Body)
+	stat.DNSMs = ms(res.Timings.DNS)
+	stat.ConnectMs = ms(res.Timings.Connect)
+	stat.TLSMs = ms(res.Timings.TLS)
+	stat.FirstByteMs = ms(res.Timings.FirstByte)
+	stat.TotalMs = ms(res.Timings.Total)
+	return stat
 }
 
 // Config is used to configure a Store
 type Config struct {
 	NodeID     string
 	ConnString string
+	Retry      RetryPolicy
+
+	// LeaseDuration is how long a node may hold a job before the job is
+	// handed to someone else.
+	LeaseDuration time.Duration
 }
 
 // Store gives the ability to create, get and perform work
 type Store struct {
-	db *sql.DB
-	id string
-
-	prepGetTrackers              *sql.Stmt
-	prepGetJobForUpdateByTracker *sql.Stmt
-	prepGetJobForUpdate          *sql.Stmt
-	prepUpdateJob                *sql.Stmt
-	prepCreateScrapeJob          *sql.Stmt
+	db    *sql.DB
+	id    string
+	retry RetryPolicy
+	lease time.Duration
+
+	prepGetTrackers        *sql.Stmt
+	prepClaimJob           *sql.Stmt
+	prepClaimCampaignJob   *sql.Stmt
+	prepClaimNoCampaignJob *sql.Stmt
+	prepFinishJob          *sql.Stmt
+	prepReapLeases         *sql.Stmt
+	prepCreateScrapeJob    *sql.Stmt
 }
 
 // New creates a new store
@@ -134,21 +375,37 @@ func New(cfg Config) (*Store, error) {
 		return nil, err
 	}
 
+	if err := checkSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	prepGetTrackers, err := db.PrepareContext(context.Background(), sqlGetTrackers)
 	if err != nil {
 		return nil, err
 	}
 
-	prepGetJobForUpdateByTracker, err := db.PrepareContext(context.Background(), sqlGetJobForUpdateByTracker)
+	prepClaimJob, err := db.PrepareContext(context.Background(), sqlClaimJob)
+	if err != nil {
+		return nil, err
+	}
+
+	prepClaimCampaignJob, err := db.PrepareContext(context.Background(), sqlClaimCampaignJob)
 	if err != nil {
 		return nil, err
 	}
-	prepGetJobForUpdate, err := db.PrepareContext(context.Background(), sqlGetJobForUpdate)
+
+	prepClaimNoCampaignJob, err := db.PrepareContext(context.Background(), sqlClaimNoCampaignJob)
 	if err != nil {
 		return nil, err
 	}
 
-	prepUpdateJob, err := db.PrepareContext(context.Background(), sqlUpdateJob)
+	prepFinishJob, err := db.PrepareContext(context.Background(), sqlFinishJob)
+	if err != nil {
+		return nil, err
+	}
+
+	prepReapLeases, err := db.PrepareContext(context.Background(), sqlReapLeases)
 	if err != nil {
 		return nil, err
 	}
@@ -158,15 +415,24 @@ func New(cfg Config) (*Store, error) {
 		return nil, err
 	}
 
-	s := &Store{
-		id: cfg.NodeID,
-		db: db,
+	lease := cfg.LeaseDuration
+	if lease <= 0 {
+		lease = DefaultLeaseDuration
+	}
 
-		prepGetTrackers:              prepGetTrackers,
-		prepGetJobForUpdateByTracker: prepGetJobForUpdateByTracker,
-		prepGetJobForUpdate:          prepGetJobForUpdate,
-		prepUpdateJob:                prepUpdateJob,
-		prepCreateScrapeJob:          prepCreateScrapeJob,
+	s := &Store{
+		id:    cfg.NodeID,
+		db:    db,
+		retry: cfg.Retry,
+		lease: lease,
+
+		prepGetTrackers:        prepGetTrackers,
+		prepClaimJob:           prepClaimJob,
+		prepClaimCampaignJob:   prepClaimCampaignJob,
+		prepClaimNoCampaignJob: prepClaimNoCampaignJob,
+		prepFinishJob:          prepFinishJob,
+		prepReapLeases:         prepReapLeases,
+		prepCreateScrapeJob:    prepCreateScrapeJob,
 	}
 	return s, nil
 }
@@ -175,15 +441,17 @@ func New(cfg Config) (*Store, error) {
 func (s *Store) Close() error {
 	// TODO(rHermes): Report on the multi error that can occur here
 	s.prepGetTrackers.Close()
-	s.prepGetJobForUpdateByTracker.Close()
-	s.prepGetJobForUpdate.Close()
-	s.prepUpdateJob.Close()
+	s.prepClaimJob.Close()
+	s.prepClaimCampaignJob.Close()
+	s.prepClaimNoCampaignJob.Close()
+	s.prepFinishJob.Close()
+	s.prepReapLeases.Close()
 	s.prepCreateScrapeJob.Close()
 	return s.db.Close()
 }
 
-func (s *Store) Trackers() ([]Tracker, error) {
-	rows, err := s.prepGetTrackers.QueryContext(context.Background())
+func (s *Store) Trackers(ctx context.Context) ([]Tracker, error) {
+	rows, err := s.prepGetTrackers.QueryContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -204,142 +472,185 @@ func (s *Store) Trackers() ([]Tracker, error) {
 	return trackers, nil
 }
 
-// InsertJob creates a single job
-func (s *Store) InsertJob(tracker int, args []byte, createdAt time.Time) error {
-	_, err := s.prepCreateScrapeJob.ExecContext(context.Background(), tracker, args, createdAt)
+// InsertJob creates a single job, unless its key is already queued
+func (s *Store) InsertJob(ctx context.Context, tracker int, args []byte, createdAt time.Time) error {
+	ts, err := s.Trackers(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := jobKeys(ts, []int{tracker}, [][]byte{args})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.prepCreateScrapeJob.ExecContext(ctx, tracker, keys[0], args, createdAt)
 	return err
 }
 
-// InsertJobs inserts all the jobs or non of them at all into the queue
-func (s *Store) InsertJobs(tracker []int, args [][]byte, createdAt []time.Time) error {
+// InsertJobs inserts all the jobs or non of them at all into the queue. The
+// jobs are copied into a staging table, and from there into the queue.
+func (s *Store) InsertJobs(ctx context.Context, mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time) (InsertResult, error) {
+	return s.insertJobs(ctx, mode, tracker, args, createdAt, nil, nil)
+}
+
+// insertJobs does the work of InsertJobs, putting the jobs in the campaign c
+// if it isn't nil, and calling then, if it is given, before committing.
+func (s *Store) insertJobs(ctx context.Context, mode InsertMode, tracker []int, args [][]byte, createdAt []time.Time, c *Campaign, then func(tx *sql.Tx) error) (InsertResult, error) {
+	var res InsertResult
+	var campaign sql.NullInt64
+	var priority int
+	if c != nil {
+		campaign, priority = sql.NullInt64{Int64: c.ID, Valid: true}, c.Priority
+	}
 	if len(tracker) != len(args) || len(args) != len(createdAt) {
-		return errors.New("All arrays must be equally long")
+		return res, errors.New("All arrays must be equally long")
 	}
 
-	tx, err := s.db.BeginTx(context.Background(), nil)
+	ts, err := s.Trackers(ctx)
 	if err != nil {
-		return err
+		return res, err
+	}
+	keys, err := jobKeys(ts, tracker, args)
+	if err != nil {
+		return res, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(pq.CopyIn("scrape_jobs", "tracker", "args", "created_at"))
+	if _, err := tx.ExecContext(ctx, sqlCreateStaging); err != nil {
+		return res, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("scrape_jobs_staging", "seq", "tracker", "job_key", "args", "created_at", "campaign_id", "priority"))
 	if err != nil {
-		return err
+		return res, err
 	}
 
 	for i := 0; i < len(tracker); i++ {
-		if i%100 == 0 {
-			log.Printf("On insert %d of %d aka %.2f%%.\n", i, len(tracker), float64(i)/float64(len(tracker))*100)
-		}
-		_, err = stmt.ExecContext(context.Background(), tracker[i], args[i], createdAt[i])
+		_, err = stmt.ExecContext(ctx, i, tracker[i], keys[i], args[i], createdAt[i], campaign, priority)
 		if err != nil {
-			return err
+			return res, err
 		}
 	}
 
-	if _, err := stmt.Exec(); err != nil {
-		return err
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return res, err
 	}
 
 	if err := stmt.Close(); err != nil {
-		return err
+		return res, err
 	}
-	if err := tx.Commit(); err != nil {
-		return err
+
+	if mode == InsertUpdate {
+		r, err := tx.ExecContext(ctx, sqlUpdateFromStaging)
+		if err != nil {
+			return res, err
+		}
+		if res.Updated, err = r.RowsAffected(); err != nil {
+			return res, err
+		}
 	}
-	return err
-}
 
-func (s *Store) PerformJob() error {
-	tx, err := s.db.BeginTx(context.Background(), nil)
+	r, err := tx.ExecContext(ctx, sqlInsertFromStaging)
 	if err != nil {
-		return err
+		return res, err
 	}
-	defer tx.Rollback()
-
-	pGetJobForUpdate := tx.StmtContext(context.Background(), s.prepGetJobForUpdate)
-	pUpdateJob := tx.StmtContext(context.Background(), s.prepUpdateJob)
+	if res.New, err = r.RowsAffected(); err != nil {
+		return res, err
+	}
+	res.Existing = int64(len(tracker)) - res.New
 
-	var id int
-	var tracker int
-	var jargs []byte
+	if then != nil {
+		if err := then(tx); err != nil {
+			return InsertResult{}, err
+		}
+	}
 
-	row := pGetJobForUpdate.QueryRowContext(context.Background())
-	if err := row.Scan(&id, &tracker, &jargs); err != nil {
-		return err
+	if err := tx.Commit(); err != nil {
+		return InsertResult{}, err
 	}
-	startedAt := time.Now()
+	return res, nil
+}
 
-	// TODO(rHermes): This is cheating, I know that it bring has id 1
-	if tracker != 1 {
-		return errors.New("There is not supposed to be an other tracker ids than 1")
+// ClaimJob takes a lease on the next job in the queue for the given tracker
+// and marks it as running. The job must be finished before the lease runs
+// out, or it will be reaped and given to someone else.
+func (s *Store) ClaimJob(ctx context.Context, q Queue) (*Job, error) {
+	job := &Job{StartedAt: time.Now()}
+
+	stmt, args := s.prepClaimJob, []interface{}{s.id, s.lease.Seconds(), job.StartedAt, q.Tracker}
+	switch {
+	case q.Campaign == NoCampaign:
+		stmt = s.prepClaimNoCampaignJob
+	case q.Campaign != 0:
+		stmt, args = s.prepClaimCampaignJob, append(args, q.Campaign)
 	}
 
-	var workargs struct {
-		Q string
+	row := stmt.QueryRowContext(ctx, args...)
+	if err := row.Scan(&job.ID, &job.Tracker, &job.Args, &job.Attempts, &job.RateLimits); err != nil {
+		return nil, err
 	}
-	if err := json.Unmarshal(jargs, &workargs); err != nil {
-		// TODO(rHermes): Fail job here?
+	return job, nil
+}
+
+// FinishJob records the result of performing a claimed job. err is the
+// error we got instead of a result, if any. The job is marked according to
+// the outcome and the retry policy, and the error it failed with is
+// returned, ErrRateLimit if we were rate limited.
+func (s *Store) FinishJob(ctx context.Context, job *Job, res *trackers.Result, err error) error {
+	f, err := finish(s.id, s.retry, job, res, err)
+	if err != nil {
 		return err
 	}
 
-	// TODO(rHermes): Make this into something that can handle proper ids
-	u := "https://tracking.bring.com/api/v2/tracking.json?q=" + workargs.Q
-	log.Printf("We will work on: %s\n", u)
-	resp, err := http.Get(u)
+	completedAt := time.Now()
+	r, err := s.prepFinishJob.ExecContext(ctx, job.ID, s.id, f.status, completedAt, f.stats, f.resp, f.attempts, f.lastError, f.retryIn.Seconds(), f.outcome, f.rateLimits)
 	if err != nil {
-		// Update job here?
-		fmt.Printf("There was an error: %s\n", err.Error())
 		return err
 	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	err2 := resp.Body.Close()
+	n, err := r.RowsAffected()
 	if err != nil {
-		// TODO(rHermes): Fail the query here?
 		return err
 	}
-	if err2 != nil {
-		// TODO(rHermes): Fail the query here?
-		return err2
-	}
-
-	var ape struct {
-		APIVersion     string `json:"apiVersion"`
-		ConsignmentSet []struct {
-			Error struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-			} `json:"error"`
-		} `json:"consignmentSet"`
-	}
-	if err := json.Unmarshal(data, &ape); err == nil {
-		// if code is not zero then it's ok
-		for _, v := range ape.ConsignmentSet {
-			if v.Error.Code != 0 && v.Error.Code != 404 {
-				if v.Error.Code == 503 {
-					return ErrRateLimit
-				}
-			}
-		}
+	if n == 0 {
+		return ErrLeaseLost
 	}
 
-	stat := &PerformStats{NodeID: s.id}
-	statb, err := json.Marshal(stat)
+	return f.err
+}
+
+// ReleaseJob gives a claimed job back to the queue without performing it,
+// for when we are shutting down. It doesn't count as an attempt.
+func (s *Store) ReleaseJob(ctx context.Context, job *Job) error {
+	r, err := s.db.ExecContext(ctx, sqlReleaseJob, job.ID, s.id)
 	if err != nil {
-		// TODO(rHermes): Fail the query here?
 		return err
 	}
-
-	completedAt := time.Now()
-	_, err = pUpdateJob.ExecContext(context.Background(), id, "success", startedAt, completedAt, statb, data)
+	n, err := r.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return err
+// ReapLeases returns jobs whose lease has expired to the queue. This counts
+// as a failed attempt, so a job that keeps killing its nodes ends up dead.
+func (s *Store) ReapLeases(ctx context.Context) (int64, error) {
+	maxAttempts := s.retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
 	}
 
-	return nil
+	res, err := s.prepReapLeases.ExecContext(ctx, maxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
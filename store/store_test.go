@@ -0,0 +1,67 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/store/storetest"
+)
+
+// TestPostgres runs the conformance tests against the database in
+// $PACKTRACK_TEST_CONN. Everything in it is deleted.
+func TestPostgres(t *testing.T) {
+	conn := os.Getenv("PACKTRACK_TEST_CONN")
+	if conn == "" {
+		t.Skip("PACKTRACK_TEST_CONN is not set")
+	}
+
+	m, err := store.NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator: %s", err)
+	}
+	defer m.Close()
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	defer db.Close()
+
+	storetest.Run(t, func(t *testing.T, cfg store.Config) store.JobQueue {
+		if _, err := db.Exec("TRUNCATE scrape_jobs, campaigns RESTART IDENTITY CASCADE"); err != nil {
+			t.Fatalf("emptying the queue: %s", err)
+		}
+
+		cfg.ConnString = conn
+		s, err := store.New(cfg)
+		if err != nil {
+			t.Fatalf("store.New: %s", err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,1462 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package storetest checks that an implementation of store.JobQueue behaves
+// the way the rest of packtrack expects it to.
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+	// The jobs are made for bring, so it must know their keys.
+	_ "github.com/rhermes/packtrack/trackers/bring"
+)
+
+// Factory creates an empty queue with the given config. The queue is closed
+// by the test using it.
+type Factory func(t *testing.T, cfg store.Config) store.JobQueue
+
+// nodeID is the node every queue is created for
+const nodeID = "storetest"
+
+// Run runs the conformance tests against the queues made by newQueue
+func Run(t *testing.T, newQueue Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, newQueue Factory)
+	}{
+		{"EmptyQueue", testEmptyQueue},
+		{"ClaimOrder", testClaimOrder},
+		{"ConcurrentClaims", testConcurrentClaims},
+		{"Success", testSuccess},
+		{"Retry", testRetry},
+		{"RetryDelay", testRetryDelay},
+		{"PermanentFailure", testPermanentFailure},
+		{"Dead", testDead},
+		{"RateLimited", testRateLimited},
+		{"Release", testRelease},
+		{"LeaseLost", testLeaseLost},
+		{"ReapLeases", testReapLeases},
+		{"DeadNode", testDeadNode},
+		{"InsertJobsMismatch", testInsertJobsMismatch},
+		{"InsertSkip", testInsertSkip},
+		{"InsertUpdate", testInsertUpdate},
+		{"Campaign", testCampaign},
+		{"CampaignSource", testCampaignSource},
+		{"CampaignStatus", testCampaignStatus},
+		{"CampaignStatusRunning", testCampaignStatusRunning},
+		{"CampaignProgress", testCampaignProgress},
+		{"Priority", testPriority},
+		{"Scheduler", testScheduler},
+		{"Exploration", testExploration},
+		{"Follows", testFollows},
+		{"Consignments", testConsignments},
+		{"Queries", testQueries},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) { tc.fn(t, newQueue) })
+	}
+}
+
+var (
+	found = &trackers.Result{
+		StatusCode: 200,
+		Body:       []byte(`{"found": true}`),
+		Outcome:    trackers.OutcomeFound,
+	}
+	notFound = &trackers.Result{
+		StatusCode: 200,
+		Body:       []byte(`{}`),
+		Outcome:    trackers.OutcomeNotFound,
+	}
+	rateLimited = &trackers.Result{
+		StatusCode: 429,
+		Body:       []byte(`{}`),
+		Outcome:    trackers.OutcomeRateLimited,
+	}
+	errNetwork = errors.New("connection reset by peer")
+	errArgs    = &trackers.ArgsError{Err: errors.New("no q")}
+)
+
+// setup creates a queue and returns it with the id of the bring tracker
+func setup(t *testing.T, newQueue Factory, cfg store.Config) (store.JobQueue, int) {
+	t.Helper()
+
+	cfg.NodeID = nodeID
+	q := newQueue(t, cfg)
+
+	ts, err := q.Trackers(context.Background())
+	if err != nil {
+		q.Close()
+		t.Fatalf("Trackers: %s", err)
+	}
+	for _, tr := range ts {
+		if tr.Name == "bring" {
+			return q, tr.ID
+		}
+	}
+	q.Close()
+	t.Fatalf("there is no bring tracker in %v", ts)
+	return nil, 0
+}
+
+// insert creates a job for every q
+func insert(t *testing.T, q store.JobQueue, tracker int, qs ...string) {
+	t.Helper()
+	insertMode(t, q, store.InsertSkip, tracker, qs...)
+}
+
+// insertMode creates a job for every q, dealing with existing jobs as mode
+// says.
+func insertMode(t *testing.T, q store.JobQueue, mode store.InsertMode, tracker int, qs ...string) store.InsertResult {
+	t.Helper()
+
+	ids := make([]int, len(qs))
+	args := make([][]byte, len(qs))
+	createdAt := make([]time.Time, len(qs))
+	for i := range qs {
+		ids[i] = tracker
+		args[i] = []byte(fmt.Sprintf(`{"q":"%s"}`, qs[i]))
+		createdAt[i] = time.Now()
+	}
+	res, err := q.InsertJobs(context.Background(), mode, ids, args, createdAt)
+	if err != nil {
+		t.Fatalf("InsertJobs: %s", err)
+	}
+	return res
+}
+
+// claim claims a job, failing if there is none
+func claim(t *testing.T, q store.JobQueue, tracker int) *store.Job {
+	t.Helper()
+
+	job, err := q.ClaimJob(context.Background(), store.Queue{Tracker: tracker})
+	if err != nil {
+		t.Fatalf("ClaimJob: %s", err)
+	}
+	return job
+}
+
+// noClaim fails if there is a job to claim
+func noClaim(t *testing.T, q store.JobQueue, tracker int) {
+	t.Helper()
+
+	job, err := q.ClaimJob(context.Background(), store.Queue{Tracker: tracker})
+	if err != sql.ErrNoRows {
+		t.Fatalf("ClaimJob gave %+v, %v; want sql.ErrNoRows", job, err)
+	}
+}
+
+// claimFrom claims a job from a part of the queue and returns its q,
+// failing if there is none.
+func claimFrom(t *testing.T, q store.JobQueue, from store.Queue) string {
+	t.Helper()
+
+	job, err := q.ClaimJob(context.Background(), from)
+	if err != nil {
+		t.Fatalf("ClaimJob(%+v): %s", from, err)
+	}
+	return jobQ(t, job.Args)
+}
+
+// jobQ returns the q of the args of a job
+func jobQ(t *testing.T, args []byte) string {
+	t.Helper()
+
+	var a struct{ Q string }
+	if err := json.Unmarshal(args, &a); err != nil {
+		t.Fatalf("args %q: %s", args, err)
+	}
+	return a.Q
+}
+
+// info returns what the queue knows about the job with the given id
+func info(t *testing.T, q store.JobQueue, id int64) store.JobInfo {
+	t.Helper()
+
+	jobs, err := q.Jobs(context.Background(), store.JobFilter{AfterID: id - 1, Limit: 1})
+	if err != nil {
+		t.Fatalf("Jobs: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != id {
+		t.Fatalf("Jobs gave %+v, want job %d", jobs, id)
+	}
+	return jobs[0]
+}
+
+// sameJSON fails unless a and b are the same JSON value
+func sameJSON(t *testing.T, a, b []byte) {
+	t.Helper()
+
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("%q: %s", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("%q: %s", b, err)
+	}
+	if !reflect.DeepEqual(va, vb) {
+		t.Fatalf("got %s, want %s", a, b)
+	}
+}
+
+func testEmptyQueue(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	noClaim(t, q, bring)
+}
+
+func testClaimOrder(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	insert(t, q, bring, "a", "b", "c")
+	for _, want := range []string{"a", "b", "c"} {
+		job := claim(t, q, bring)
+		if got := jobQ(t, job.Args); got != want {
+			t.Fatalf("claimed %q, want %q", got, want)
+		}
+		if job.Tracker != "bring" || job.Attempts != 0 {
+			t.Fatalf("claimed %+v, want a fresh bring job", job)
+		}
+		if s := info(t, q, job.ID).Status; s != store.StatusRunning {
+			t.Fatalf("claimed job is %s, want %s", s, store.StatusRunning)
+		}
+	}
+	noClaim(t, q, bring)
+}
+
+func testConcurrentClaims(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	const jobs = 50
+	qs := make([]string, jobs)
+	for i := range qs {
+		qs[i] = fmt.Sprint(i)
+	}
+	insert(t, q, bring, qs...)
+
+	var mu sync.Mutex
+	claimed := make(map[int64]int)
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := q.ClaimJob(context.Background(), store.Queue{Tracker: bring})
+				if err == sql.ErrNoRows {
+					return
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("ClaimJob: %s", err)
+	}
+	if len(claimed) != jobs {
+		t.Fatalf("claimed %d jobs, want %d", len(claimed), jobs)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Fatalf("job %d was claimed %d times", id, n)
+		}
+	}
+}
+
+func testSuccess(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	if err := q.FinishJob(context.Background(), job, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+
+	j := info(t, q, job.ID)
+	if j.Status != store.StatusSuccess || j.Attempts != 0 || j.ClaimedBy != "" || j.EndTime.IsZero() {
+		t.Fatalf("finished job is %+v", j)
+	}
+
+	var stats store.PerformStats
+	if err := json.Unmarshal(j.Stats, &stats); err != nil {
+		t.Fatalf("stats %q: %s", j.Stats, err)
+	}
+	if stats.NodeID != nodeID || stats.Attempt != 1 || stats.Outcome != "found" || stats.StatusCode != 200 {
+		t.Fatalf("stats are %+v", stats)
+	}
+	noClaim(t, q, bring)
+}
+
+func testRetry(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{
+		Retry: store.RetryPolicy{BaseDelay: time.Millisecond},
+	})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	if err := q.FinishJob(context.Background(), job, nil, errNetwork); err != errNetwork {
+		t.Fatalf("FinishJob gave %v, want %v", err, errNetwork)
+	}
+
+	j := info(t, q, job.ID)
+	if j.Status != store.StatusRetry || j.Attempts != 1 || j.LastError != errNetwork.Error() {
+		t.Fatalf("failed job is %+v", j)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	again := claim(t, q, bring)
+	if again.ID != job.ID || again.Attempts != 1 {
+		t.Fatalf("claimed %+v, want job %d with 1 attempt", again, job.ID)
+	}
+}
+
+func testRetryDelay(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	q.FinishJob(context.Background(), job, nil, errNetwork)
+
+	if j := info(t, q, job.ID); !j.RunAt.After(time.Now()) {
+		t.Fatalf("job is to run at %s, which is not in the future", j.RunAt)
+	}
+	noClaim(t, q, bring)
+}
+
+func testPermanentFailure(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{
+		Retry: store.RetryPolicy{BaseDelay: time.Millisecond},
+	})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	if err := q.FinishJob(context.Background(), job, nil, errArgs); err != errArgs {
+		t.Fatalf("FinishJob gave %v, want %v", err, errArgs)
+	}
+
+	if j := info(t, q, job.ID); j.Status != store.StatusFailed || j.Attempts != 1 {
+		t.Fatalf("failed job is %+v", j)
+	}
+	time.Sleep(50 * time.Millisecond)
+	noClaim(t, q, bring)
+}
+
+func testDead(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{
+		Retry: store.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+	})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	for i := 0; i < 2; i++ {
+		job := claim(t, q, bring)
+		q.FinishJob(context.Background(), job, nil, errNetwork)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	jobs, err := q.Jobs(context.Background(), store.JobFilter{})
+	if err != nil {
+		t.Fatalf("Jobs: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].Status != store.StatusDead || jobs[0].Attempts != 2 {
+		t.Fatalf("jobs are %+v, want a single dead one", jobs)
+	}
+	noClaim(t, q, bring)
+}
+
+func testRateLimited(t *testing.T, newQueue Factory) {
+	const delay = 40 * time.Millisecond
+	q, bring := setup(t, newQueue, store.Config{
+		Retry: store.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, RateLimitDelay: delay},
+	})
+	defer q.Close()
+
+	// Every time in a row the job is rate limited doubles the delay, but
+	// it never counts as an attempt, so it doesn't die of it.
+	insert(t, q, bring, "a")
+	d := delay
+	for i := 0; i < 3; i++ {
+		job := claim(t, q, bring)
+		if job.RateLimits != i {
+			t.Fatalf("claimed %+v, want it rate limited %d times", job, i)
+		}
+		if err := q.FinishJob(context.Background(), job, rateLimited, nil); err != store.ErrRateLimit {
+			t.Fatalf("FinishJob gave %v, want %v", err, store.ErrRateLimit)
+		}
+
+		j := info(t, q, job.ID)
+		if j.Status != store.StatusRetry || j.Attempts != 0 {
+			t.Fatalf("rate limited job is %+v, want it retried without counting the attempt", j)
+		}
+		// The delay has jitter, taking it down to half.
+		if in := j.RunAt.Sub(j.EndTime); in < d/2-5*time.Millisecond || in > d+time.Second {
+			t.Fatalf("job rate limited %d times is retried in %s, want between %s and %s", i+1, in, d/2, d)
+		}
+		time.Sleep(d)
+		d *= 2
+	}
+
+	// Anything else ends the run of rate limits.
+	job := claim(t, q, bring)
+	q.FinishJob(context.Background(), job, nil, errNetwork)
+	time.Sleep(50 * time.Millisecond)
+	if again := claim(t, q, bring); again.Attempts != 1 || again.RateLimits != 0 {
+		t.Fatalf("claimed %+v, want it with 1 attempt and no rate limits", again)
+	}
+}
+
+func testRelease(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{
+		Retry: store.RetryPolicy{BaseDelay: time.Millisecond},
+	})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	if err := q.ReleaseJob(context.Background(), job); err != nil {
+		t.Fatalf("ReleaseJob: %s", err)
+	}
+	if j := info(t, q, job.ID); j.Status != store.StatusCreated || j.Attempts != 0 || j.ClaimedBy != "" {
+		t.Fatalf("released job is %+v", j)
+	}
+	if err := q.ReleaseJob(context.Background(), job); err != store.ErrLeaseLost {
+		t.Fatalf("releasing twice gave %v, want %v", err, store.ErrLeaseLost)
+	}
+
+	// A job that has been tried before goes back to being retried.
+	job = claim(t, q, bring)
+	q.FinishJob(context.Background(), job, nil, errNetwork)
+	time.Sleep(50 * time.Millisecond)
+	job = claim(t, q, bring)
+	if err := q.ReleaseJob(context.Background(), job); err != nil {
+		t.Fatalf("ReleaseJob: %s", err)
+	}
+	if j := info(t, q, job.ID); j.Status != store.StatusRetry || j.Attempts != 1 {
+		t.Fatalf("released job is %+v", j)
+	}
+	claim(t, q, bring)
+}
+
+func testLeaseLost(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	if err := q.FinishJob(context.Background(), job, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+	if err := q.FinishJob(context.Background(), job, found, nil); err != store.ErrLeaseLost {
+		t.Fatalf("finishing twice gave %v, want %v", err, store.ErrLeaseLost)
+	}
+}
+
+func testReapLeases(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{LeaseDuration: time.Millisecond})
+	defer q.Close()
+
+	insert(t, q, bring, "a")
+	job := claim(t, q, bring)
+	time.Sleep(50 * time.Millisecond)
+
+	n, err := q.ReapLeases(context.Background())
+	if err != nil {
+		t.Fatalf("ReapLeases: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("reaped %d leases, want 1", n)
+	}
+
+	j := info(t, q, job.ID)
+	if j.Status != store.StatusRetry || j.Attempts != 1 || !strings.Contains(j.LastError, nodeID) {
+		t.Fatalf("reaped job is %+v", j)
+	}
+	if err := q.FinishJob(context.Background(), job, found, nil); err != store.ErrLeaseLost {
+		t.Fatalf("finishing a reaped job gave %v, want %v", err, store.ErrLeaseLost)
+	}
+
+	// Leases that haven't run out are left alone.
+	q2, bring := setup(t, newQueue, store.Config{})
+	defer q2.Close()
+
+	insert(t, q2, bring, "b")
+	claim(t, q2, bring)
+	if n, err := q2.ReapLeases(context.Background()); err != nil || n != 0 {
+		t.Fatalf("ReapLeases gave %d, %v; want 0", n, err)
+	}
+}
+
+func testDeadNode(t *testing.T, newQueue Factory) {
+	q, _ := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	nr, ok := q.(store.NodeRegistry)
+	if !ok {
+		t.Skip("the queue doesn't keep track of nodes")
+	}
+	if err := nr.RegisterNode(ctx, &store.Node{Version: "test", Hostname: "localhost", Workers: 1}); err != nil {
+		t.Fatalf("RegisterNode: %s", err)
+	}
+	if err := nr.Heartbeat(ctx, &store.Node{Workers: 1}); err != nil {
+		t.Fatalf("Heartbeat: %s", err)
+	}
+
+	// Every heartbeat is too old with a negative timeout.
+	if nodes, _, err := nr.ReapDeadNodes(ctx, -time.Hour); err != nil || nodes != 1 {
+		t.Fatalf("ReapDeadNodes gave %d, %v; want 1 node", nodes, err)
+	}
+	if err := nr.Heartbeat(ctx, &store.Node{Workers: 1}); err != store.ErrNodeDead {
+		t.Fatalf("Heartbeat of a dead node gave %v, want ErrNodeDead", err)
+	}
+
+	if err := nr.RegisterNode(ctx, &store.Node{Version: "test", Hostname: "localhost", Workers: 1}); err != nil {
+		t.Fatalf("RegisterNode: %s", err)
+	}
+	if err := nr.Heartbeat(ctx, &store.Node{Workers: 1}); err != nil {
+		t.Fatalf("Heartbeat after registering again: %s", err)
+	}
+}
+
+func testInsertJobsMismatch(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	_, err := q.InsertJobs(context.Background(), store.InsertSkip, []int{bring, bring}, [][]byte{[]byte(`{"q":"a"}`)}, []time.Time{time.Now()})
+	if err == nil {
+		t.Fatalf("InsertJobs with arrays of different lengths succeeded")
+	}
+	noClaim(t, q, bring)
+}
+
+func testInsertSkip(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	res := insertMode(t, q, store.InsertSkip, bring, "a", "b", "a")
+	if want := (store.InsertResult{New: 2, Existing: 1}); res != want {
+		t.Fatalf("inserting a, b, a gave %+v, want %+v", res, want)
+	}
+
+	job := claim(t, q, bring)
+	if err := q.FinishJob(context.Background(), job, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+
+	res = insertMode(t, q, store.InsertSkip, bring, "c", "b", "a")
+	if want := (store.InsertResult{New: 1, Existing: 2}); res != want {
+		t.Fatalf("inserting c, b, a gave %+v, want %+v", res, want)
+	}
+
+	// The jobs are claimed in the order they were first given.
+	for _, want := range []string{"b", "c"} {
+		if got := jobQ(t, claim(t, q, bring).Args); got != want {
+			t.Fatalf("claimed %q, want %q", got, want)
+		}
+	}
+	noClaim(t, q, bring)
+
+	if j := info(t, q, job.ID); j.Status != store.StatusSuccess {
+		t.Fatalf("skipped job is %+v, want it left alone", j)
+	}
+}
+
+func testInsertUpdate(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+
+	insert(t, q, bring, "a", "b", "c")
+	done := claim(t, q, bring)
+	if err := q.FinishJob(context.Background(), done, nil, errNetwork); err != errNetwork {
+		t.Fatalf("FinishJob gave %v, want %v", err, errNetwork)
+	}
+	running := claim(t, q, bring)
+
+	res := insertMode(t, q, store.InsertUpdate, bring, "a", "b", "d")
+	if want := (store.InsertResult{New: 1, Existing: 2, Updated: 1}); res != want {
+		t.Fatalf("updating a, b, d gave %+v, want %+v", res, want)
+	}
+
+	if j := info(t, q, done.ID); j.Status != store.StatusCreated || j.Attempts != 0 || j.LastError != "" {
+		t.Fatalf("updated job is %+v, want it queued again", j)
+	}
+	if j := info(t, q, running.ID); j.Status != store.StatusRunning {
+		t.Fatalf("running job is %+v, want it left alone", j)
+	}
+	again := claim(t, q, bring)
+	if again.ID != done.ID {
+		t.Fatalf("claimed job %d, want the updated job %d", again.ID, done.ID)
+	}
+
+	// The response of the last time it was performed goes with it.
+	if err := q.FinishJob(context.Background(), again, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+	insertMode(t, q, store.InsertUpdate, bring, "a")
+	err := q.ExportJobs(context.Background(), store.JobFilter{AfterID: done.ID - 1, Limit: 1}, func(j *store.JobInfo) error {
+		if j.ID != done.ID || j.Status != store.StatusCreated || j.Outcome != "" || j.Resp != nil {
+			t.Errorf("updated job is %+v, want it without the old response", j)
+		}
+		sameJSON(t, j.Stats, []byte(`{}`))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ExportJobs: %s", err)
+	}
+}
+
+func testQueries(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	insert(t, q, bring, "a", "b", "c", "d", "e")
+	var done []int64
+	for i := 0; i < 2; i++ {
+		job := claim(t, q, bring)
+		if err := q.FinishJob(ctx, job, found, nil); err != nil {
+			t.Fatalf("FinishJob: %s", err)
+		}
+		done = append(done, job.ID)
+	}
+
+	counts, err := q.JobCounts(ctx)
+	if err != nil {
+		t.Fatalf("JobCounts: %s", err)
+	}
+	want := []store.JobCount{
+		{Tracker: "bring", Status: store.StatusCreated, N: 3},
+		{Tracker: "bring", Status: store.StatusSuccess, N: 2},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("JobCounts gave %+v, want %+v", counts, want)
+	}
+
+	jobs, err := q.Jobs(ctx, store.JobFilter{Status: store.StatusSuccess})
+	if err != nil {
+		t.Fatalf("Jobs: %s", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != done[0] || jobs[1].ID != done[1] {
+		t.Fatalf("Jobs gave %+v, want jobs %v", jobs, done)
+	}
+	for _, j := range jobs {
+		if j.Resp != nil {
+			t.Fatalf("Jobs gave job %d with a response", j.ID)
+		}
+	}
+
+	for outcome, want := range map[trackers.Outcome]int{trackers.OutcomeFound: 2, trackers.OutcomeNotFound: 0} {
+		jobs, err := q.Jobs(ctx, store.JobFilter{Outcome: outcome.String()})
+		if err != nil {
+			t.Fatalf("Jobs: %s", err)
+		}
+		if len(jobs) != want {
+			t.Fatalf("Jobs with outcome %s gave %+v, want %d jobs", outcome, jobs, want)
+		}
+	}
+	n := 0
+	err = q.ExportJobs(ctx, store.JobFilter{Outcome: trackers.OutcomeFound.String()}, func(j *store.JobInfo) error {
+		if j.Outcome != trackers.OutcomeFound.String() {
+			t.Errorf("exported job %+v with outcome %s", j, trackers.OutcomeFound)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("ExportJobs with outcome %s gave %v after %d jobs, want 2", trackers.OutcomeFound, err, n)
+	}
+
+	jobs, err = q.Jobs(ctx, store.JobFilter{Tracker: bring, AfterID: done[0], Limit: 2})
+	if err != nil {
+		t.Fatalf("Jobs: %s", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != done[1] || jobs[1].ID <= done[1] {
+		t.Fatalf("Jobs after %d gave %+v", done[0], jobs)
+	}
+
+	var exported []store.JobInfo
+	err = q.ExportJobs(ctx, store.JobFilter{}, func(j *store.JobInfo) error {
+		exported = append(exported, *j)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ExportJobs: %s", err)
+	}
+	if len(exported) != 5 {
+		t.Fatalf("exported %d jobs, want 5", len(exported))
+	}
+	for i, j := range exported {
+		if i > 0 && j.ID <= exported[i-1].ID {
+			t.Fatalf("exported jobs out of order: %d after %d", j.ID, exported[i-1].ID)
+		}
+		if j.Status == store.StatusSuccess {
+			sameJSON(t, j.Resp, found.Body)
+		} else if j.Resp != nil {
+			t.Fatalf("exported job %d without a result has response %q", j.ID, j.Resp)
+		}
+	}
+
+	errStop := errors.New("stop")
+	n = 0
+	err = q.ExportJobs(ctx, store.JobFilter{}, func(j *store.JobInfo) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatalf("ExportJobs gave %v after %d jobs, want it to stop after the first", err, n)
+	}
+}
+
+// createCampaign creates a campaign for the ids [start, end)
+func createCampaign(t *testing.T, q store.JobQueue, tracker int, name string, start, end int64) *store.Campaign {
+	t.Helper()
+
+	c := &store.Campaign{
+		Name:        name,
+		TrackerID:   tracker,
+		Description: "made by storetest",
+		RangeStart:  start,
+		RangeEnd:    end,
+		CreatedBy:   nodeID,
+	}
+	if err := q.CreateCampaign(context.Background(), c); err != nil {
+		t.Fatalf("CreateCampaign: %s", err)
+	}
+	return c
+}
+
+// enqueue enqueues the ids [c.Next, next) of the campaign
+func enqueue(q store.JobQueue, c *store.Campaign, next int64) (store.InsertResult, error) {
+	var args [][]byte
+	var createdAt []time.Time
+	for i := c.Next; i < next; i++ {
+		args = append(args, []byte(fmt.Sprintf(`{"q":"%d"}`, i)))
+		createdAt = append(createdAt, time.Now())
+	}
+	return q.InsertCampaignJobs(context.Background(), c, store.InsertSkip, args, createdAt, next)
+}
+
+// progress returns how far the campaign has come
+func progress(t *testing.T, q store.JobQueue, c *store.Campaign) *store.CampaignProgress {
+	t.Helper()
+
+	p, err := q.CampaignProgress(context.Background(), c)
+	if err != nil {
+		t.Fatalf("CampaignProgress: %s", err)
+	}
+	return p
+}
+
+func testCampaign(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	c := createCampaign(t, q, bring, "first", 10, 20)
+	if c.ID == 0 || c.Tracker != "bring" || c.Status != store.CampaignActive || c.Next != 10 || c.Finished() {
+		t.Fatalf("created %+v, want a fresh campaign for [10, 20)", c)
+	}
+	if err := q.CreateCampaign(ctx, &store.Campaign{Name: "first", TrackerID: bring, RangeStart: 1, RangeEnd: 2}); err == nil {
+		t.Fatalf("created a second campaign with the same name")
+	}
+	if err := q.CreateCampaign(ctx, &store.Campaign{Name: "backwards", TrackerID: bring, RangeStart: 2, RangeEnd: 1}); err == nil {
+		t.Fatalf("created a campaign with an empty range")
+	}
+	generated := &store.Campaign{Name: "generated", TrackerID: bring, RangeStart: 0, RangeEnd: 10, Generator: "s10:CS:NO"}
+	if err := q.CreateCampaign(ctx, generated); err != nil {
+		t.Fatalf("CreateCampaign: %s", err)
+	}
+	if again, err := q.Campaign(ctx, "generated"); err != nil || again.Generator != "s10:CS:NO" {
+		t.Fatalf("looked up %+v, %v; want a campaign with generator s10:CS:NO", again, err)
+	}
+
+	if res, err := enqueue(q, c, 15); err != nil || res.New != 5 {
+		t.Fatalf("first chunk gave %+v, %v; want 5 new jobs", res, err)
+	}
+	if c.Next != 15 {
+		t.Fatalf("campaign is at %d after the first chunk, want 15", c.Next)
+	}
+
+	// Looking the campaign up again picks up where we left off.
+	again, err := q.Campaign(ctx, "first")
+	if err != nil {
+		t.Fatalf("Campaign: %s", err)
+	}
+	if again.ID != c.ID || again.Next != 15 || again.Description != "made by storetest" || again.CreatedBy != nodeID {
+		t.Fatalf("looked up %+v, want campaign %d at 15", again, c.ID)
+	}
+	if _, err := q.Campaign(ctx, "missing"); err != sql.ErrNoRows {
+		t.Fatalf("looking up a missing campaign gave %v, want sql.ErrNoRows", err)
+	}
+
+	// Only one of two copies of the campaign can move it on.
+	stale := *again
+	if res, err := enqueue(q, again, 20); err != nil || res.New != 5 {
+		t.Fatalf("last chunk gave %+v, %v; want 5 new jobs", res, err)
+	}
+	if !again.Finished() || again.Next != 20 {
+		t.Fatalf("campaign is %+v after the last chunk, want it finished", again)
+	}
+	if _, err := enqueue(q, &stale, 20); err != store.ErrCampaignChanged {
+		t.Fatalf("moving on a stale campaign gave %v, want %v", err, store.ErrCampaignChanged)
+	}
+
+	// Ids already queued by another campaign stay with it.
+	other := createCampaign(t, q, bring, "overlapping", 18, 22)
+	if res, err := enqueue(q, other, 22); err != nil || res.New != 2 || res.Existing != 2 {
+		t.Fatalf("enqueueing an overlapping range gave %+v, %v; want 2 new and 2 existing jobs", res, err)
+	}
+
+	campaigns, err := q.Campaigns(ctx)
+	if err != nil {
+		t.Fatalf("Campaigns: %s", err)
+	}
+	if len(campaigns) != 3 || campaigns[0].Name != "first" || campaigns[1].Name != "generated" || campaigns[2].Name != "overlapping" {
+		t.Fatalf("Campaigns gave %+v, want first, generated and overlapping", campaigns)
+	}
+	if p := progress(t, q, c); p.Jobs != 10 || p.Waiting != 10 {
+		t.Fatalf("first campaign has %+v, want 10 waiting jobs", p)
+	}
+	if p := progress(t, q, other); p.Jobs != 2 || p.Waiting != 2 {
+		t.Fatalf("overlapping campaign has %+v, want 2 waiting jobs", p)
+	}
+}
+
+func testCampaignSource(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	if err := q.CreateCampaign(ctx, &store.Campaign{Name: "both", TrackerID: bring, RangeStart: 1, RangeEnd: 2, Source: "ids.txt"}); err == nil {
+		t.Fatalf("created a campaign with both a range and a source")
+	}
+	if err := q.CreateCampaign(ctx, &store.Campaign{Name: "both", TrackerID: bring, Source: "ids.txt", Generator: "s10:CS:NO"}); err == nil {
+		t.Fatalf("created a campaign with both a source and a generator")
+	}
+	c := &store.Campaign{Name: "file", TrackerID: bring, Source: "ids.txt"}
+	if err := q.CreateCampaign(ctx, c); err != nil {
+		t.Fatalf("CreateCampaign: %s", err)
+	}
+	if c.Source != "ids.txt" || c.Next != 0 || c.Finished() {
+		t.Fatalf("created %+v, want a fresh campaign reading ids.txt", c)
+	}
+
+	// Enqueueing from a source never finishes the campaign by itself.
+	if res, err := enqueue(q, c, 3); err != nil || res.New != 3 {
+		t.Fatalf("enqueueing gave %+v, %v; want 3 new jobs", res, err)
+	}
+	if c.Next != 3 || c.Finished() {
+		t.Fatalf("campaign is %+v after enqueueing, want it at 3 and unfinished", c)
+	}
+
+	stale := *c
+	stale.Next = 0
+	if err := q.FinishCampaign(ctx, &stale); err != store.ErrCampaignChanged {
+		t.Fatalf("finishing a stale campaign gave %v, want %v", err, store.ErrCampaignChanged)
+	}
+	if err := q.FinishCampaign(ctx, c); err != nil {
+		t.Fatalf("FinishCampaign: %s", err)
+	}
+	if !c.Finished() || c.Next != 3 {
+		t.Fatalf("campaign is %+v after finishing, want it finished at 3", c)
+	}
+	if err := q.FinishCampaign(ctx, c); err != store.ErrCampaignChanged {
+		t.Fatalf("finishing twice gave %v, want %v", err, store.ErrCampaignChanged)
+	}
+	if p := progress(t, q, c); p.Jobs != 3 || p.Waiting != 3 || p.Percent() != 0 {
+		t.Fatalf("campaign has %+v, want 3 waiting jobs", p)
+	}
+}
+
+func testCampaignStatus(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	c := createCampaign(t, q, bring, "paused", 0, 10)
+	if _, err := enqueue(q, c, 5); err != nil {
+		t.Fatalf("enqueueing: %s", err)
+	}
+	running := claim(t, q, bring)
+	failed := claim(t, q, bring)
+	if err := q.FinishJob(ctx, failed, nil, errNetwork); err != errNetwork {
+		t.Fatalf("FinishJob gave %v, want %v", err, errNetwork)
+	}
+
+	// Pausing takes the waiting jobs, retries too, out of the queue.
+	if n, err := q.SetCampaignStatus(ctx, c, store.CampaignPaused); err != nil || n != 4 {
+		t.Fatalf("pausing gave %d, %v; want 4 jobs paused", n, err)
+	}
+	noClaim(t, q, bring)
+	if _, err := enqueue(q, c, 10); err == nil {
+		t.Fatalf("enqueued jobs for a paused campaign")
+	}
+	if s := info(t, q, running.ID).Status; s != store.StatusRunning {
+		t.Fatalf("running job is %s after pausing, want it left alone", s)
+	}
+	if p := progress(t, q, c); p.Paused != 4 || p.Running != 1 || p.ETA() != 0 {
+		t.Fatalf("paused campaign has %+v, want 4 paused and 1 running job", p)
+	}
+
+	// Resuming puts them back the way they were.
+	if n, err := q.SetCampaignStatus(ctx, c, store.CampaignActive); err != nil || n != 4 {
+		t.Fatalf("resuming gave %d, %v; want 4 jobs resumed", n, err)
+	}
+	if j := info(t, q, failed.ID); j.Status != store.StatusRetry || j.Attempts != 1 {
+		t.Fatalf("failed job is %+v after resuming, want it back in retry", j)
+	}
+	claim(t, q, bring)
+
+	// Cancelling is for good.
+	if n, err := q.SetCampaignStatus(ctx, c, store.CampaignCancelled); err != nil || n != 3 {
+		t.Fatalf("cancelling gave %d, %v; want 3 jobs cancelled", n, err)
+	}
+	if _, err := q.SetCampaignStatus(ctx, c, store.CampaignActive); err != store.ErrCampaignCancelled {
+		t.Fatalf("resuming a cancelled campaign gave %v, want %v", err, store.ErrCampaignCancelled)
+	}
+	if _, err := enqueue(q, c, 10); err != store.ErrCampaignCancelled {
+		t.Fatalf("enqueueing for a cancelled campaign gave %v, want %v", err, store.ErrCampaignCancelled)
+	}
+	if p := progress(t, q, c); p.Cancelled != 3 || p.Running != 2 {
+		t.Fatalf("cancelled campaign has %+v, want 3 cancelled and 2 running jobs", p)
+	}
+}
+
+// Jobs that were running when their campaign was paused or cancelled follow
+// it once they are done running, instead of waiting in retry.
+func testCampaignStatusRunning(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{LeaseDuration: time.Millisecond})
+	defer q.Close()
+	ctx := context.Background()
+
+	c := createCampaign(t, q, bring, "stopped", 0, 10)
+	if _, err := enqueue(q, c, 4); err != nil {
+		t.Fatalf("enqueueing: %s", err)
+	}
+	failed, released, reaped := claim(t, q, bring), claim(t, q, bring), claim(t, q, bring)
+
+	if n, err := q.SetCampaignStatus(ctx, c, store.CampaignPaused); err != nil || n != 1 {
+		t.Fatalf("pausing gave %d, %v; want 1 job paused", n, err)
+	}
+	if err := q.FinishJob(ctx, failed, nil, errNetwork); err != errNetwork {
+		t.Fatalf("FinishJob gave %v, want %v", err, errNetwork)
+	}
+	if j := info(t, q, failed.ID); j.Status != store.StatusPaused || j.Attempts != 1 {
+		t.Fatalf("job failing in a paused campaign is %+v, want it paused", j)
+	}
+	if err := q.ReleaseJob(ctx, released); err != nil {
+		t.Fatalf("ReleaseJob: %s", err)
+	}
+	if s := info(t, q, released.ID).Status; s != store.StatusPaused {
+		t.Fatalf("job released in a paused campaign is %s, want it paused", s)
+	}
+
+	if n, err := q.SetCampaignStatus(ctx, c, store.CampaignActive); err != nil || n != 3 {
+		t.Fatalf("resuming gave %d, %v; want 3 jobs resumed", n, err)
+	}
+	if j := info(t, q, failed.ID); j.Status != store.StatusRetry {
+		t.Fatalf("failed job is %+v after resuming, want it back in retry", j)
+	}
+
+	if n, err := q.SetCampaignStatus(ctx, c, store.CampaignCancelled); err != nil || n != 3 {
+		t.Fatalf("cancelling gave %d, %v; want 3 jobs cancelled", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, err := q.ReapLeases(ctx); err != nil || n != 1 {
+		t.Fatalf("ReapLeases gave %d, %v; want 1", n, err)
+	}
+	if j := info(t, q, reaped.ID); j.Status != store.StatusCancelled || j.Attempts != 1 {
+		t.Fatalf("job reaped in a cancelled campaign is %+v, want it cancelled", j)
+	}
+	if p := progress(t, q, c); p.Cancelled != 4 || p.Running != 0 {
+		t.Fatalf("cancelled campaign has %+v, want all 4 jobs cancelled", p)
+	}
+}
+
+func testCampaignProgress(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	c := createCampaign(t, q, bring, "progress", 0, 10)
+	if _, err := enqueue(q, c, 4); err != nil {
+		t.Fatalf("enqueueing: %s", err)
+	}
+
+	for _, res := range []*trackers.Result{found, notFound} {
+		if err := q.FinishJob(ctx, claim(t, q, bring), res, nil); err != nil {
+			t.Fatalf("FinishJob: %s", err)
+		}
+	}
+	if err := q.FinishJob(ctx, claim(t, q, bring), nil, errArgs); err != errArgs {
+		t.Fatalf("FinishJob gave %v, want %v", err, errArgs)
+	}
+
+	p := progress(t, q, c)
+	want := store.CampaignProgress{Campaign: *c, Jobs: 4, Waiting: 1, Done: 2, Failed: 1, Hits: 1, FinishedLastHour: 3}
+	if !reflect.DeepEqual(*p, want) {
+		t.Fatalf("progress is %+v, want %+v", *p, want)
+	}
+
+	// The ids that aren't enqueued yet are still to come.
+	if got := p.Percent(); got != 30 {
+		t.Fatalf("percent done is %f, want 30", got)
+	}
+	if got := p.HitRate(); got != 0.5 {
+		t.Fatalf("hit rate is %f, want 0.5", got)
+	}
+	if got := p.ETA(); got != 140*time.Minute {
+		t.Fatalf("ETA is %s, want 2h20m", got)
+	}
+}
+
+func testPriority(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	insert(t, q, bring, "a", "b")
+	urgent := &store.Campaign{Name: "urgent", TrackerID: bring, RangeStart: 100, RangeEnd: 102, Priority: 5}
+	if err := q.CreateCampaign(ctx, urgent); err != nil {
+		t.Fatalf("CreateCampaign: %s", err)
+	}
+	if urgent.Weight != 1 || urgent.Priority != 5 {
+		t.Fatalf("created %+v, want weight 1 and priority 5", urgent)
+	}
+	later := createCampaign(t, q, bring, "later", 200, 203)
+	for _, c := range []*store.Campaign{urgent, later} {
+		if _, err := enqueue(q, c, c.RangeEnd); err != nil {
+			t.Fatalf("enqueueing %s: %s", c.Name, err)
+		}
+	}
+
+	// A part of the queue only gives its own jobs.
+	if got := claimFrom(t, q, store.Queue{Tracker: bring, Campaign: later.ID}); got != "200" {
+		t.Fatalf("claimed %q from the later campaign, want 200", got)
+	}
+	if got := claimFrom(t, q, store.Queue{Tracker: bring, Campaign: store.NoCampaign}); got != "a" {
+		t.Fatalf("claimed %q from outside the campaigns, want a", got)
+	}
+
+	// The whole queue gives the jobs with the highest priority first.
+	for _, want := range []string{"100", "101"} {
+		if got := claimFrom(t, q, store.Queue{Tracker: bring}); got != want {
+			t.Fatalf("claimed %q, want %q", got, want)
+		}
+	}
+
+	if _, err := q.SetCampaignSchedule(ctx, later, -1, 0); err == nil {
+		t.Fatalf("set a negative weight")
+	}
+	if n, err := q.SetCampaignSchedule(ctx, later, 3, 10); err != nil || n != 2 {
+		t.Fatalf("SetCampaignSchedule gave %d, %v; want 2 jobs changed", n, err)
+	}
+	if later.Weight != 3 || later.Priority != 10 {
+		t.Fatalf("campaign is %+v after SetCampaignSchedule, want weight 3 and priority 10", later)
+	}
+	for _, want := range []string{"201", "202", "b"} {
+		job := claim(t, q, bring)
+		if got := jobQ(t, job.Args); got != want {
+			t.Fatalf("claimed %q, want %q", got, want)
+		}
+		if p := info(t, q, job.ID).Priority; want != "b" && p != 10 {
+			t.Fatalf("job %s has priority %d, want 10", want, p)
+		}
+	}
+	noClaim(t, q, bring)
+}
+
+func testScheduler(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	insert(t, q, bring, "a", "b", "c", "d")
+	urgent := &store.Campaign{Name: "urgent", TrackerID: bring, RangeStart: 500, RangeEnd: 502, Priority: 1}
+	heavy := &store.Campaign{Name: "heavy", TrackerID: bring, RangeStart: 0, RangeEnd: 8, Weight: 2}
+	light := &store.Campaign{Name: "light", TrackerID: bring, RangeStart: 100, RangeEnd: 104}
+	for _, c := range []*store.Campaign{urgent, heavy, light} {
+		if err := q.CreateCampaign(ctx, c); err != nil {
+			t.Fatalf("CreateCampaign: %s", err)
+		}
+		if _, err := enqueue(q, c, c.RangeEnd); err != nil {
+			t.Fatalf("enqueueing %s: %s", c.Name, err)
+		}
+	}
+
+	s := store.NewScheduler(q, map[int]int{bring: 1}, time.Hour)
+	next := func() string {
+		t.Helper()
+		job, err := s.ClaimJob(ctx, nil)
+		if err != nil {
+			t.Fatalf("Scheduler.ClaimJob: %s", err)
+		}
+		q := jobQ(t, job.Args)
+		switch {
+		case strings.HasPrefix(q, "50"):
+			return "urgent"
+		case strings.HasPrefix(q, "10"):
+			return "light"
+		case len(q) == 1 && q[0] >= '0' && q[0] <= '9':
+			return "heavy"
+		}
+		return "none"
+	}
+
+	// The urgent campaign goes first, and then the rest share by weight,
+	// with the jobs outside any campaign having a weight of 1.
+	var got []string
+	for i := 0; i < 10; i++ {
+		got = append(got, next())
+	}
+	want := []string{"urgent", "urgent", "heavy", "none", "light", "heavy", "heavy", "none", "light", "heavy"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("claimed from %v, want %v", got, want)
+	}
+
+	// A paused campaign is skipped, and the rest carry on without it.
+	if _, err := q.SetCampaignStatus(ctx, heavy, store.CampaignPaused); err != nil {
+		t.Fatalf("pausing: %s", err)
+	}
+	got = got[:0]
+	for i := 0; i < 4; i++ {
+		got = append(got, next())
+	}
+	want = []string{"none", "light", "none", "light"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("claimed from %v with heavy paused, want %v", got, want)
+	}
+	if job, err := s.ClaimJob(ctx, nil); err != sql.ErrNoRows {
+		t.Fatalf("Scheduler.ClaimJob gave %+v, %v; want sql.ErrNoRows", job, err)
+	}
+
+	// Once everything is claimed, the scheduler looks again for new work.
+	if _, err := q.SetCampaignStatus(ctx, heavy, store.CampaignActive); err != nil {
+		t.Fatalf("resuming: %s", err)
+	}
+	if got := next(); got != "heavy" {
+		t.Fatalf("claimed from %s after resuming, want heavy", got)
+	}
+}
+
+func testExploration(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	c := createCampaign(t, q, bring, "explored", 0, 200)
+	other := createCampaign(t, q, bring, "other", 500, 510)
+	if _, err := q.Exploration(ctx, c.ID); err != sql.ErrNoRows {
+		t.Fatalf("Exploration of an unexplored campaign gave %v, want sql.ErrNoRows", err)
+	}
+	if err := q.CreateExploration(ctx, &store.Exploration{CampaignID: c.ID, BlockSize: 50, Stride: 10, Factor: 1}); err == nil {
+		t.Fatalf("created an exploration with a factor of 1")
+	}
+	e := &store.Exploration{CampaignID: c.ID, BlockSize: 50, Stride: 10, Factor: 5, MinHitRate: 0.1}
+	if err := q.CreateExploration(ctx, e); err != nil {
+		t.Fatalf("CreateExploration: %s", err)
+	}
+	if e.CreatedAt.IsZero() {
+		t.Fatalf("created %+v, want it filled in", e)
+	}
+	if again, err := q.Exploration(ctx, c.ID); err != nil || *again != *e {
+		t.Fatalf("Exploration gave %+v, %v; want %+v", again, err, e)
+	}
+
+	if blocks, err := q.ExploreBlocks(ctx, e); err != nil || len(blocks) != 0 {
+		t.Fatalf("ExploreBlocks gave %+v, %v; want no blocks", blocks, err)
+	}
+	err := q.SaveExploreBlocks(ctx, e, []store.ExploreBlock{
+		{Start: 50, Stride: 10, State: store.BlockSampling},
+		{Start: 0, Stride: 10, State: store.BlockSampling},
+	})
+	if err != nil {
+		t.Fatalf("SaveExploreBlocks: %s", err)
+	}
+	err = q.SaveExploreBlocks(ctx, e, []store.ExploreBlock{{Start: 0, Stride: 2, State: store.BlockSampling, Samples: 5, Hits: 1}})
+	if err != nil {
+		t.Fatalf("SaveExploreBlocks: %s", err)
+	}
+	err = q.SaveExploreBlocks(ctx, e, []store.ExploreBlock{
+		{Start: 100, Stride: 10, State: store.BlockSampling},
+		{Start: 150, Stride: 10, State: "bogus"},
+	})
+	if err == nil {
+		t.Fatalf("saved a block in an unknown state")
+	}
+
+	blocks, err := q.ExploreBlocks(ctx, e)
+	if err != nil {
+		t.Fatalf("ExploreBlocks: %s", err)
+	}
+	if len(blocks) != 2 || blocks[0].Start != 0 || blocks[1].Start != 50 {
+		t.Fatalf("ExploreBlocks gave %+v, want the blocks at 0 and 50", blocks)
+	}
+	if b := blocks[0]; b.Stride != 2 || b.State != store.BlockSampling || b.Samples != 5 || b.Hits != 1 || b.UpdatedAt.IsZero() {
+		t.Fatalf("block 0 is %+v, want it updated", b)
+	}
+
+	// The hits of an exploration are found from the jobs of its campaign.
+	for _, cc := range []*store.Campaign{c, other} {
+		if _, err := enqueue(q, cc, cc.Next+3); err != nil {
+			t.Fatalf("enqueueing: %s", err)
+		}
+	}
+	job := claim(t, q, bring)
+	if err := q.FinishJob(ctx, job, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+	jobs, err := q.Jobs(ctx, store.JobFilter{Campaign: c.ID})
+	if err != nil {
+		t.Fatalf("Jobs: %s", err)
+	}
+	if len(jobs) != 3 || jobs[0].Outcome != trackers.OutcomeFound.String() || jobs[1].Outcome != "" {
+		t.Fatalf("Jobs of the campaign gave %+v, want 3 jobs with the first found", jobs)
+	}
+
+	// Only the samples of blocks being sampled that are jobs of the
+	// campaign are summed up.
+	if err := q.SaveExploreBlocks(ctx, e, []store.ExploreBlock{{Start: 100, Stride: 10, State: store.BlockAbandoned}}); err != nil {
+		t.Fatalf("SaveExploreBlocks: %s", err)
+	}
+	samples := []store.ExploreSample{{Key: "0", Block: 0}, {Key: "1", Block: 0}, {Key: "2", Block: 100},
+		{Key: "500", Block: 50}, {Key: "7", Block: 50}}
+	for i := 0; i < 2; i++ {
+		if err := q.AddExploreSamples(ctx, e, samples); err != nil {
+			t.Fatalf("AddExploreSamples: %s", err)
+		}
+	}
+	stats, err := q.ExploreStats(ctx, e)
+	if err != nil {
+		t.Fatalf("ExploreStats: %s", err)
+	}
+	if want := []store.BlockStats{{Start: 0, Pending: 1, Samples: 1, Hits: 1}}; !reflect.DeepEqual(stats, want) {
+		t.Fatalf("ExploreStats gave %+v, want %+v", stats, want)
+	}
+}
+
+// waitingFollows returns the waiting follows of the tracker
+func waitingFollows(t *testing.T, q store.JobQueue, tracker int) []store.Follow {
+	t.Helper()
+
+	follows, err := q.WaitingFollows(context.Background(), tracker, 10)
+	if err != nil {
+		t.Fatalf("WaitingFollows: %s", err)
+	}
+	return follows
+}
+
+func testFollows(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	insert(t, q, bring, "a", "b")
+	first := claim(t, q, bring)
+	if err := q.FinishJob(ctx, first, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+	if err := q.FinishJob(ctx, claim(t, q, bring), notFound, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+
+	for _, want := range []int64{1, 0} {
+		if n, err := q.StartFollows(ctx, bring); err != nil || n != want {
+			t.Fatalf("StartFollows gave %d, %v; want %d", n, err, want)
+		}
+	}
+	follows := waitingFollows(t, q, bring)
+	if len(follows) != 1 {
+		t.Fatalf("WaitingFollows gave %+v, want the follow of job %d", follows, first.ID)
+	}
+	f := follows[0]
+	if f.JobID != first.ID || f.LastJobID != first.ID || f.Tracker != "bring" || f.State != store.FollowWaiting ||
+		f.FoundAt.IsZero() || f.Last.ID != first.ID || f.Last.Status != store.StatusSuccess ||
+		f.Last.Outcome != trackers.OutcomeFound.String() || f.Last.EndTime.IsZero() {
+		t.Fatalf("follow is %+v, want it waiting on job %d", f, first.ID)
+	}
+	sameJSON(t, f.Last.Resp, found.Body)
+
+	if err := q.SaveFollows(ctx, []store.Follow{{JobID: f.JobID, LastJobID: f.LastJobID, State: store.FollowScheduled}}); err == nil {
+		t.Fatalf("scheduled a follow-up without a time")
+	}
+	now := time.Now()
+	f.State, f.Status, f.NextAt = store.FollowScheduled, "IN_TRANSIT", now.Add(time.Hour)
+	if err := q.SaveFollows(ctx, []store.Follow{f}); err != nil {
+		t.Fatalf("SaveFollows: %s", err)
+	}
+	if follows := waitingFollows(t, q, bring); len(follows) != 0 {
+		t.Fatalf("WaitingFollows gave %+v after scheduling, want none", follows)
+	}
+
+	if n, err := q.FollowUp(ctx, bring, now, 5, 10); err != nil || n != 0 {
+		t.Fatalf("FollowUp before it is due gave %d, %v; want 0", n, err)
+	}
+	if n, err := q.FollowUp(ctx, bring, now.Add(2*time.Hour), 5, 10); err != nil || n != 1 {
+		t.Fatalf("FollowUp gave %d, %v; want 1", n, err)
+	}
+
+	// The follow-up is a job of its own, which doesn't get in the way of
+	// enqueueing the key again.
+	followUp := claim(t, q, bring)
+	if j := info(t, q, followUp.ID); j.FollowOf != first.ID || j.Priority != 5 || jobQ(t, j.Args) != "a" {
+		t.Fatalf("follow-up is %+v, want a follow-up of job %d", j, first.ID)
+	}
+	if res := insertMode(t, q, store.InsertSkip, bring, "a"); res.New != 0 || res.Existing != 1 {
+		t.Fatalf("enqueueing a again gave %+v, want it to exist", res)
+	}
+	if j := info(t, q, first.ID); j.FollowOf != 0 || j.Status != store.StatusSuccess {
+		t.Fatalf("the first job is %+v, want it left alone", j)
+	}
+	if follows := waitingFollows(t, q, bring); len(follows) != 0 {
+		t.Fatalf("WaitingFollows gave %+v with the follow-up running, want none", follows)
+	}
+	if err := q.FinishJob(ctx, followUp, found, nil); err != nil {
+		t.Fatalf("FinishJob: %s", err)
+	}
+	if n, err := q.StartFollows(ctx, bring); err != nil || n != 0 {
+		t.Fatalf("StartFollows gave %d, %v for a follow-up; want 0", n, err)
+	}
+
+	follows = waitingFollows(t, q, bring)
+	if len(follows) != 1 || follows[0].LastJobID != followUp.ID || follows[0].Checks != 1 || follows[0].Status != "IN_TRANSIT" {
+		t.Fatalf("WaitingFollows gave %+v, want the follow waiting on job %d", follows, followUp.ID)
+	}
+
+	// Saving a follow that has moved on leaves it alone.
+	if err := q.SaveFollows(ctx, []store.Follow{f}); err != nil {
+		t.Fatalf("SaveFollows: %s", err)
+	}
+	if again := waitingFollows(t, q, bring); len(again) != 1 {
+		t.Fatalf("saving an old follow changed it to %+v", again)
+	}
+
+	f = follows[0]
+	f.State, f.Status = store.FollowStopped, "DELIVERED"
+	if err := q.SaveFollows(ctx, []store.Follow{f}); err != nil {
+		t.Fatalf("SaveFollows: %s", err)
+	}
+	if n, err := q.FollowUp(ctx, bring, now.Add(time.Hour*24*365), 5, 10); err != nil || n != 0 {
+		t.Fatalf("FollowUp of a stopped follow gave %d, %v; want 0", n, err)
+	}
+	if follows := waitingFollows(t, q, bring); len(follows) != 0 {
+		t.Fatalf("WaitingFollows gave %+v after stopping, want none", follows)
+	}
+}
+
+func testConsignments(t *testing.T, newQueue Factory) {
+	q, bring := setup(t, newQueue, store.Config{})
+	defer q.Close()
+	ctx := context.Background()
+
+	insert(t, q, bring, "a", "b")
+	a, b := claim(t, q, bring), claim(t, q, bring)
+
+	at := time.Date(2019, 5, 17, 12, 30, 0, 0, time.UTC)
+	want := []trackers.Consignment{
+		{
+			ID: "70123", SenderName: "Sender", SenderCountryCode: "NO", RecipientCountryCode: "NO",
+			TotalWeightKg: 1.5, TotalVolumeDm3: 2,
+			Packages: []trackers.Package{
+				{
+					Number: "a", Brand: "POSTEN", StatusDescription: "Delivered", RecipientCity: "OSLO",
+					WeightKg: 1, LengthCm: 10, WidthCm: 20, HeightCm: 30,
+					Events: []trackers.Event{
+						{Time: at, Status: "IN_TRANSIT", City: "TRONDHEIM", CountryCode: "NO"},
+						{Time: at.Add(time.Hour), Status: "DELIVERED", UnitID: "0001", City: "OSLO"},
+						{Status: "NOTIFICATION_SENT"},
+					},
+				},
+				{Number: "c", PreviousNumber: "b", Events: []trackers.Event{}},
+			},
+		},
+		{ID: "70124", Packages: []trackers.Package{}},
+	}
+	if err := q.SaveConsignments(ctx, a.ID, want); err != nil {
+		t.Fatalf("SaveConsignments: %s", err)
+	}
+	// Saving again replaces what was saved, and other jobs keep their own.
+	if err := q.SaveConsignments(ctx, a.ID, want); err != nil {
+		t.Fatalf("SaveConsignments again: %s", err)
+	}
+	if err := q.SaveConsignments(ctx, b.ID, want[1:]); err != nil {
+		t.Fatalf("SaveConsignments: %s", err)
+	}
+	if err := q.SaveConsignments(ctx, b.ID+100, want); err == nil {
+		t.Fatalf("saved consignments for a job that doesn't exist")
+	}
+
+	for _, tc := range []struct {
+		job  int64
+		want []trackers.Consignment
+	}{{a.ID, want}, {b.ID, want[1:]}, {b.ID + 100, []trackers.Consignment{}}} {
+		got, err := q.Consignments(ctx, tc.job)
+		if err != nil {
+			t.Fatalf("Consignments: %s", err)
+		}
+		for _, c := range got {
+			for _, p := range c.Packages {
+				for i := range p.Events {
+					if !p.Events[i].Time.IsZero() {
+						p.Events[i].Time = p.Events[i].Time.UTC()
+					}
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Consignments of job %d gave %+v, want %+v", tc.job, got, tc.want)
+		}
+	}
+
+	if err := q.SaveConsignments(ctx, a.ID, nil); err != nil {
+		t.Fatalf("SaveConsignments: %s", err)
+	}
+	if got, err := q.Consignments(ctx, a.ID); err != nil || len(got) != 0 {
+		t.Fatalf("Consignments gave %+v, %v after saving none", got, err)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package bring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const apiURL = "https://tracking.bring.com/api/v2/tracking.json"
+
+func init() {
+	trackers.Register(Tracker{})
+}
+
+// Args are the arguments stored with a bring job
+type Args struct {
+	Q string `json:"q"`
+}
+
+// Tracker implements trackers.Tracker for the bring tracking api
+type Tracker struct{}
+
+// Name returns the name of the tracker in the trackers table
+func (Tracker) Name() string { return "bring" }
+
+// Version returns the version of the tracker. Bump it when changing how
+// requests are made or responses are classified.
+func (Tracker) Version() string { return "1" }
+
+// parseArgs decodes the args of a job
+func parseArgs(args []byte) (Args, error) {
+	var a Args
+	if err := json.Unmarshal(args, &a); err != nil {
+		return a, err
+	}
+	if a.Q == "" {
+		return a, errors.New("bring: job args is missing q")
+	}
+	return a, nil
+}
+
+// maxIDLength is longer than any tracking id bring hands out, but still
+// catches a whole line of a file ending up as an id.
+const maxIDLength = 64
+
+// Args returns the args of a job tracking id, which must be letters and
+// digits only, as all of bring's tracking numbers are.
+func (Tracker) Args(id string) ([]byte, error) {
+	if id == "" {
+		return nil, errors.New("bring: the tracking id is empty")
+	}
+	if len(id) > maxIDLength {
+		return nil, fmt.Errorf("bring: the tracking id %.20q... is longer than %d characters", id, maxIDLength)
+	}
+	for _, r := range id {
+		if !('0' <= r && r <= '9' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z') {
+			return nil, fmt.Errorf("bring: the tracking id %q has a %q in it, which isn't a letter or digit", id, r)
+		}
+	}
+	return json.Marshal(Args{Q: id})
+}
+
+// Key returns the id being tracked. The scrape_jobs migration that added
+// keys does the same thing in SQL, so keep them in step.
+func (Tracker) Key(args []byte) (string, error) {
+	a, err := parseArgs(args)
+	return a.Q, err
+}
+
+// NewRequest creates a request for the given job args
+func (Tracker) NewRequest(args []byte) (*http.Request, error) {
+	a, err := parseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequest("GET", apiURL+"?q="+url.QueryEscape(a.Q), nil)
+}
+
+// Classify looks at the consignment set errors to decide what the
+// response means.
+func (t Tracker) Classify(resp *http.Response, body []byte) (trackers.Outcome, error) {
+	if limited, _ := t.RateLimit(resp, body); limited {
+		return trackers.OutcomeRateLimited, nil
+	}
+
+	var ape APIResponseError
+	if err := json.Unmarshal(body, &ape); err != nil {
+		return trackers.OutcomeError, fmt.Errorf("bring: %s: %s", resp.Status, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return trackers.OutcomeError, fmt.Errorf("bring: unexpected status %s", resp.Status)
+	}
+
+	outcome := trackers.OutcomeFound
+	for _, v := range ape.ConsignmentSet {
+		switch v.Error.Code {
+		case 0:
+		case 404:
+			outcome = trackers.OutcomeNotFound
+		default:
+			return trackers.OutcomeError, fmt.Errorf("bring: error %d: %s", v.Error.Code, v.Error.Message)
+		}
+	}
+	return outcome, nil
+}
+
+// RateLimit reports if we have been rate limited. Bring does this by giving
+// an error with code 503 on the consignment.
+func (Tracker) RateLimit(resp *http.Response, body []byte) (bool, time.Duration) {
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true, retryAfter
+	}
+
+	var ape APIResponseError
+	if err := json.Unmarshal(body, &ape); err != nil {
+		return false, 0
+	}
+	for _, v := range ape.ConsignmentSet {
+		if v.Error.Code == 503 {
+			return true, retryAfter
+		}
+	}
+	return false, 0
+}
+
+// finalStatuses are the event statuses after which nothing more happens to
+// a package, as it has been delivered, picked up or returned to the sender.
+var finalStatuses = map[string]bool{
+	"DELIVERED":        true,
+	"COLLECTED":        true,
+	"DELIVERED_SENDER": true,
+	"RETURNED":         true,
+}
+
+// Status returns the status of the latest event of the packages in the
+// response, which bring lists first. The status is final once every package
+// has a final status, and until then it is that of the first package that
+// hasn't.
+func (Tracker) Status(body []byte) (string, bool, error) {
+	var resp APIResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", false, fmt.Errorf("bring: %s", err.Error())
+	}
+
+	var status string
+	for _, c := range resp.ConsignmentSet {
+		for _, p := range c.PackageSet {
+			if len(p.EventSet) == 0 {
+				return "", false, nil
+			}
+			status = p.EventSet[0].Status
+			if !finalStatuses[status] {
+				return status, false, nil
+			}
+		}
+	}
+	return status, status != "", nil
+}
+
+// Parse turns the consignments of a response into trackers.Consignments
+func (Tracker) Parse(body []byte) ([]trackers.Consignment, error) {
+	var resp APIResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("bring: %s", err.Error())
+	}
+
+	consignments := make([]trackers.Consignment, 0, len(resp.ConsignmentSet))
+	for _, c := range resp.ConsignmentSet {
+		tc := trackers.Consignment{
+			ID:                   c.ConsignmentID,
+			PreviousID:           c.PreviousConsignmentID,
+			SenderName:           c.SenderName,
+			SenderReference:      c.SenderReference,
+			SenderCountryCode:    c.SenderAddress.CountryCode,
+			RecipientCountryCode: c.RecipientAddress.CountryCode,
+			TotalWeightKg:        c.TotalWeightInKgs,
+			TotalVolumeDm3:       c.TotalVolumeInDm3,
+			Packages:             make([]trackers.Package, 0, len(c.PackageSet)),
+		}
+		for _, p := range c.PackageSet {
+			tp := trackers.Package{
+				Number:              p.PackageNumber,
+				PreviousNumber:      p.PreviousPackageNumber,
+				ProductName:         p.ProductName,
+				ProductCode:         p.ProductCode,
+				Brand:               p.Brand,
+				StatusDescription:   p.StatusDescription,
+				SenderName:          p.SenderName,
+				RecipientPostalCode: p.RecipientAddress.PostalCode,
+				RecipientCity:       p.RecipientAddress.City,
+				RecipientCountry:    p.RecipientAddress.Country,
+				WeightKg:            p.WeightInKgs,
+				VolumeDm3:           p.VolumeInDm3,
+				LengthCm:            p.LengthInCm,
+				WidthCm:             p.WidthInCm,
+				HeightCm:            p.HeightInCm,
+				Events:              make([]trackers.Event, 0, len(p.EventSet)),
+			}
+			for _, e := range p.EventSet {
+				tp.Events = append(tp.Events, trackers.Event{
+					Time:        e.DateIso,
+					Status:      e.Status,
+					Description: e.Description,
+					UnitID:      e.UnitID,
+					UnitType:    e.UnitType,
+					PostalCode:  e.PostalCode,
+					City:        e.City,
+					CountryCode: e.CountryCode,
+					Country:     e.Country,
+				})
+			}
+			tc.Packages = append(tc.Packages, tp)
+		}
+		consignments = append(consignments, tc)
+	}
+	return consignments, nil
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package bring
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhermes/packtrack/trackers"
+)
+
+// body returns a response body recorded from the bring api
+func body(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// response returns a response with the given status code and headers
+func response(code int, header ...string) *http.Response {
+	resp := &http.Response{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Header:     make(http.Header),
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		resp.Header.Set(header[i], header[i+1])
+	}
+	return resp
+}
+
+func TestArgs(t *testing.T) {
+	for _, id := range []string{"LA123456789NO", "70438101015432907"} {
+		args, err := Tracker{}.Args(id)
+		if err != nil {
+			t.Fatalf("Args(%q): %s", id, err)
+		}
+		key, err := Tracker{}.Key(args)
+		if err != nil {
+			t.Fatalf("Key(%s): %s", args, err)
+		}
+		if key != id {
+			t.Errorf("Key(Args(%q)) = %q", id, key)
+		}
+		req, err := Tracker{}.NewRequest(args)
+		if err != nil {
+			t.Fatalf("NewRequest(%s): %s", args, err)
+		}
+		if q := req.URL.Query().Get("q"); q != id {
+			t.Errorf("NewRequest(%s) asks for %q", args, q)
+		}
+	}
+
+	for _, id := range []string{"", "LA 123456789NO", "LA123456789NO\n", "æøå", strings.Repeat("1", maxIDLength+1)} {
+		if _, err := (Tracker{}).Args(id); err == nil {
+			t.Errorf("Args(%q) gave no error", id)
+		}
+	}
+	for _, args := range []string{``, `{}`, `{"q":""}`, `"LA123456789NO"`} {
+		if _, err := (Tracker{}).Key([]byte(args)); err == nil {
+			t.Errorf("Key(%s) gave no error", args)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		resp       *http.Response
+		body       []byte
+		want       trackers.Outcome
+		err        bool
+		limited    bool
+		retryAfter time.Duration
+	}{
+		{"found", response(200), body(t, "found_in_transit.json"), trackers.OutcomeFound, false, false, 0},
+		{"found without events", response(200), body(t, "no_events.json"), trackers.OutcomeFound, false, false, 0},
+		{"not found", response(200), body(t, "not_found.json"), trackers.OutcomeNotFound, false, false, 0},
+		{"too many requests", response(429, "Retry-After", "120"), []byte("Too Many Requests\n"), trackers.OutcomeRateLimited, false, true, 2 * time.Minute},
+		{"too many requests without retry after", response(429), nil, trackers.OutcomeRateLimited, false, true, 0},
+		{"consignment unavailable", response(200), body(t, "unavailable.json"), trackers.OutcomeRateLimited, false, true, 0},
+		{"consignment unavailable with retry after", response(200, "Retry-After", "30"), body(t, "unavailable.json"), trackers.OutcomeRateLimited, false, true, 30 * time.Second},
+		{"consignment error", response(200), body(t, "server_error.json"), trackers.OutcomeError, true, false, 0},
+		{"server error", response(500), []byte(`{"apiVersion":"2","consignmentSet":[]}`), trackers.OutcomeError, true, false, 0},
+		{"not json", response(502), []byte("<html>Bad Gateway</html>"), trackers.OutcomeError, true, false, 0},
+		{"retry after on another response", response(200, "Retry-After", "30"), body(t, "found_delivered.json"), trackers.OutcomeFound, false, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Tracker{}.Classify(tt.resp, tt.body)
+			if got != tt.want || (err != nil) != tt.err {
+				t.Errorf("Classify = %s, %v, want %s with error %t", got, err, tt.want, tt.err)
+			}
+			limited, retryAfter := Tracker{}.RateLimit(tt.resp, tt.body)
+			if limited != tt.limited || retryAfter != tt.retryAfter {
+				t.Errorf("RateLimit = %t, %s, want %t, %s", limited, retryAfter, tt.limited, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		file   string
+		status string
+		final  bool
+	}{
+		// The first package is still on its way, even though the second
+		// has been delivered.
+		{"found_in_transit.json", "IN_TRANSIT", false},
+		{"found_delivered.json", "COLLECTED", true},
+		{"no_events.json", "", false},
+		{"not_found.json", "", false},
+	}
+	for _, tt := range tests {
+		status, final, err := Tracker{}.Status(body(t, tt.file))
+		if err != nil {
+			t.Fatalf("Status(%s): %s", tt.file, err)
+		}
+		if status != tt.status || final != tt.final {
+			t.Errorf("Status(%s) = %q, %t, want %q, %t", tt.file, status, final, tt.status, tt.final)
+		}
+	}
+
+	if _, _, err := (Tracker{}).Status([]byte("<html>")); err == nil {
+		t.Error("Status of a body that isn't json gave no error")
+	}
+}
+
+func TestParse(t *testing.T) {
+	cet := time.FixedZone("", 2*60*60)
+	got, err := Tracker{}.Parse(body(t, "found_in_transit.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []trackers.Consignment{{
+		ID:                   "70438101015432907",
+		SenderName:           "NETTBUTIKKEN AS",
+		SenderReference:      "ORDER-48213",
+		SenderCountryCode:    "NO",
+		RecipientCountryCode: "NO",
+		TotalWeightKg:        3.3,
+		TotalVolumeDm3:       17.4,
+		Packages: []trackers.Package{
+			{
+				Number:              "370438101264567811",
+				ProductName:         "Klimanøytral Servicepakke",
+				ProductCode:         "1202",
+				Brand:               "POSTEN",
+				StatusDescription:   "The shipment is on its way",
+				SenderName:          "NETTBUTIKKEN AS",
+				RecipientPostalCode: "7030",
+				RecipientCity:       "TRONDHEIM",
+				RecipientCountry:    "Norway",
+				WeightKg:            2.5,
+				VolumeDm3:           14.4,
+				LengthCm:            40,
+				WidthCm:             30,
+				HeightCm:            12,
+				Events: []trackers.Event{
+					{
+						Time:        time.Date(2019, 7, 23, 6, 12, 31, 0, cet),
+						Status:      "IN_TRANSIT",
+						Description: "The shipment has arrived at the terminal",
+						UnitID:      "030900",
+						UnitType:    "TERMINAL",
+						PostalCode:  "7088",
+						City:        "HEIMDAL",
+						CountryCode: "NO",
+						Country:     "Norway",
+					},
+					{
+						Time:        time.Date(2019, 7, 22, 16, 45, 2, 0, cet),
+						Status:      "HANDED_IN",
+						Description: "The shipment has been handed in at the terminal",
+						UnitID:      "032850",
+						UnitType:    "TERMINAL",
+						PostalCode:  "1081",
+						City:        "OSLO",
+						CountryCode: "NO",
+						Country:     "Norway",
+					},
+				},
+			},
+			{
+				Number:              "370438101264567828",
+				ProductName:         "Klimanøytral Servicepakke",
+				ProductCode:         "1202",
+				Brand:               "POSTEN",
+				StatusDescription:   "The shipment has been delivered",
+				SenderName:          "NETTBUTIKKEN AS",
+				RecipientPostalCode: "7030",
+				RecipientCity:       "TRONDHEIM",
+				RecipientCountry:    "Norway",
+				WeightKg:            0.8,
+				VolumeDm3:           3,
+				LengthCm:            20,
+				WidthCm:             15,
+				HeightCm:            10,
+				Events: []trackers.Event{{
+					Time:        time.Date(2019, 7, 23, 13, 2, 0, 0, cet),
+					Status:      "DELIVERED",
+					Description: "The shipment has been delivered",
+					UnitID:      "7030",
+					UnitType:    "DELIVERY_UNIT",
+					PostalCode:  "7030",
+					City:        "TRONDHEIM",
+					CountryCode: "NO",
+					Country:     "Norway",
+				}},
+			},
+		},
+	}}
+	if len(got) != len(want) || len(got[0].Packages) != len(want[0].Packages) {
+		t.Fatalf("Parse = %+v\nwant %+v", got, want)
+	}
+	// Compare the times apart, as the locations differ.
+	for i, p := range got[0].Packages {
+		for j, e := range p.Events {
+			if j >= len(want[0].Packages[i].Events) {
+				break
+			}
+			w := want[0].Packages[i].Events[j].Time
+			if !e.Time.Equal(w) {
+				t.Errorf("package %d event %d happened at %s, want %s", i, j, e.Time, w)
+			}
+			got[0].Packages[i].Events[j].Time = w
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse = %+v\nwant %+v", got, want)
+	}
+
+	got, err = Tracker{}.Parse(body(t, "not_found.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "" || len(got[0].Packages) != 0 {
+		t.Errorf("Parse of not found = %+v, want one empty consignment", got)
+	}
+}
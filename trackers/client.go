@@ -0,0 +1,255 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package trackers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rhermes/packtrack/ratelimit"
+)
+
+// CrawlRequest is a job we want the crawler to look up
+type CrawlRequest struct {
+	ID int64
+	// Tracker is the name of the tracker the job is for
+	Tracker string
+	Args    []byte
+}
+
+// CrawlResponse is what the tracker gave back for a request
+type CrawlResponse struct {
+	Input  CrawlRequest
+	Worker string
+	Result *Result
+}
+
+// CrawlError is a request that couldn't be made
+type CrawlError struct {
+	Input  CrawlRequest
+	Worker string
+	Error  error
+}
+
+// Lane is a tracker the client makes requests to, with a rate limit of its
+// own so the trackers don't hold each other up.
+type Lane struct {
+	// Tracker makes the requests, and decides what came of them
+	Tracker Tracker
+
+	// Buffer is how many requests may wait for the limiter
+	Buffer int
+
+	// Limiter decides when the next request can be made
+	Limiter ratelimit.Limiter
+}
+
+// ClientConfig configures a Client
+type ClientConfig struct {
+	// Lanes are the trackers the client makes requests to
+	Lanes []Lane
+
+	// Workers is how many requests are made at the same time, shared by
+	// all the lanes.
+	Workers int
+
+	OutputBuffer int
+	ErrorBuffer  int
+
+	// Timeout is the most time a single request may take, zero is no limit
+	Timeout time.Duration
+}
+
+// Client performs the requests of jobs with a pool of workers, shared by the
+// trackers it makes requests to.
+type Client struct {
+	ctx             context.Context
+	lanes           map[string]*lane
+	hc              http.Client
+	timeout         time.Duration
+	wg              sync.WaitGroup
+	wgLanes         sync.WaitGroup
+	chanRateLimited chan CrawlRequest
+	chanOutputs     chan CrawlResponse
+	chanErrors      chan CrawlError
+	chanRoom        chan struct{}
+}
+
+// lane is the queue of requests for a tracker, waiting for its limiter
+type lane struct {
+	tracker Tracker
+	limiter ratelimit.Limiter
+	inputs  chan CrawlRequest
+}
+
+// NewClient returns a new client which we can use to crawl. When ctx is
+// done, the requests being made are aborted, and the requests not yet made
+// are given back on the error channel with the error of ctx.
+func NewClient(ctx context.Context, cfg ClientConfig) (*Client, error) {
+	if len(cfg.Lanes) == 0 {
+		return nil, fmt.Errorf("the client needs a tracker to make requests to")
+	}
+
+	c := &Client{
+		ctx:             ctx,
+		lanes:           make(map[string]*lane, len(cfg.Lanes)),
+		timeout:         cfg.Timeout,
+		chanRateLimited: make(chan CrawlRequest),
+		chanOutputs:     make(chan CrawlResponse, cfg.OutputBuffer),
+		chanErrors:      make(chan CrawlError, cfg.ErrorBuffer),
+		chanRoom:        make(chan struct{}, 1),
+	}
+	for _, l := range cfg.Lanes {
+		if l.Tracker == nil || l.Limiter == nil {
+			return nil, fmt.Errorf("every lane of the client needs a tracker and a limiter")
+		}
+		name := l.Tracker.Name()
+		if c.lanes[name] != nil {
+			return nil, fmt.Errorf("the client has two lanes for %s", name)
+		}
+		c.lanes[name] = &lane{tracker: l.Tracker, limiter: l.Limiter, inputs: make(chan CrawlRequest, l.Buffer)}
+	}
+
+	for _, l := range c.lanes {
+		c.wgLanes.Add(1)
+		go c.runRateLimiter(l)
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		c.wg.Add(1)
+		go c.runWorker(fmt.Sprintf("worker-%02d", i))
+	}
+
+	return c, nil
+}
+
+// Ready tells if the lane of the named tracker has room for another request
+// without Send blocking. It is only accurate as long as nobody else sends.
+func (c *Client) Ready(tracker string) bool {
+	l := c.lanes[tracker]
+	return l != nil && len(l.inputs) < cap(l.inputs)
+}
+
+// Room gets a value when a lane has made room for another request
+func (c *Client) Room() <-chan struct{} { return c.chanRoom }
+
+// Send gives the crawler a new request, waiting for room in the lane of its
+// tracker. Requests for a tracker the client has no lane for are given back
+// on the error channel.
+func (c *Client) Send(req CrawlRequest) {
+	l := c.lanes[req.Tracker]
+	if l == nil {
+		c.chanErrors <- CrawlError{req, "client", fmt.Errorf("the client makes no requests to %q", req.Tracker)}
+		return
+	}
+	l.inputs <- req
+}
+
+// Outputs returns a channel with the output from the crawlers
+func (c *Client) Outputs() <-chan CrawlResponse { return c.chanOutputs }
+
+// Errors returns a channel with errors from the crawlers
+func (c *Client) Errors() <-chan CrawlError { return c.chanErrors }
+
+// Close the scraping process
+func (c *Client) Close() error {
+	for _, l := range c.lanes {
+		close(l.inputs)
+	}
+	c.wgLanes.Wait()
+	close(c.chanRateLimited)
+	c.wg.Wait()
+	close(c.chanErrors)
+	close(c.chanOutputs)
+	return nil
+}
+
+// runRateLimiter rate limits the requests of a lane
+func (c *Client) runRateLimiter(l *lane) {
+	defer c.wgLanes.Done()
+
+	for req := range l.inputs {
+		// There is room in the lane now, which whoever sends may want to
+		// know.
+		select {
+		case c.chanRoom <- struct{}{}:
+		default:
+		}
+
+		if err := c.wait(l.limiter); err != nil {
+			c.chanErrors <- CrawlError{req, "ratelimiter", err}
+			continue
+		}
+		c.chanRateLimited <- req
+	}
+}
+
+// wait waits for the limiter to let us through, retrying when it fails, until
+// the context of the client is done.
+func (c *Client) wait(limiter ratelimit.Limiter) error {
+	for {
+		err := limiter.Wait(c.ctx)
+		if err == nil {
+			return nil
+		}
+		if c.ctx.Err() != nil {
+			return c.ctx.Err()
+		}
+		log.Printf("Error waiting on the rate limiter, trying again in a second: %s\n", err.Error())
+		if err := ratelimit.Sleep(c.ctx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// do performs a single request, bounded by the timeout of the client
+func (c *Client) do(t Tracker, args []byte) (*Result, error) {
+	ctx := c.ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return Do(ctx, &c.hc, t, args)
+}
+
+func (c *Client) runWorker(id string) {
+	log.Printf("[%s] worker started.\n", id)
+	for req := range c.chanRateLimited {
+		log.Printf("[%s] Start processing job %d\n", id, req.ID)
+
+		res, err := c.do(c.lanes[req.Tracker].tracker, req.Args)
+		if err != nil {
+			c.chanErrors <- CrawlError{req, id, err}
+			log.Printf("[%s] Stopped processing job %d\n", id, req.ID)
+			continue
+		}
+
+		c.chanOutputs <- CrawlResponse{Input: req, Worker: id, Result: res}
+
+		log.Printf("[%s] Stopped processing job %d\n", id, req.ID)
+	}
+	log.Printf("[%s] worker stopped.\n", id)
+	c.wg.Done()
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package trackers
+
+import "time"
+
+// Parser is implemented by trackers that can make sense of the body of a
+// response that found something, so what it says can be kept in tables of
+// its own rather than only as the raw response.
+type Parser interface {
+	// Parse returns the consignments in the body of a response
+	Parse(body []byte) ([]Consignment, error)
+}
+
+// Consignment is a shipment of one or more packages, as a tracker reports it
+type Consignment struct {
+	ID string
+	// PreviousID is the id the consignment had before, if the tracker
+	// gave it a new one.
+	PreviousID string
+
+	SenderName      string
+	SenderReference string
+	// SenderCountryCode and RecipientCountryCode are ISO 3166 country
+	// codes.
+	SenderCountryCode    string
+	RecipientCountryCode string
+
+	TotalWeightKg  float64
+	TotalVolumeDm3 float64
+
+	Packages []Package
+}
+
+// Package is a single package of a consignment
+type Package struct {
+	Number         string
+	PreviousNumber string
+
+	ProductName string
+	ProductCode string
+	// Brand is who the package was sent through
+	Brand string
+	// StatusDescription is what the tracker says about where the package
+	// is, for people.
+	StatusDescription string
+
+	SenderName          string
+	RecipientPostalCode string
+	RecipientCity       string
+	RecipientCountry    string
+
+	WeightKg  float64
+	VolumeDm3 float64
+	LengthCm  int
+	WidthCm   int
+	HeightCm  int
+
+	Events []Event
+}
+
+// Event is something that happened to a package
+type Event struct {
+	Time        time.Time
+	Status      string
+	Description string
+	// UnitID and UnitType are the place the event happened at, like a
+	// terminal or a pickup point.
+	UnitID      string
+	UnitType    string
+	PostalCode  string
+	City        string
+	CountryCode string
+	Country     string
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package trackers
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings is how long the parts of a request took. Parts that didn't
+// happen, like DNS for a reused connection, are zero.
+type Timings struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+	Total     time.Duration
+}
+
+// tracer records Timings through a httptrace.ClientTrace. The hooks can be
+// called from other goroutines, hence the mutex.
+type tracer struct {
+	mu       sync.Mutex
+	start    time.Time
+	dnsStart time.Time
+	conStart time.Time
+	tlsStart time.Time
+	t        Timings
+}
+
+func newTracer() *tracer {
+	return &tracer{start: time.Now()}
+}
+
+func (tr *tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tr.mu.Lock()
+			tr.dnsStart = time.Now()
+			tr.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tr.mu.Lock()
+			tr.t.DNS = time.Since(tr.dnsStart)
+			tr.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			tr.mu.Lock()
+			tr.conStart = time.Now()
+			tr.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			tr.mu.Lock()
+			tr.t.Connect = time.Since(tr.conStart)
+			tr.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			tr.mu.Lock()
+			tr.tlsStart = time.Now()
+			tr.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tr.mu.Lock()
+			tr.t.TLS = time.Since(tr.tlsStart)
+			tr.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			tr.mu.Lock()
+			tr.t.FirstByte = time.Since(tr.start)
+			tr.mu.Unlock()
+		},
+	}
+}
+
+// done returns the timings, with Total counted up until now
+func (tr *tracer) done() Timings {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.t.Total = time.Since(tr.start)
+	return tr.t
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package trackers holds the interface every carrier implements, and the
+// registry the store uses to find the right one for a job.
+package trackers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcome is what came out of asking a tracker about a job
+type Outcome int
+
+const (
+	// OutcomeFound means the tracker knew about the id
+	OutcomeFound Outcome = iota
+	// OutcomeNotFound means the tracker answered, but didn't know the id
+	OutcomeNotFound
+	// OutcomeRateLimited means the tracker wants us to slow down
+	OutcomeRateLimited
+	// OutcomeError means the answer was not something we understood
+	OutcomeError
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeFound:
+		return "found"
+	case OutcomeNotFound:
+		return "not-found"
+	case OutcomeRateLimited:
+		return "rate-limited"
+	case OutcomeError:
+		return "error"
+	default:
+		return fmt.Sprintf("outcome(%d)", int(o))
+	}
+}
+
+// Tracker is implemented by every carrier we know how to scrape.
+type Tracker interface {
+	// Name is the name of the tracker, as found in the trackers table.
+	Name() string
+
+	// Version is the version of the implementation, stored with the stats
+	// of every job so we know what produced a response.
+	Version() string
+
+	// Key returns what identifies the job with the given args, so the same
+	// thing isn't queued twice. Jobs with the same key are the same job.
+	Key(args []byte) (string, error)
+
+	// NewRequest builds the request for a job, given the args stored with it.
+	NewRequest(args []byte) (*http.Request, error)
+
+	// Classify decides what the response to a request means. The error
+	// describes the problem when the outcome is OutcomeError.
+	Classify(resp *http.Response, body []byte) (Outcome, error)
+
+	// RateLimit reports if the response tells us to back off, and for how
+	// long, if the tracker was kind enough to say.
+	RateLimit(resp *http.Response, body []byte) (bool, time.Duration)
+}
+
+// Enqueuer is implemented by trackers that can make the args of a job from
+// a tracking id, which is how ids read from files are enqueued.
+type Enqueuer interface {
+	// Args checks that id looks like something the tracker can track, and
+	// returns the args of a job for it.
+	Args(id string) ([]byte, error)
+}
+
+// Follower is implemented by trackers that can tell from a response where
+// what was found has gotten to, which is how it is followed until it gets
+// where it is going.
+type Follower interface {
+	// Status returns the status of the latest event in the body of a
+	// response that found something, and if it is final, like delivered,
+	// so asking again won't tell us anything new.
+	Status(body []byte) (status string, final bool, err error)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Tracker)
+)
+
+// Register makes a tracker available under its name. It panics if called
+// twice with the same name, or with a nil tracker.
+func Register(t Tracker) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if t == nil {
+		panic("trackers: Register tracker is nil")
+	}
+	name := t.Name()
+	if _, dup := registry[name]; dup {
+		panic("trackers: Register called twice for tracker " + name)
+	}
+	registry[name] = t
+}
+
+// Get returns the tracker registered under name.
+func Get(name string) (Tracker, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	t, ok := registry[name]
+	return t, ok
+}
+
+// Names returns a sorted list of the names of the registered trackers.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Result is what we got back from a tracker for a single request
+type Result struct {
+	StatusCode int
+	Body       []byte
+	Outcome    Outcome
+
+	// TrackerVersion is the version of the tracker that made the request
+	TrackerVersion string
+
+	// Timings is how long the parts of the request took
+	Timings Timings
+
+	// Err describes the problem when Outcome is OutcomeError
+	Err error
+
+	// RetryAfter is how long the tracker asked us to back off, if it did
+	RetryAfter time.Duration
+}
+
+// ArgsError is returned by Do when the args of a job can't be made into a
+// request. Trying the same args again will not help.
+type ArgsError struct {
+	Err error
+}
+
+func (e *ArgsError) Error() string { return "bad job args: " + e.Err.Error() }
+
+// Do performs the request for a job with the given tracker, and classifies
+// the response. Errors are returned for args we can't make a request from,
+// and for when we don't get a response at all, including when ctx is done
+// before the response has been read.
+func Do(ctx context.Context, hc *http.Client, t Tracker, args []byte) (*Result, error) {
+	req, err := t.NewRequest(args)
+	if err != nil {
+		return nil, &ArgsError{err}
+	}
+
+	tr := newTracer()
+	req = req.WithContext(httptrace.WithClientTrace(ctx, tr.clientTrace()))
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	err2 := resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+
+	res := &Result{
+		StatusCode:     resp.StatusCode,
+		Body:           data,
+		TrackerVersion: t.Version(),
+		Timings:        tr.done(),
+	}
+	res.Outcome, res.Err = t.Classify(resp, data)
+	if res.Outcome == OutcomeRateLimited {
+		_, res.RetryAfter = t.RateLimit(resp, data)
+	}
+	return res, nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2019 Teodor Spæren
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rhermes/packtrack/config"
+	"github.com/rhermes/packtrack/ratelimit"
+	"github.com/rhermes/packtrack/store"
+	"github.com/rhermes/packtrack/trackers"
+)
+
+const workHelp = `
+Work claims jobs from the queues of one or more trackers and performs them,
+until it gets SIGINT or SIGTERM. The workers are shared by the trackers by
+their weight, each tracker with its own rate limit. The requests being made are then aborted, and the
+jobs claimed but not finished are given back to the queue before it exits.
+`
+
+func workCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("work", "-nodeid id [flags]", workHelp)
+	cfg := config.Default()
+	configPath := configFlags(fs, cfg)
+	fs.StringVar(&cfg.NodeID, "nodeid", cfg.NodeID, "the nodeid for this node")
+	fs.StringVar(&cfg.Work.Tracker, "tracker", cfg.Work.Tracker, "the names of the trackers we will be using, separated by commas")
+	fs.IntVar(&cfg.Work.Workers, "workers", cfg.Work.Workers, "How many jobs to perform at the same time")
+	fs.DurationVar(&cfg.Work.Lease.Duration, "lease", cfg.Work.Lease.Duration, "How long we may hold a job before it is given to someone else")
+	fs.DurationVar(&cfg.Work.RequestTimeout.Duration, "timeout", cfg.Work.RequestTimeout.Duration, "The most time a single request may take")
+	fs.DurationVar(&cfg.Work.Heartbeat.Duration, "heartbeat", cfg.Work.Heartbeat.Duration, "How often this node tells the others it is alive")
+	fs.DurationVar(&cfg.Work.DeadNodeAfter.Duration, "deadNodeAfter", cfg.Work.DeadNodeAfter.Duration, "How long without a heartbeat before a node is considered dead")
+	fs.IntVar(&cfg.Retry.MaxAttempts, "maxAttempts", cfg.Retry.MaxAttempts, "How many times a job is tried before it is dead")
+
+	// These are the limits for the trackers we work, on top of their config.
+	lim := config.DefaultTracker()
+	fs.DurationVar(&lim.RateLimit.Duration, "rateLimit", lim.RateLimit.Duration, "The time between each request this node makes")
+	fs.BoolVar(&lim.Adaptive, "adaptive", lim.Adaptive, "Adapt the rate to how the tracker responds, starting at one request per rateLimit")
+	fs.Float64Var(&lim.MinRate, "minRate", lim.MinRate, "The lowest requests per second the adaptive rate goes to")
+	fs.Float64Var(&lim.MaxRate, "maxRate", lim.MaxRate, "The highest requests per second the adaptive rate goes to")
+	fs.DurationVar(&lim.SlowLatency.Duration, "slowLatency", lim.SlowLatency.Duration, "Requests slower than this make the adaptive rate go down")
+	fs.DurationVar(&lim.RateLimitPause.Duration, "rateLimitPause", lim.RateLimitPause.Duration, "How long to stop making requests after being ratelimited")
+	fs.Float64Var(&lim.FleetRate, "fleetRate", lim.FleetRate, "Requests per second allowed for all nodes together, shared through the database. 0 disables it")
+	fs.Float64Var(&lim.FleetBurst, "fleetBurst", lim.FleetBurst, "How many requests the nodes together may burst above the fleet rate")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	given, err := loadConfig(fs, cfg, *configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.NodeID == "" {
+		return usageErrorf(fs, "NodeID is required")
+	}
+	names := strings.Split(cfg.Work.Tracker, ",")
+
+	s, err := store.Open(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var worked []*workedTracker
+	seen := make(map[string]bool)
+	for _, name := range names {
+		t, err := findTracker(ctx, s, strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		if seen[t.Name] {
+			return usageErrorf(fs, "Tracker %s is given twice", t.Name)
+		}
+		seen[t.Name] = true
+		// Now that we know the tracker, we can start from its limits,
+		// with the flags on top again.
+		lim = cfg.Tracker(t.Name)
+		if err := given.apply(fs); err != nil {
+			return err
+		}
+		if err := lim.Validate(); err != nil {
+			return err
+		}
+
+		limiter, err := newLimiter(ctx, s, t, lim)
+		if err != nil {
+			return err
+		}
+
+		// findTracker made sure we have an implementation. Not every
+		// tracker can be parsed, their jobs are then only kept raw.
+		impl, _ := trackers.Get(t.Name)
+		parser, _ := impl.(trackers.Parser)
+		worked = append(worked, &workedTracker{
+			Tracker: t,
+			Impl:    impl,
+			Weight:  lim.Weight,
+			Parser:  parser,
+			Limiter: limiter,
+			Pause:   lim.RateLimitPause.Duration,
+		})
+	}
+
+	p, err := newPerformer(ctx, s, performerConfig{
+		Trackers:      worked,
+		Workers:       cfg.Work.Workers,
+		Timeout:       cfg.Work.RequestTimeout.Duration,
+		Heartbeat:     cfg.Work.Heartbeat.Duration,
+		DeadNodeAfter: cfg.Work.DeadNodeAfter.Duration,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-p.Done():
+		if ctx.Err() == nil {
+			p.Close()
+			return fmt.Errorf("node %s was marked as dead by the others", cfg.NodeID)
+		}
+	}
+	log.Printf("Giving back the jobs we have claimed\n")
+	return p.Close()
+}
+
+// newLimiter returns the rate limiter for the requests of this node to the
+// tracker, shared with the other nodes if the tracker has a fleet rate.
+func newLimiter(ctx context.Context, s store.Backend, t store.Tracker, lim config.Tracker) (ratelimit.Limiter, error) {
+	var local ratelimit.Limiter = ratelimit.NewInterval(lim.RateLimit.Duration)
+	if lim.Adaptive {
+		local = ratelimit.NewAIMD(ratelimit.AIMDConfig{
+			StartRate:   1 / lim.RateLimit.Seconds(),
+			MinRate:     lim.MinRate,
+			MaxRate:     lim.MaxRate,
+			Increase:    0.01,
+			Decrease:    0.5,
+			SlowLatency: lim.SlowLatency.Duration,
+		})
+	}
+
+	limiter := ratelimit.Chain{local}
+	if lim.FleetRate > 0 {
+		sl, ok := s.(store.SharedLimiter)
+		if !ok {
+			return nil, fmt.Errorf("fleet_rate is set, but the database can't share a rate limit between nodes")
+		}
+		fleet, err := sl.RateLimiter(ctx, t.ID, lim.FleetRate, lim.FleetBurst)
+		if err != nil {
+			return nil, err
+		}
+		limiter = append(limiter, fleet)
+	}
+	return limiter, nil
+}